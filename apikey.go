@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+/*
+ * API KEYS
+ * Long lived keys for scripts and devices, sent as "Authorization: Bearer sk_..." or
+ * "X-API-Key: sk_...". A key is "sk_<id>_<secret>". Only the sha256 of the secret is
+ * stored (_system/apikeys), so a key is shown once, when it is minted.
+ * A valid key acts as its owner with the key's scopes, see middleJWT.
+ */
+type ApiKey struct {
+	Id      string   `json:"_key"`
+	Email   string   `json:"email"`
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+	Hash    string   `json:"hash,omitempty"` //Hex sha256 of the secret. Never sent to clients.
+	Created int64    `json:"created"`        //Unix seconds
+	Expires int64    `json:"expires"`
+}
+
+// POST /keys body
+type ApiKeyNew struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Days   int      `json:"expires_in_days"` //Default 90
+}
+
+const (
+	apiKeyPrefix  = "sk_"
+	apiKeyIssuer  = "apikey" //CtxVerify.Iss of key requests; their Sub is "apikey|<id>"
+	apiKeyDays    = 90
+	apiKeyMaxDays = 365
+)
+
+var errBadKey = errors.New("invalid api key")
+
+// Mint a key for email. Returns the stored key and the plain text key to hand out.
+func newApiKey(email string, n ApiKeyNew) (ApiKey, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return ApiKey{}, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	days := n.Days
+	if days == 0 {
+		days = apiKeyDays
+	}
+
+	now := time.Now()
+	k := ApiKey{
+		Id:      ulid.Make().String(),
+		Email:   email,
+		Name:    n.Name,
+		Scopes:  n.Scopes,
+		Hash:    apiKeyHash(secret),
+		Created: now.Unix(),
+		Expires: now.AddDate(0, 0, days).Unix(),
+	}
+
+	return k, apiKeyPrefix + k.Id + "_" + secret, nil
+}
+
+func apiKeyHash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// Key sent with the request, if any
+func apiKeyFrom(r *http.Request) (string, bool) {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k, true
+	}
+
+	k, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && strings.HasPrefix(k, apiKeyPrefix) {
+		return k, true
+	}
+
+	return "", false
+}
+
+// Look up and check a plain text key
+func verifyApiKey(ctx context.Context, plain string) (ApiKey, error) {
+	rest, ok := strings.CutPrefix(plain, apiKeyPrefix)
+	if !ok {
+		return ApiKey{}, errBadKey
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return ApiKey{}, errBadKey
+	}
+
+	k, err := store.KeyGet(ctx, id)
+	if errors.Is(err, errNotFound) {
+		return ApiKey{}, errBadKey
+	} else if err != nil {
+		return ApiKey{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(apiKeyHash(secret))) != 1 {
+		return ApiKey{}, errBadKey
+	}
+	if time.Now().Unix() >= k.Expires {
+		return ApiKey{}, fmt.Errorf("%w: expired", errBadKey)
+	}
+
+	return k, nil
+}
+
+/*
+ * Handlers, /keys. Keys belong to the calling user.
+ */
+
+func keyGetAll(c echo.Context) error {
+	keys, err := store.KeyAll(c.Request().Context(), ctxEmail(c))
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	if keys == nil {
+		keys = []ApiKey{}
+	}
+
+	return c.JSON(http.StatusOK, keys)
+}
+
+func keyCreate(c echo.Context) error {
+	ver := c.Request().Context().Value("verify").(CtxVerify)
+
+	//A leaked key must not be able to mint more keys
+	if ver.Iss == apiKeyIssuer {
+		return echo.NewHTTPError(http.StatusForbidden, "api keys cannot mint api keys")
+	}
+
+	var data ApiKeyNew
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	if data.Name == "" || len(data.Scopes) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "name and scopes are required")
+	}
+	if data.Days < 0 || data.Days > apiKeyMaxDays {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("expires_in_days must be between 1 and %d", apiKeyMaxDays))
+	}
+
+	//Keys get at most the scopes of the token minting them
+	for _, s := range data.Scopes {
+		if !hasScope(ver.Scopes, s) {
+			return echo.NewHTTPError(http.StatusForbidden, "cannot grant scope "+s)
+		}
+	}
+
+	k, plain, err := newApiKey(ctxEmail(c), data)
+	if err != nil {
+		return err
+	}
+
+	if err := store.KeyCreate(c.Request().Context(), k); err != nil {
+		return err
+	}
+
+	k.Hash = ""
+	return c.JSON(http.StatusCreated, d{"key": plain, "details": k})
+}
+
+func keyRevoke(c echo.Context) error {
+	id := c.Param("id")
+
+	if err := store.KeyRevoke(c.Request().Context(), ctxEmail(c), id); err != nil {
+		return err
+	}
+
+	cache.invalidate(apiKeyIssuer + "|" + id)
+
+	return c.JSON(http.StatusOK, "api key revoked")
+}
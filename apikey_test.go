@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiKeyFrom(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+		ok      bool
+	}{
+		{"x-api-key", map[string]string{"X-API-Key": "sk_1_abc"}, "sk_1_abc", true},
+		{"bearer key", map[string]string{"Authorization": "Bearer sk_1_abc"}, "sk_1_abc", true},
+		{"x-api-key wins", map[string]string{"X-API-Key": "sk_1_abc", "Authorization": "Bearer sk_2_def"}, "sk_1_abc", true},
+		{"bearer jwt", map[string]string{"Authorization": "Bearer eyJhbGciOi.x.y"}, "", false},
+		{"basic", map[string]string{"Authorization": "Basic sk_1_abc"}, "", false},
+		{"none", nil, "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for h, v := range tt.headers {
+			r.Header.Set(h, v)
+		}
+
+		if k, ok := apiKeyFrom(r); k != tt.want || ok != tt.ok {
+			t.Errorf("%s: apiKeyFrom = %q, %v, want %q, %v", tt.name, k, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestVerifyApiKey(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+
+	mint := func(days int) (ApiKey, string) {
+		k, plain, err := newApiKey("a@x.io", ApiKeyNew{Name: "script", Scopes: []string{scopeReadItems}, Days: days})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.KeyCreate(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+		return k, plain
+	}
+
+	k, plain := mint(0)
+	if days := time.Unix(k.Expires, 0).Sub(time.Unix(k.Created, 0)).Hours() / 24; days < apiKeyDays-1 || days > apiKeyDays+1 {
+		t.Errorf("default key lasts %.1f days, want %d", days, apiKeyDays)
+	}
+	if strings.Contains(k.Hash, strings.TrimPrefix(plain, apiKeyPrefix+k.Id+"_")) {
+		t.Error("secret stored in the clear")
+	}
+
+	got, err := verifyApiKey(ctx, plain)
+	if err != nil {
+		t.Fatalf("verifyApiKey(minted key) = %v", err)
+	}
+	if got.Id != k.Id || got.Email != "a@x.io" {
+		t.Errorf("verifyApiKey = %+v, want key %s of a@x.io", got, k.Id)
+	}
+
+	//Past its expiry
+	old, oldPlain := mint(1)
+	old.Expires = time.Now().Add(-time.Minute).Unix()
+	m := store.(*memStore)
+	m.keys[old.Id] = old
+
+	_, secret, _ := strings.Cut(strings.TrimPrefix(plain, apiKeyPrefix), "_")
+	tests := []struct {
+		name  string
+		plain string
+	}{
+		{"no prefix", strings.TrimPrefix(plain, apiKeyPrefix)},
+		{"no secret", apiKeyPrefix + k.Id + "_"},
+		{"no id", apiKeyPrefix + "_" + secret},
+		{"wrong secret", apiKeyPrefix + k.Id + "_x" + secret},
+		{"unknown id", apiKeyPrefix + "01HZZZZZZZZZZZZZZZZZZZZZZZ_" + secret},
+		{"another key's secret", apiKeyPrefix + old.Id + "_" + secret},
+		{"expired", oldPlain},
+	}
+
+	for _, tt := range tests {
+		if _, err := verifyApiKey(ctx, tt.plain); !errors.Is(err, errBadKey) {
+			t.Errorf("%s: verifyApiKey error = %v, want errBadKey", tt.name, err)
+		}
+	}
+
+	//Revoked
+	if err := store.KeyRevoke(ctx, "a@x.io", k.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyApiKey(ctx, plain); !errors.Is(err, errBadKey) {
+		t.Errorf("revoked key: verifyApiKey error = %v, want errBadKey", err)
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"sync"
 	"time"
 
 	driver "github.com/arangodb/go-driver"
@@ -51,7 +54,7 @@ type ShopNew struct {
 type ShopListsAll struct {
 	Id     string  `json:"id"`
 	Name   string  `json:"name"`
-	Date   float32 `json:"date"`
+	Date   float64 `json:"date"`
 	Hidden bool    `json:"hidden"`
 	Label  string  `json:"label"`
 }
@@ -75,12 +78,16 @@ type SListItems struct {
 	Edge_id   string  `json:"edge_id"`
 	Item_id   string  `json:"item_id"`
 	Shop_id   string  `json:"shop_id"`
+	Tag       string  `json:"tag"`
+	UnitPrice float32 `json:"unit_price,omitempty"` //Per Per, set by handlers, see setUnitPrice
+	Per       string  `json:"per,omitempty"`
 }
 
 //ShoppingList struct
 type SList struct {
-	Shop  string       `json:"shop"`
-	Items []SListItems `json:"items"`
+	Shop     string       `json:"shop"`
+	Items    []SListItems `json:"items"`
+	Subtotal []Money      `json:"subtotal,omitempty"` //Per currency, set by handlers, see setSubtotals
 }
 
 //ShoppingList Edge: links Shop to Item, along with price, etc
@@ -111,14 +118,59 @@ type SlistEdgeItem struct {
 
 //Price Trend for item
 type ItemTrend struct {
-	Shop     string `json:"shop"`
-	Branch   string `json:"branch"`
-	City     string `json:"city"`
-	Country  string `json:"country"`
-	Currency string `json:"currency"`
-	Price    string `json:"price"`
-	Date     string `json:"date"`
-	List     string `json:"list_id"`
+	Shop      string  `json:"shop"`
+	Branch    string  `json:"branch"`
+	City      string  `json:"city"`
+	Country   string  `json:"country"`
+	Currency  string  `json:"currency"`
+	Price     float32 `json:"price"`
+	Date      int64   `json:"date"`
+	Special   bool    `json:"special"`
+	List      string  `json:"list_id"`
+	ShopId    string  `json:"shop_id"`
+	UnitPrice float32 `json:"unit_price,omitempty"` //Per Per, set by handlers, see setUnitPrices
+	Per       string  `json:"per,omitempty"`
+}
+
+//Price history filter and page, see PriceHistory. Zero values don't filter.
+type PriceFilter struct {
+	From     int64  //Entry dates, unix seconds, inclusive
+	To       int64
+	Shop     string //Full id, Shops/123
+	Currency string
+	ByShop   bool //Also give stats per shop
+	Limit    int  //Of prices returned, stats cover every match
+	Offset   int
+}
+
+//Price history of an item, newest first. Stats are per currency, as prices in different
+//currencies can't be compared.
+type PriceHistory struct {
+	Item     string       `json:"item_id"`
+	Nett     float32      `json:"nett"`
+	NettUnit string       `json:"nett_unit"`
+	Total    int          `json:"total"` //Prices matching the filter, before paging
+	Stats    []PriceStats `json:"stats"`
+	Shops    []ShopPrices `json:"shops,omitempty"`
+	Prices   []ItemTrend  `json:"prices"`
+}
+
+type PriceStats struct {
+	Currency string  `json:"currency"`
+	Count    int     `json:"count"`
+	Min      float32 `json:"min"`
+	Max      float32 `json:"max"`
+	Avg      float32 `json:"avg"`
+	Median   float32 `json:"median"`
+}
+
+type ShopPrices struct {
+	ShopId  string       `json:"shop_id"`
+	Shop    string       `json:"shop"`
+	Branch  string       `json:"branch"`
+	City    string       `json:"city"`
+	Country string       `json:"country"`
+	Stats   []PriceStats `json:"stats"`
 }
 
 //Template items
@@ -163,348 +215,455 @@ func makeID() string {
 
 /*
  * ARANGO DATABASE CONNECTION
+ * One client is created at startup and shared by all requests. Database handles
+ * are cached per tenant db, so a request only costs the query itself.
  */
 
-func aranDB(x, db string) (driver.Database, context.Context) {
+type aranPool struct {
+	client driver.Client
+
+	mu  sync.RWMutex
+	dbs map[string]driver.Database //Handles per database name
+
+	hmu       sync.RWMutex
+	healthy   bool
+	lastErr   error
+	lastCheck time.Time
+}
+
+// Pool limits, see newAranPool
+type aranLimits struct {
+	conns int           //Max connections per server (driver ConnLimit, -1 for no limit)
+	idle  int           //Max idle connections kept per server
+	idleT time.Duration //How long idle connections are kept
+}
 
-	if !ahok {
-		fmt.Println("ArangoDB: Arango DB host not set!")
+// Shared pool, set in newStore() when the Arango store is used
+var pool *aranPool
+
+func newAranPool(endpoints []string, usr, pass string, l aranLimits) (*aranPool, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no ArangoDB endpoints given")
+	}
+
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: l.idle,
+		MaxIdleConns:        l.idle * len(endpoints),
+		IdleConnTimeout:     l.idleT,
 	}
 
 	conn, err := ahttp.NewConnection(ahttp.ConnectionConfig{
-		Endpoints: []string{x},
+		Endpoints: endpoints,
+		Transport: tr,
+		ConnLimit: l.conns,
 	})
 	if err != nil {
-		fmt.Println("ArangoDB: Error creating connection:", err)
+		return nil, fmt.Errorf("ArangoDB: error creating connection: %w", err)
 	}
 
 	//Create a Client to ArrangoDB
 	c, err := driver.NewClient(driver.ClientConfig{
 		Connection:     conn,
-		Authentication: driver.BasicAuthentication("root", ap),
+		Authentication: driver.BasicAuthentication(usr, pass),
 	})
 	if err != nil {
-		fmt.Println(err)
-	}
-
-	if ahok {
-		ctx := context.Background()
-		db, err := c.Database(ctx, db)
-		if err != nil {
-			fmt.Println("ArangoDB: Error opening database:", err)
-			ct = false
-		} else {
-			ct = true
-			return db, ctx
-		}
+		return nil, fmt.Errorf("ArangoDB: error creating client: %w", err)
 	}
 
-	return nil, nil
+	return &aranPool{client: c, dbs: make(map[string]driver.Database)}, nil
 }
 
-/*
-* ARANGO CREATE EDGE COLLECTION
- */
-func (db dbase) edgeCreate(s string) (driver.Collection, error) {
-	//Create Edge collection
-	dbx, ctx := aranDB(ah, db.db)
-
-	//Type = 3 for edge, type = 2 for document
-	t := &driver.CreateCollectionOptions{Type: 3}
-	col, err := dbx.CreateCollection(ctx, s, t)
+// Get (cached) handle for database n
+func (p *aranPool) database(ctx context.Context, n string) (driver.Database, error) {
+	p.mu.RLock()
+	dbx, ok := p.dbs[n]
+	p.mu.RUnlock()
+	if ok {
+		return dbx, nil
+	}
 
+	dbx, err := p.client.Database(ctx, n)
 	if err != nil {
+		//A missing db is the caller's problem, anything else says something about the server
+		if !driver.IsNotFoundGeneral(err) {
+			p.setHealth(err)
+		}
 		return nil, err
 	}
 
-	return col, nil
+	p.mu.Lock()
+	p.dbs[n] = dbx
+	p.mu.Unlock()
+
+	return dbx, nil
 }
 
-func dbCreate(x, n string) (string, error) {
-	if !ahok {
-		fmt.Println("ArangoDB: Arango DB host not set!")
-	}
+// Drop cached handle, e.g. after the database was removed
+func (p *aranPool) forget(n string) {
+	p.mu.Lock()
+	delete(p.dbs, n)
+	p.mu.Unlock()
+}
 
-	if n == "" {
-		return "", fmt.Errorf("database name cannot be empty")
+func (p *aranPool) setHealth(err error) {
+	p.hmu.Lock()
+	defer p.hmu.Unlock()
+
+	p.healthy = err == nil
+	p.lastErr = err
+	p.lastCheck = time.Now()
+}
+
+// Current health as seen by the last check or failed call
+func (p *aranPool) health() (bool, time.Time, error) {
+	p.hmu.RLock()
+	defer p.hmu.RUnlock()
+
+	return p.healthy, p.lastCheck, p.lastErr
+}
+
+// Ping the server now
+func (p *aranPool) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := p.client.Version(ctx)
+	p.setHealth(err)
+
+	return err
+}
+
+// Check health every interval until ctx is done
+func (p *aranPool) watch(ctx context.Context, interval time.Duration) {
+	if err := p.check(ctx); err != nil {
+		fmt.Println("ArangoDB: health check failed:", err)
 	}
 
-	conn, err := ahttp.NewConnection(ahttp.ConnectionConfig{
-		Endpoints: []string{x},
-	})
-	if err != nil {
-		fmt.Println("ArangoDB: Error creating connection:", err)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			was, _, _ := p.health()
+			err := p.check(ctx)
+			if err != nil && was {
+				fmt.Println("ArangoDB: health check failed:", err)
+			} else if err == nil && !was {
+				fmt.Println("ArangoDB: connection restored")
+			}
+		}
 	}
+}
 
-	//Create a Client to ArrangoDB
-	c, err := driver.NewClient(driver.ClientConfig{
-		Connection:     conn,
-		Authentication: driver.BasicAuthentication("root", ap),
-	})
+// Open database db via the shared pool
+func aranDB(ctx context.Context, db string) (driver.Database, error) {
+	dbx, err := pool.database(ctx, db)
 	if err != nil {
-		fmt.Println(err)
-	}
-
-	if ahok {
-		ctx := context.Background()
-		op := &driver.CreateDatabaseOptions{}
-		dbn, err := c.CreateDatabase(ctx, n, op)
-		if err != nil {
-			fmt.Println("ArangoDB: Error opening database:", err)
-			ct = false
-		} else {
-			ct = true
-			return dbn.Name(), nil
-		}
+		return nil, storeErr("open database "+db, err)
 	}
 
-	return "", fmt.Errorf("an unknown error occurred while creatng db")
+	return dbx, nil
 }
 
-func (db dbase) colCreate(s string) (driver.Collection, error) {
-	//Create Edge collection
-	dbx, ctx := aranDB(ah, db.db)
-
-	//Type = 3 for edge, type = 2 for document
-	t := &driver.CreateCollectionOptions{Type: 2}
-	col, err := dbx.CreateCollection(ctx, s, t)
+/*
+ * ARANGO STREAM TRANSACTION
+ * Runs fn inside a transaction writing to cols. Queries made with the ctx handed to
+ * fn join the transaction. It is committed if fn returns nil, aborted otherwise.
+ */
+func (db dbase) inTx(ctx context.Context, cols []string, fn func(ctx context.Context) error) error {
+	dbx, err := aranDB(ctx, db.db)
+	if err != nil {
+		return err
+	}
 
+	tid, err := dbx.BeginTransaction(ctx, driver.TransactionCollections{Write: cols}, nil)
 	if err != nil {
-		return nil, err
+		return storeErr("begin transaction", err)
 	}
 
-	return col, nil
+	if err := fn(driver.WithTransactionID(ctx, tid)); err != nil {
+		if aerr := dbx.AbortTransaction(ctx, tid, nil); aerr != nil {
+			fmt.Println("ArangoDB: abort transaction:", aerr)
+		}
+		return err
+	}
+
+	if err := dbx.CommitTransaction(ctx, tid, nil); err != nil {
+		return storeErr("commit transaction", err)
+	}
+
+	return nil
 }
 
 /*
- * ARANGO QUERY METHOD
+* ARANGO CREATE EDGE COLLECTION
  */
-
-type aranQuery struct {
-	q    string
-	bind d
-	db   driver.Database
-	ctx  context.Context
+func (db dbase) edgeCreate(ctx context.Context, s string) (driver.Collection, error) {
+	//Type = 3 for edge, type = 2 for document
+	return db.createCollection(ctx, s, driver.CollectionTypeEdge)
 }
 
-func (query aranQuery) aranQ() []d {
-	var ra []d
+func dbCreate(ctx context.Context, n string) (string, error) {
+	if n == "" {
+		return "", &storeError{errBadQuery, "create database", fmt.Errorf("database name cannot be empty")}
+	}
 
-	cursor, err := query.db.Query(query.ctx, query.q, query.bind)
+	op := &driver.CreateDatabaseOptions{}
+	dbn, err := pool.client.CreateDatabase(ctx, n, op)
 	if err != nil {
-		fmt.Println("ArangoDB Query: Error running query:", err)
-	} else {
-		for {
+		return "", storeErr("create database "+n, err)
+	}
 
-			var report d
-			_, err := cursor.ReadDocument(query.ctx, &report)
+	pool.mu.Lock()
+	pool.dbs[n] = dbn
+	pool.mu.Unlock()
 
-			if driver.IsNoMoreDocuments(err) {
-				break
-			} else if err != nil {
-				fmt.Println(err)
-			}
+	return dbn.Name(), nil
+}
 
-			ra = append(ra, report)
-		}
+// Create database n unless it exists. Reports whether it was created.
+func dbEnsure(ctx context.Context, n string) (bool, error) {
+	ok, err := pool.client.DatabaseExists(ctx, n)
+	if err != nil {
+		return false, storeErr("check database "+n, err)
+	}
+	if ok {
+		return false, nil
 	}
 
-	defer cursor.Close()
+	if _, err := dbCreate(ctx, n); err != nil && !errors.Is(err, errConflict) {
+		return false, err
+	}
 
-	return ra
+	return true, nil
 }
 
-/*
- * ARANGO INSERT METHOD
- */
+// Drop database n and forget its handle
+func dbDrop(ctx context.Context, n string) error {
+	dbx, err := aranDB(ctx, n)
+	if err == nil {
+		err = storeErr("drop database "+n, dbx.Remove(ctx))
+	}
+	pool.forget(n)
 
-type aranInsertItem struct {
-	cl  string //Specifiy collection name
-	in  ItemNew
-	db  driver.Database
-	ctx context.Context
+	return err
 }
 
-type aranInsertShop struct {
-	cl  string //Specifiy collection name
-	in  ShopNew
-	db  driver.Database
-	ctx context.Context
+// Create document collection s unless it exists
+func (db dbase) colEnsure(ctx context.Context, s string) error {
+	if _, err := db.colCreate(ctx, s); err != nil && !errors.Is(err, errConflict) {
+		return err
+	}
+
+	return nil
 }
 
-func (insert aranInsertItem) aranIns() string {
+// As colEnsure, for an edge collection
+func (db dbase) edgeEnsure(ctx context.Context, s string) error {
+	if _, err := db.edgeCreate(ctx, s); err != nil && !errors.Is(err, errConflict) {
+		return err
+	}
 
-	//Select collection
-	col, err := insert.db.Collection(insert.ctx, insert.cl)
+	return nil
+}
+
+// Persistent index on fields of collection c, created unless it exists
+func (db dbase) indexEnsure(ctx context.Context, c string, fields []string, unique bool) error {
+	dbx, err := aranDB(ctx, db.db)
 	if err != nil {
-		fmt.Println("ArangoDB Insert: Error getting collection", err)
+		return err
 	}
 
-	//Create document
-	meta, err := col.CreateDocument(insert.ctx, insert.in)
+	col, err := dbx.Collection(ctx, c)
 	if err != nil {
-		fmt.Println("ArangoDB Insert: Error creating document", err)
+		return storeErr("get collection "+c, err)
 	}
 
-	return meta.Key
+	_, _, err = col.EnsurePersistentIndex(ctx, fields, &driver.EnsurePersistentIndexOptions{Unique: unique})
+	return storeErr("ensure index on "+c, err)
 }
 
-func (insert aranInsertShop) aranIns() string {
+func (db dbase) colCreate(ctx context.Context, s string) (driver.Collection, error) {
+	return db.createCollection(ctx, s, driver.CollectionTypeDocument)
+}
 
-	//Select collection
-	col, err := insert.db.Collection(insert.ctx, insert.cl)
+func (db dbase) createCollection(ctx context.Context, s string, t driver.CollectionType) (driver.Collection, error) {
+	dbx, err := aranDB(ctx, db.db)
 	if err != nil {
-		fmt.Println("ArangoDB Insert: Error getting collection", err)
+		return nil, err
 	}
 
-	//Create document
-	meta, err := col.CreateDocument(insert.ctx, insert.in)
+	col, err := dbx.CreateCollection(ctx, s, &driver.CreateCollectionOptions{Type: t})
 	if err != nil {
-		fmt.Println("ArangoDB Insert: Error creating document", err)
+		return nil, storeErr("create collection "+s, err)
 	}
 
-	return meta.Key
+	return col, nil
 }
 
 /*
- * ARANGO UPDATE METHOD
- * First get document key. Then update.
+ * ARANGO QUERY METHOD
+ * queryAll decodes every result into T (e.g. Item, Shop, SListItems or d for a plain map).
+ * queryIter streams results one at a time, for result sets too large to hold at once.
  */
 
-type aranUpdateItem struct {
-	cl   string //Specifiy collection name
-	ky   string //Document key
-	data ItemNew
-	db   driver.Database
-	ctx  context.Context
+type aranQuery struct {
+	q     string
+	bind  d
+	db    driver.Database
+	ctx   context.Context
+	batch int //Cursor batch size, 0 for the server default
 }
 
-type aranUpdateShop struct {
-	cl   string //Specifiy collection name
-	ky   string //Document key
-	data ShopNew
-	db   driver.Database
-	ctx  context.Context
+// Untyped results, kept for queries that return mixed documents
+func (query aranQuery) aranQ() ([]d, error) {
+	return queryAll[d](query)
 }
 
-type aranUpdateSlist struct {
-	cl   string //Specifiy collection name
-	ky   string //Document key
-	data SlistEdgeItem
-	db   driver.Database
-	ctx  context.Context
-}
+// Run the query and return its cursor
+func (query aranQuery) cursor() (driver.Cursor, error) {
+	ctx := query.ctx
+	if query.batch > 0 {
+		ctx = driver.WithQueryBatchSize(ctx, query.batch)
+	}
 
-type aranUpdateSlistAll struct {
-	cl   string //Specifiy collection name
-	ky   string //Document key
-	data ShopListsAll
-	db   driver.Database
-	ctx  context.Context
-}
+	cursor, err := query.db.Query(ctx, query.q, query.bind)
+	if err != nil {
+		return nil, storeErr("query", err)
+	}
 
-type aranUpdateTpl struct {
-	cl   string //Specifiy collection name
-	ky   string //Document key
-	data TplEdgeItem
-	db   driver.Database
-	ctx  context.Context
+	return cursor, nil
 }
 
-func (update aranUpdateItem) aranUp() (string, error) {
-	//Update document based on key with new data
+// Run query and decode all results into T. No results gives a nil slice and nil error.
+func queryAll[T any](query aranQuery) ([]T, error) {
+	var ra []T
 
-	patch := update.data
-	col, err := update.db.Collection(update.ctx, update.cl)
+	it, err := queryIter[T](query)
 	if err != nil {
-		fmt.Println("Error: aranUpdate: db.Collection")
-		return "", err
+		return nil, err
 	}
+	defer it.Close()
 
-	meta, err := col.UpdateDocument(update.ctx, update.ky, patch)
-	if err != nil {
-		fmt.Println("Error: aranUpdate: UpdateDocument " + update.ky)
-		return "", err
+	for it.Next() {
+		ra = append(ra, it.Value())
 	}
 
-	return meta.Key, nil
-
+	return ra, it.Err()
 }
 
-func (update aranUpdateShop) aranUp() (string, error) {
-	//Update document based on key with new data
+// Iterator over query results, decoded into T
+//
+//	it, err := queryIter[Item](q)
+//	defer it.Close()
+//	for it.Next() { i := it.Value() }
+//	err = it.Err()
+type cursorIter[T any] struct {
+	cursor driver.Cursor
+	ctx    context.Context
+	cur    T
+	err    error
+}
 
-	patch := update.data
-	col, err := update.db.Collection(update.ctx, update.cl)
+func queryIter[T any](query aranQuery) (*cursorIter[T], error) {
+	cursor, err := query.cursor()
 	if err != nil {
-		fmt.Println("Error: aranUpdate: db.Collection")
-		return "", err
+		return nil, err
 	}
 
-	meta, err := col.UpdateDocument(update.ctx, update.ky, patch)
-	if err != nil {
-		fmt.Println("Error: aranUpdate: UpdateDocument " + update.ky)
-		return "", err
+	return &cursorIter[T]{cursor: cursor, ctx: query.ctx}, nil
+}
+
+// Advance to the next result. Returns false when done or on error, see Err.
+func (it *cursorIter[T]) Next() bool {
+	if it.err != nil {
+		return false
 	}
 
-	return meta.Key, nil
+	var v T
+	_, err := it.cursor.ReadDocument(it.ctx, &v)
+	if driver.IsNoMoreDocuments(err) {
+		return false
+	} else if err != nil {
+		it.err = storeErr("read query result", err)
+		return false
+	}
 
+	it.cur = v
+	return true
 }
 
-func (update aranUpdateSlist) aranUp() (string, error) {
-	//Update document based on key with new data
+// Current result
+func (it *cursorIter[T]) Value() T {
+	return it.cur
+}
 
-	patch := update.data
-	col, err := update.db.Collection(update.ctx, update.cl)
-	if err != nil {
-		fmt.Println("Error: aranUpdate: db.Collection", err)
-		return "", err
-	}
+// First error hit while reading, if any
+func (it *cursorIter[T]) Err() error {
+	return it.err
+}
 
-	meta, err := col.UpdateDocument(update.ctx, update.ky, patch)
-	if err != nil {
-		fmt.Println("Error: aranUpdate: UpdateDocument "+update.ky, err, patch)
-		return "", err
-	}
+// Release the cursor on the server. Safe to call more than once.
+func (it *cursorIter[T]) Close() error {
+	return it.cursor.Close()
+}
 
-	return meta.Key, nil
+/*
+ * ARANGO INSERT METHOD
+ */
 
+type aranInsert struct {
+	cl  string      //Specifiy collection name
+	in  interface{} //Document, e.g. ItemNew
+	db  driver.Database
+	ctx context.Context
 }
 
-func (update aranUpdateSlistAll) aranUp() (string, error) {
-	//Update document based on key with new data
+func (insert aranInsert) aranIns() (string, error) {
 
-	patch := update.data
-	col, err := update.db.Collection(update.ctx, update.cl)
+	//Select collection
+	col, err := insert.db.Collection(insert.ctx, insert.cl)
 	if err != nil {
-		fmt.Println("Error: aranUpdate: db.Collection")
-		return "", err
+		return "", storeErr("get collection "+insert.cl, err)
 	}
 
-	meta, err := col.UpdateDocument(update.ctx, update.ky, patch)
+	//Create document
+	meta, err := col.CreateDocument(insert.ctx, insert.in)
 	if err != nil {
-		fmt.Println("Error: aranUpdate: UpdateDocument " + update.ky)
-		return "", err
+		return "", storeErr("insert into "+insert.cl, err)
 	}
 
 	return meta.Key, nil
+}
+
+/*
+ * ARANGO UPDATE METHOD
+ * Update document by key.
+ */
 
+type aranUpdate struct {
+	cl   string      //Specifiy collection name
+	ky   string      //Document key
+	data interface{} //Patch, e.g. SlistEdgeItem
+	db   driver.Database
+	ctx  context.Context
 }
 
-func (update aranUpdateTpl) aranUp() (string, error) {
+func (update aranUpdate) aranUp() (string, error) {
 	//Update document based on key with new data
 
-	patch := update.data
 	col, err := update.db.Collection(update.ctx, update.cl)
 	if err != nil {
-		fmt.Println("Error: aranUpdate: db.Collection", err)
-		return "", err
+		return "", storeErr("get collection "+update.cl, err)
 	}
 
-	meta, err := col.UpdateDocument(update.ctx, update.ky, patch)
+	meta, err := col.UpdateDocument(update.ctx, update.ky, update.data)
 	if err != nil {
-		fmt.Println("Error: aranUpdate: UpdateDocument "+update.ky, err, patch)
-		return "", err
+		return "", storeErr("update "+update.cl+"/"+update.ky, err)
 	}
 
 	return meta.Key, nil
@@ -525,14 +684,11 @@ type getDocKey struct {
 	ctx   context.Context
 }
 
-func (my getDocKey) getKey() []d {
+func (my getDocKey) getKey() ([]d, error) {
 	//Get key WHERE month, year IN ulid
 	var query string = "FOR doc IN " + my.ulid + " FILTER doc.`year` == @year AND doc.`month` == @month RETURN { 'key':doc._key }"
 	var bind = d{"year": my.year, "month": my.month}
-	var key []d
-
-	keys := aranQuery{query, bind, my.db, my.ctx}
-	key = keys.aranQ()
 
-	return key
+	keys := aranQuery{q: query, bind: bind, db: my.db, ctx: my.ctx}
+	return keys.aranQ()
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * USER ARCHIVE
+ * Everything a user owns, written as one JSON file to archive_dir before their data is
+ * deleted. Lists and templates are exported as they are viewed, i.e. grouped per shop.
+ */
+type userArchive struct {
+	Email     string        `json:"email"`
+	Db        string        `json:"db"`
+	Role      string        `json:"role"`
+	Exported  int64         `json:"exported"` //Unix seconds
+	Items     []Item        `json:"items"`
+	Shops     []Shop        `json:"shops"`
+	Lists     []archiveList `json:"lists"`
+	Templates []archiveList `json:"templates"`
+	Keys      []ApiKey      `json:"api_keys"`
+}
+
+type archiveList struct {
+	ShopListsAll
+	Entries interface{} `json:"entries"` //[]SList or []Tpl
+}
+
+func exportUser(ctx context.Context, u user) (userArchive, error) {
+	a := userArchive{Email: u.email, Db: u.db, Role: u.role, Exported: time.Now().Unix()}
+
+	var err error
+	if a.Items, err = store.ItemAll(ctx, u.db); err != nil {
+		return a, err
+	}
+	if a.Shops, err = store.ShopAll(ctx, u.db); err != nil {
+		return a, err
+	}
+
+	lists, err := store.ListAll(ctx, u.db, false)
+	if err != nil {
+		return a, err
+	}
+	for _, l := range lists {
+		v, err := store.ListView(ctx, u.db, l.Id)
+		if err != nil {
+			return a, err
+		}
+		a.Lists = append(a.Lists, archiveList{l, v})
+	}
+
+	//Templates are optional, see listEnableTemplates
+	tpls, err := store.TemplateAll(ctx, u.db)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return a, err
+	}
+	for _, l := range tpls {
+		v, err := store.TemplateView(ctx, u.db, l.Id)
+		if err != nil {
+			return a, err
+		}
+		a.Templates = append(a.Templates, archiveList{l, v})
+	}
+
+	if a.Keys, err = store.KeyAll(ctx, u.email); err != nil {
+		return a, err
+	}
+	for i := range a.Keys {
+		a.Keys[i].Hash = ""
+	}
+
+	return a, nil
+}
+
+// Write the archive to dir, returns the file name
+func writeArchive(dir string, a userArchive) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	f := filepath.Join(dir, fmt.Sprintf("%s-%d.json", a.Db, a.Exported))
+	if err := os.WriteFile(f, b, 0o600); err != nil {
+		return "", err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+ * AUDIT TRAIL
+ * Admin changes to users, kept in _system/audit and echoed to the log.
+ * Recording is best effort: a failed write is logged but doesn't undo the change.
+ */
+type AuditEntry struct {
+	Time   int64  `json:"time"`   //Unix seconds
+	Actor  string `json:"actor"`  //Email of the admin, or "bootstrap"
+	Action string `json:"action"` //e.g. "role"
+	Target string `json:"target"` //Email of the user changed
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+// Actor of changes made at startup, see bootstrapAdmin
+const auditBootstrap = "bootstrap"
+
+func audit(ctx context.Context, a AuditEntry) {
+	a.Time = time.Now().Unix()
+
+	fmt.Printf("Audit: %s %s %s %q -> %q\n", a.Actor, a.Action, a.Target, a.From, a.To)
+
+	if err := store.AuditAdd(ctx, a); err != nil {
+		fmt.Println("Audit: failed to record entry:", err)
+	}
+}
+
+// Make email an admin at startup, unless there already is one. The user is created if needed.
+func bootstrapAdmin(ctx context.Context, email string) error {
+	if !validEmail(email) {
+		return fmt.Errorf("invalid email %q", email)
+	}
+
+	users, err := store.UserAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if u.Role == roleAdmin {
+			return nil
+		}
+	}
+
+	if _, err := store.UserGet(ctx, email); errors.Is(err, errNotFound) {
+		if _, _, err := store.UserCreate(ctx, UserNew{email, roleUser}); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	old, err := store.UserSetRole(ctx, email, roleAdmin)
+	if err != nil {
+		return err
+	}
+
+	audit(ctx, AuditEntry{Actor: auditBootstrap, Action: "role", Target: email, From: old, To: roleAdmin})
+
+	return nil
+}
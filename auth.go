@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/auth0/go-jwt-middleware/v2/jwks"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+/*
+ * TOKEN PROVIDERS
+ * Validators are built once at startup, one per issuer and audience, so the JWKS
+ * cache of each issuer is shared by every request. A token is routed to its provider
+ * by the (unverified) iss claim and must then pass that provider's validator.
+ */
+type authProvider struct {
+	name     string
+	kind     string //"auth0", "oidc" or "static"
+	issuer   string
+	userinfo string                 //Empty if the provider has no userinfo endpoint
+	vals     []*validator.Validator //One per accepted audience
+
+	emailClaim    string //Offline user resolution, see ProviderConfig
+	verifiedClaim string
+}
+
+type authenticator struct {
+	byIss map[string]*authProvider
+}
+
+// Set up in main()
+var auth *authenticator
+
+var errUnknownIssuer = errors.New("unknown issuer")
+
+func newAuth(ps []ProviderConfig) (*authenticator, error) {
+	a := &authenticator{byIss: make(map[string]*authProvider)}
+
+	for _, pc := range ps {
+		p, err := newAuthProvider(pc)
+		if err != nil {
+			return nil, fmt.Errorf("auth provider %s: %w", pc.Name, err)
+		}
+		a.byIss[p.issuer] = p
+	}
+
+	return a, nil
+}
+
+func newAuthProvider(pc ProviderConfig) (*authProvider, error) {
+	var keyFunc func(context.Context) (interface{}, error)
+	alg := validator.RS256
+
+	switch pc.Type {
+	case "auth0", "oidc":
+		issuerURL, err := url.Parse(pc.Issuer)
+		if err != nil {
+			return nil, err
+		}
+
+		var opts []jwks.ProviderOption
+		if pc.JWKSURL != "" {
+			u, err := url.Parse(pc.JWKSURL)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, jwks.WithCustomJWKSURI(u))
+		}
+
+		ttl := time.Duration(pc.JWKSTTL)
+		if ttl <= 0 {
+			ttl = 5 * time.Minute
+		}
+		keyFunc = jwks.NewCachingProvider(issuerURL, ttl, opts...).KeyFunc
+	case "static":
+		if pc.Algorithm != "" {
+			alg = validator.SignatureAlgorithm(pc.Algorithm)
+		}
+
+		key, err := staticKey(alg, pc.Key)
+		if err != nil {
+			return nil, err
+		}
+		keyFunc = func(context.Context) (interface{}, error) { return key, nil }
+	default:
+		return nil, fmt.Errorf("unknown type %q", pc.Type)
+	}
+
+	p := &authProvider{
+		name:          pc.Name,
+		kind:          pc.Type,
+		issuer:        pc.Issuer,
+		userinfo:      pc.UserInfo,
+		emailClaim:    pc.EmailClaim,
+		verifiedClaim: pc.VerifiedClaim,
+	}
+	if p.userinfo == "" && pc.Type == "auth0" {
+		p.userinfo = pc.Issuer + "userinfo"
+	}
+
+	for _, aud := range pc.Audience {
+		v, err := validator.New(
+			keyFunc,
+			alg,
+			pc.Issuer,
+			[]string{aud},
+			validator.WithCustomClaims(
+				func() validator.CustomClaims {
+					return &Claims{}
+				},
+			),
+		)
+		if err != nil {
+			return nil, err
+		}
+		p.vals = append(p.vals, v)
+	}
+
+	return p, nil
+}
+
+// Shared secret for HS*, otherwise a PEM public key read from file
+func staticKey(alg validator.SignatureAlgorithm, key string) (interface{}, error) {
+	if strings.HasPrefix(string(alg), "HS") {
+		return []byte(key), nil
+	}
+
+	b, err := os.ReadFile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: no PEM data", key)
+	}
+	if pub, err := x509.ParsePKIXPublicKey(blk.Bytes); err == nil {
+		return pub, nil
+	}
+
+	return x509.ParsePKCS1PublicKey(blk.Bytes)
+}
+
+// Validate tkn against the provider of its issuer
+func (a *authenticator) validate(ctx context.Context, tkn string) (*validator.ValidatedClaims, *authProvider, error) {
+	iss, err := tokenIssuer(tkn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, ok := a.byIss[iss]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w %q", errUnknownIssuer, iss)
+	}
+
+	//Any accepted audience will do
+	for _, v := range p.vals {
+		var vr interface{}
+		if vr, err = v.ValidateToken(ctx, tkn); err == nil {
+			return vr.(*validator.ValidatedClaims), p, nil
+		}
+	}
+
+	return nil, p, err
+}
+
+// Provider for a validated issuer
+func (a *authenticator) provider(iss string) (*authProvider, bool) {
+	p, ok := a.byIss[iss]
+	return p, ok
+}
+
+// Email from the provider's email claim of an already validated token. Empty if the
+// provider has no email claim configured or the token does not carry it.
+func (p *authProvider) claimEmail(tkn string) (string, error) {
+	if p.emailClaim == "" {
+		return "", nil
+	}
+
+	pl, err := tokenPayload(tkn)
+	if err != nil {
+		return "", err
+	}
+
+	eml, _ := pl[p.emailClaim].(string)
+	if eml == "" {
+		return "", nil
+	}
+
+	if p.verifiedClaim != "" {
+		if v, _ := pl[p.verifiedClaim].(bool); !v {
+			return "", fmt.Errorf("%s: email %q not verified", p.name, eml)
+		}
+	}
+
+	return eml, nil
+}
+
+// Read iss from the token payload without verifying it. Only used to pick the validator.
+func tokenIssuer(tkn string) (string, error) {
+	pl, err := tokenPayload(tkn)
+	if err != nil {
+		return "", err
+	}
+
+	iss, _ := pl["iss"].(string)
+	return iss, nil
+}
+
+// Decoded claims of tkn. The signature is not checked here.
+func tokenPayload(tkn string) (map[string]interface{}, error) {
+	parts := strings.Split(tkn, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+
+	var pl map[string]interface{}
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+
+	return pl, nil
+}
@@ -2,33 +2,34 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/url"
-	"os"
 	"strings"
-	"time"
 
+	"crypto/sha256"
 	"encoding/json"
-	"io/ioutil"
+	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/labstack/echo/v4"
-
-	"github.com/auth0/go-jwt-middleware/v2/jwks"
-	"github.com/auth0/go-jwt-middleware/v2/validator"
 )
 
 //Struct type for context's Value being sent to Middleware #2
 type CtxVerify struct {
-	Sub string
-	Iss string
-	Tkn string
+	Sub    string //iss|sub, as a sub is only unique per issuer. Also the user cache key.
+	Iss    string
+	Tkn    string
+	Scopes []string //Granted scopes, see scope.go
+	Email  string   //From the token's email claim, if the provider has one. See auth.go
 }
 
 //Middleware 1: MiddleJWT
 // CustomClaims contains the data we want from the token.
 type Claims struct {
-	Scope string   `json:"scope"`
+	Scope string   `json:"scope"` //Space separated, as issued by Auth0
+	Scp   []string `json:"scp"`   //Array form used by some OIDC providers
 	Iss   string   `json:"iss"`
 	Sub   string   `json:"sub"`
 	Aud   []string `json:"aud"`
@@ -46,32 +47,27 @@ func (c Claims) Validate(ctx context.Context) error {
 func middleJWT(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 
-		c.Get("Authorization")
-
-		issuerURL, err := url.Parse(os.Getenv("AUTH0_ISS"))
-		if err != nil {
-			fmt.Println("Middleware: issuer error: ", err)
-			return echo.ErrInternalServerError
+		//e.g. /openapi.json
+		if publicRoute(c.Path()) {
+			return next(c)
 		}
-		aud := os.Getenv("AUTH0_AUD")
-		provider := jwks.NewCachingProvider(issuerURL, 5*time.Minute)
-
-		// c holds Response and Request
-		jwtValidator, err := validator.New(
-			provider.KeyFunc,
-			validator.RS256,
-			issuerURL.String(),
-			[]string{aud},
-			validator.WithCustomClaims(
-				func() validator.CustomClaims {
-					return &Claims{}
-				},
-			),
-		)
 
-		if err != nil {
-			fmt.Println("Middleware: jwtValidator error: ", err)
-			return echo.ErrInternalServerError
+		//API keys instead of a JWT, see apikey.go
+		if plain, ok := apiKeyFrom(c.Request()); ok {
+			k, err := verifyApiKey(c.Request().Context(), plain)
+			if err != nil {
+				fmt.Println("Middleware: api key error: ", err)
+				if errors.Is(err, errUnavailable) {
+					return echo.ErrServiceUnavailable
+				}
+				return echo.ErrUnauthorized
+			}
+
+			ver := CtxVerify{apiKeyIssuer + "|" + k.Id, apiKeyIssuer, "", k.Scopes, k.Email}
+			con := c.Request()
+			c.SetRequest(con.WithContext(context.WithValue(con.Context(), "verify", ver)))
+
+			return next(c) //Proceed to next.
 		}
 
 		reqToken := c.Request().Header.Get("Authorization")
@@ -83,22 +79,23 @@ func middleJWT(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 		tkn := splitToken[1]
 
-		vr, err := jwtValidator.ValidateToken(c.Request().Context(), tkn)
-
+		//Validators are set up once in main(), see auth.go
+		a, p, err := auth.validate(c.Request().Context(), tkn)
 		if err != nil {
 			fmt.Println("Middleware: jwtValidation error: ", err)
-			return echo.ErrUnauthorized
-		}
-
-		if vr == nil {
 			return echo.ErrUnauthorized //Not allowed to proceed. Might be nice to break it down further to "no token", etc
 		}
 
-		//Retrieve claims as a struct
-		a := vr.(*validator.ValidatedClaims)
+		//Offline user resolution, when the provider puts the email in the token
+		eml, err := p.claimEmail(tkn)
+		if err != nil {
+			fmt.Println("Middleware: email claim error: ", err)
+			return echo.ErrUnauthorized
+		}
 
 		//Ammend context to contain CtxVerify
-		ver := CtxVerify{a.RegisteredClaims.Subject, a.RegisteredClaims.Issuer, tkn}
+		iss := a.RegisteredClaims.Issuer
+		ver := CtxVerify{iss + "|" + a.RegisteredClaims.Subject, iss, tkn, a.CustomClaims.(*Claims).scopes(), eml}
 		con := c.Request()
 		conctx := con.Context()
 		c.SetRequest(con.WithContext(context.WithValue(conctx, "verify", ver)))
@@ -121,17 +118,16 @@ func middleUser(next echo.HandlerFunc) echo.HandlerFunc {
 		ver := c.Request().Context().Value("verify").(CtxVerify)
 
 		//SetCache returns false only if user not exist
-		ok := ver.setCache()
+		usr, ok := ver.setCache(c.Request().Context())
 		if !ok {
 			return echo.ErrUnauthorized
 		}
 
 		//Set db for queries to that of the user in Context Value
-		edb := cache[ver.Sub].db
-
 		con := c.Request()
-		conctx := con.Context()
-		c.SetRequest(con.WithContext(context.WithValue(conctx, "db", edb)))
+		conctx := context.WithValue(con.Context(), "db", usr.db)
+		conctx = context.WithValue(conctx, "email", usr.email)
+		c.SetRequest(con.WithContext(conctx))
 
 		return next(c) //Proceed to next.
 	}
@@ -143,15 +139,17 @@ func middleAdmin(next echo.HandlerFunc) echo.HandlerFunc {
 		ver := c.Request().Context().Value("verify").(CtxVerify)
 
 		//SetCache returns false only if user not exist
-		ok := ver.setCache()
+		usr, ok := ver.setCache(c.Request().Context())
 		if !ok {
 			return echo.ErrUnauthorized
 		}
 
-		//Send sub. Each /admin query should verify role from cache
+		//Send sub, role and email. Admin routes check role and scopes, see needAdmin
 		con := c.Request()
-		conctx := con.Context()
-		c.SetRequest(con.WithContext(context.WithValue(conctx, "sub", ver.Sub)))
+		conctx := context.WithValue(con.Context(), "sub", ver.Sub)
+		conctx = context.WithValue(conctx, "role", usr.role)
+		conctx = context.WithValue(conctx, "email", usr.email)
+		c.SetRequest(con.WithContext(conctx))
 
 		return next(c) //Proceed to next.
 	}
@@ -159,83 +157,180 @@ func middleAdmin(next echo.HandlerFunc) echo.HandlerFunc {
 
 //This fnc sets the users in cache. Only returns false if subjct's email
 // does not exist in the users db
-func (cv CtxVerify) setCache() bool {
+func (cv CtxVerify) setCache(ctx context.Context) (user, bool) {
 
 	sub := cv.Sub
 	tkn := cv.Tkn
 	iss := cv.Iss
 
 	//Check if sub is a key which has data in cache
-	usr := cache[sub]
-
-	//Retrieve info from /userinfo if not present
-	if usr.email == "" {
-		//If not: query /userinfo and db
-		u := getUser(tkn, iss)
-		if sub != u["sub"] {
-			return false //sub from token should match sub from Auth0's /userinfo
+	if usr, ok := cache.get(sub); ok {
+		return usr, true
+	}
+
+	//If not: take the email from the token (set by middleJWT), or query the issuer's /userinfo
+	eml := cv.Email
+	if eml == "" {
+		p, ok := auth.provider(iss)
+		if !ok || p.userinfo == "" {
+			fmt.Println("No email claim or userinfo endpoint for issuer", iss)
+			return user{}, false
 		}
 
-		//Retrieve user info from db _system
-		dbx, ctx := aranDB(ah, "_system")
-		var execQ []d
+		u, err := userInfo.getUser(ctx, tkn, p.userinfo)
+		if err != nil {
+			fmt.Println("Failed to retrieve userinfo:", err)
+			return user{}, false
+		}
+		if sub != iss+"|"+fmt.Sprint(u["sub"]) {
+			return user{}, false //sub from token should match sub from Auth0's /userinfo
+		}
 
-		eml := u["email"]
+		eml = fmt.Sprintf("%v", u["email"])
+	}
 
-		bind := d{"email": eml}
-		q := "FOR d in users FILTER d.email == @email RETURN {db: d.db, email: d.email, role:d.role}"
+	//Retrieve user info from db _system
+	b, err := store.UserGet(ctx, eml)
+	if errors.Is(err, errNotFound) {
+		return user{}, false //user does not exist in system db
+	} else if err != nil {
+		fmt.Println("Failed to retrieve user:", err)
+		return user{}, false
+	}
 
-		if ct {
-			data := aranQuery{q, bind, dbx, ctx}
-			execQ = data.aranQ()
-		} else {
-			fmt.Println("Failed to connect. Troubleshoot connection to ", ah)
-			return false
-		}
+	cache.set(sub, b)
 
-		em := fmt.Sprintf("%v", execQ[0]["email"])
-		edb := fmt.Sprintf("%v", execQ[0]["db"])
-		er := fmt.Sprintf("%v", execQ[0]["role"])
+	return b, true
 
-		if edb == "" {
-			return false //user does not exist in system db
-		}
+}
 
-		b := user{em, edb, er}
-		cache[sub] = b
+/*
+ * USERINFO CLIENT
+ * Looks up /userinfo for tokens without an email claim. Each attempt has a timeout,
+ * network errors, 429 and 5xx are retried with backoff, and answers are cached per
+ * token so a burst of requests (or a cache purge) doesn't hit the provider's rate limit.
+ */
+type userInfoClient struct {
+	http    *http.Client
+	retries int
+	ttl     time.Duration
+
+	mu   sync.Mutex
+	seen map[[32]byte]userInfoEntry //sha256 of the token
+}
 
-		return true
+type userInfoEntry struct {
+	u   ujson
+	exp time.Time
+}
 
-	}
+// Set up in main()
+var userInfo *userInfoClient
 
-	return true
+// Entries kept before expired ones are swept
+const userInfoMax = 1000
 
+func newUserInfoClient(cfg UserInfoConfig) *userInfoClient {
+	return &userInfoClient{
+		http:    &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		retries: cfg.Retries,
+		ttl:     time.Duration(cfg.CacheTTL),
+		seen:    make(map[[32]byte]userInfoEntry),
+	}
 }
 
-//Retrieve /userinfo from Auth0 based on Bearer token
-func getUser(tok string, iss string) ujson {
-	url := iss + "userinfo"
+//Retrieve /userinfo from the issuer based on Bearer token
+func (ui *userInfoClient) getUser(ctx context.Context, tok string, url string) (ujson, error) {
+	k := sha256.Sum256([]byte(tok))
 
+	ui.mu.Lock()
+	e, ok := ui.seen[k]
+	ui.mu.Unlock()
+	if ok && time.Now().Before(e.exp) {
+		return e.u, nil
+	}
+
+	var err error
+	var u ujson
+	wait := 250 * time.Millisecond
+
+	for i := 0; i <= ui.retries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+			wait *= 2
+		}
+
+		var retry bool
+		if u, retry, err = ui.fetch(ctx, tok, url); err == nil || !retry {
+			break
+		}
+		fmt.Println("Userinfo: attempt", i+1, "failed:", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ui.ttl > 0 {
+		ui.set(k, u)
+	}
+
+	return u, nil
+}
+
+// One attempt. retry reports whether trying again might help.
+func (ui *userInfoClient) fetch(ctx context.Context, tok string, url string) (u ujson, retry bool, err error) {
 	//curl --request GET --url 'https://YOUR_DOMAIN/userinfo' --header 'Authorization: Bearer {ACCESS_TOKEN}' --header 'Content-Type: application/json'
-	req, _ := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
 
 	req.Header.Add("authorization", "Bearer "+tok)
 	req.Header.Add("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
-
+	res, err := ui.http.Do(req)
 	if err != nil {
-		fmt.Println(err)
+		return nil, ctx.Err() == nil, err //res is nil here
 	}
-
 	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		retry = res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		return nil, retry, fmt.Errorf("userinfo: %s", res.Status)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, true, err
+	}
 
 	//Get as json
-	var bodyj ujson
-	if err := json.Unmarshal(body, &bodyj); err != nil {
-		fmt.Println("Error providing json: ", err)
+	if err := json.Unmarshal(body, &u); err != nil {
+		return nil, false, fmt.Errorf("userinfo: %w", err)
+	}
+
+	return u, false, nil
+}
+
+func (ui *userInfoClient) set(k [32]byte, u ujson) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	now := time.Now()
+	if len(ui.seen) >= userInfoMax {
+		for sk, e := range ui.seen {
+			if now.After(e.exp) {
+				delete(ui.seen, sk)
+			}
+		}
+	}
+	if len(ui.seen) >= userInfoMax {
+		ui.seen = make(map[[32]byte]userInfoEntry)
 	}
 
-	return bodyj
+	ui.seen[k] = userInfoEntry{u, now.Add(ui.ttl)}
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * USER CACHE
+ * Maps a token's issuer and sub (CtxVerify.Sub, "iss|sub") to the user (email, db, role). Safe for concurrent use.
+ * Entries expire after ttl so role changes and deletions are picked up, and the
+ * least recently used entry is evicted once max entries are held.
+ */
+type userCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element //sub -> element in lru, holding *cacheEntry
+	lru     *list.List               //Most recently used at the front
+
+	hits, misses, evictions, expired atomic.Uint64
+}
+
+type cacheEntry struct {
+	sub string
+	usr user
+	exp time.Time
+}
+
+// Counters since start, see GET /admin/cache
+type cacheStats struct {
+	Size      int    `json:"size"`
+	Max       int    `json:"max"`
+	TTL       string `json:"ttl"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Expired   uint64 `json:"expired"`
+}
+
+func newUserCache(ttl time.Duration, max int) *userCache {
+	return &userCache{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// User cached for sub, if present and not expired
+func (c *userCache) get(sub string) (user, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[sub]
+	if !ok {
+		c.misses.Add(1)
+		return user{}, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.exp) {
+		c.remove(el)
+		c.expired.Add(1)
+		c.misses.Add(1)
+		return user{}, false
+	}
+
+	c.lru.MoveToFront(el)
+	c.hits.Add(1)
+
+	return e.usr, true
+}
+
+func (c *userCache) set(sub string, u user) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	exp := time.Now().Add(c.ttl)
+
+	if el, ok := c.entries[sub]; ok {
+		el.Value = &cacheEntry{sub, u, exp}
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[sub] = c.lru.PushFront(&cacheEntry{sub, u, exp})
+
+	for c.max > 0 && c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Drop the entry for sub
+func (c *userCache) invalidate(sub string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[sub]; ok {
+		c.remove(el)
+	}
+}
+
+// Drop every sub belonging to email, e.g. after a role change. Returns the number dropped.
+func (c *userCache) invalidateEmail(email string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, el := range c.entries {
+		if el.Value.(*cacheEntry).usr.email == email {
+			c.remove(el)
+			n++
+		}
+	}
+
+	return n
+}
+
+// Drop everything
+func (c *userCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+func (c *userCache) stats() cacheStats {
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+
+	return cacheStats{
+		Size:      size,
+		Max:       c.max,
+		TTL:       c.ttl.String(),
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Expired:   c.expired.Load(),
+	}
+}
+
+// Callers must hold the lock
+func (c *userCache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*cacheEntry).sub)
+	c.lru.Remove(el)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUserCacheTTL(t *testing.T) {
+	c := newUserCache(time.Hour, 10)
+	c.set("iss|a", user{"a@x.io", "db1", roleUser})
+	if u, ok := c.get("iss|a"); !ok || u.email != "a@x.io" {
+		t.Fatalf("get = %v, %v, want a@x.io", u, ok)
+	}
+
+	//Already expired when set
+	c = newUserCache(-time.Nanosecond, 10)
+	c.set("iss|a", user{"a@x.io", "db1", roleUser})
+	if _, ok := c.get("iss|a"); ok {
+		t.Error("expired entry returned")
+	}
+
+	s := c.stats()
+	if s.Size != 0 || s.Expired != 1 || s.Misses != 1 {
+		t.Errorf("stats = %+v, want the entry dropped as expired", s)
+	}
+}
+
+func TestUserCacheLRU(t *testing.T) {
+	c := newUserCache(time.Hour, 2)
+	c.set("a", user{email: "a@x.io"})
+	c.set("b", user{email: "b@x.io"})
+	c.get("a") //b is now least recently used
+	c.set("c", user{email: "c@x.io"})
+
+	for sub, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(sub); ok != want {
+			t.Errorf("get(%s) found %v, want %v", sub, ok, want)
+		}
+	}
+	if s := c.stats(); s.Size != 2 || s.Evictions != 1 {
+		t.Errorf("stats = %+v, want size 2 after 1 eviction", s)
+	}
+
+	//Setting a held sub again replaces it without evicting
+	c.set("a", user{email: "a2@x.io"})
+	if u, _ := c.get("a"); u.email != "a2@x.io" {
+		t.Errorf("get(a) = %v after replacing it", u)
+	}
+	if s := c.stats(); s.Evictions != 1 {
+		t.Errorf("%d evictions, want 1", s.Evictions)
+	}
+}
+
+func TestUserCacheInvalidate(t *testing.T) {
+	c := newUserCache(time.Hour, 10)
+	c.set("iss1|a", user{email: "a@x.io"})
+	c.set("iss2|a", user{email: "a@x.io"}) //Same user from a second issuer
+	c.set("iss1|b", user{email: "b@x.io"})
+
+	if n := c.invalidateEmail("a@x.io"); n != 2 {
+		t.Errorf("invalidateEmail = %d, want 2", n)
+	}
+	if n := c.invalidateEmail("a@x.io"); n != 0 {
+		t.Errorf("invalidateEmail again = %d, want 0", n)
+	}
+	if _, ok := c.get("iss1|b"); !ok {
+		t.Error("other user dropped")
+	}
+
+	c.invalidate("iss1|b")
+	if _, ok := c.get("iss1|b"); ok {
+		t.Error("invalidated sub still cached")
+	}
+
+	c.set("iss1|c", user{email: "c@x.io"})
+	c.purge()
+	if s := c.stats(); s.Size != 0 {
+		t.Errorf("size %d after purge", s.Size)
+	}
+}
+
+// Run with -race
+func TestUserCacheConcurrent(t *testing.T) {
+	c := newUserCache(time.Hour, 50)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				sub := fmt.Sprint(i % 80)
+				c.set(sub, user{email: sub + "@x.io"})
+				c.get(sub)
+				if i%50 == 0 {
+					c.invalidateEmail(fmt.Sprint(g) + "@x.io")
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if s := c.stats(); s.Size > 50 {
+		t.Errorf("size %d, over max 50", s.Size)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"apiServer/units"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * PRICE COMPARISON
+ * Latest and average price of an item at each shop, from its price history. Prices are
+ * also given per kg, l or unit of the item's nett, so they can be set against prices of
+ * other items. Prices in different currencies can't be compared, so
+ * a shop that priced the item in two currencies has a row for each, and the cheapest
+ * shop is flagged per currency.
+ */
+type ItemCompare struct {
+	Item  Item          `json:"item"`
+	Per   string        `json:"per"` //Unit of the unit prices, "" if the item has no nett or an unknown unit
+	Shops []ShopCompare `json:"shops"`
+}
+
+type ShopCompare struct {
+	ShopId      string  `json:"shop_id"`
+	Shop        string  `json:"shop"`
+	Branch      string  `json:"branch"`
+	City        string  `json:"city"`
+	Country     string  `json:"country"`
+	Currency    string  `json:"currency"`
+	Latest      float32 `json:"latest"`
+	LatestDate  int64   `json:"latest_date"`
+	Special     bool    `json:"special"` //The latest price was a special
+	Average     float32 `json:"average"`
+	Count       int     `json:"count"` //Prices the average is over
+	UnitLatest  float32 `json:"unit_latest"`
+	UnitAverage float32 `json:"unit_average"`
+	Cheapest    bool    `json:"cheapest"` //Lowest latest price in its currency
+}
+
+/*
+ * Unit prices, per kg, l or unit (see package units). Items without a nett, or from
+ * before nett_unit was checked with a unit it doesn't know, have none.
+ */
+
+// Price per unit of an item of nett in unit, and what that unit is. Both are empty
+// without a price or a unit price.
+func unitPrice(price, nett float32, unit string) (float32, string) {
+	if price == 0 {
+		return 0, ""
+	}
+	p, per, err := units.PricePer(float64(price), float64(nett), unit)
+	if err != nil {
+		return 0, ""
+	}
+
+	return float32(p), per
+}
+
+func (e *SListItems) setUnitPrice() {
+	e.UnitPrice, e.Per = unitPrice(e.Price, e.Nett, e.Nett_unit)
+}
+
+func setUnitPrices(sl []SList) {
+	for _, s := range sl {
+		for n := range s.Items {
+			s.Items[n].setUnitPrice()
+		}
+	}
+}
+
+func (h *PriceHistory) setUnitPrices() {
+	for n, p := range h.Prices {
+		h.Prices[n].UnitPrice, h.Prices[n].Per = unitPrice(p.Price, h.Nett, h.NettUnit)
+	}
+}
+
+// Cheapest first within each currency
+func compareItem(i Item, h PriceHistory) ItemCompare {
+	out := ItemCompare{Item: i, Shops: []ShopCompare{}}
+
+	_, out.Per = unitPrice(1, i.Nett, i.Ntt_un)
+	unit := func(p float32) float32 {
+		u, _ := unitPrice(p, i.Nett, i.Ntt_un)
+		return u
+	}
+
+	//Prices are newest first, so the first of each shop and currency is the latest
+	latest := map[[2]string]ItemTrend{}
+	for _, p := range h.Prices {
+		k := [2]string{p.ShopId, p.Currency}
+		if _, ok := latest[k]; !ok {
+			latest[k] = p
+		}
+	}
+
+	for _, s := range h.Shops {
+		for _, st := range s.Stats {
+			l := latest[[2]string{s.ShopId, st.Currency}]
+			out.Shops = append(out.Shops, ShopCompare{
+				s.ShopId, s.Shop, s.Branch, s.City, s.Country, st.Currency,
+				l.Price, l.Date, l.Special, st.Avg, st.Count,
+				unit(l.Price), unit(st.Avg), false,
+			})
+		}
+	}
+
+	sort.SliceStable(out.Shops, func(a, b int) bool {
+		if out.Shops[a].Currency != out.Shops[b].Currency {
+			return out.Shops[a].Currency < out.Shops[b].Currency
+		}
+		return out.Shops[a].Latest < out.Shops[b].Latest
+	})
+
+	//Flag the first of each currency, and any tied with it
+	for n, s := range out.Shops {
+		if n == 0 || s.Currency != out.Shops[n-1].Currency {
+			out.Shops[n].Cheapest = true
+		} else if s.Latest == out.Shops[n-1].Latest && out.Shops[n-1].Cheapest {
+			out.Shops[n].Cheapest = true
+		}
+	}
+
+	return out
+}
+
+func compareGetItem(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	i, err := store.ItemGet(ctx, ctxDB(c), id)
+	if err != nil {
+		return err
+	}
+
+	h, err := store.PriceHistory(ctx, ctxDB(c), id, PriceFilter{ByShop: true})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, compareItem(i, h))
+}
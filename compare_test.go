@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestUnitPrice(t *testing.T) {
+	tests := []struct {
+		price, nett float32
+		unit        string
+		want        float32
+		per         string
+	}{
+		{10, 500, "g", 20, "kg"},
+		{12, 1, "dozen", 1, "unit"},
+		{10, 2, "bunch", 0, ""}, //Unknown unit
+		{10, 0, "kg", 0, ""},
+		{10, 1, "", 0, ""},
+		{0, 1, "kg", 0, ""}, //No price, as entries of a list made from a template
+	}
+
+	for _, tt := range tests {
+		p, per := unitPrice(tt.price, tt.nett, tt.unit)
+		if p != tt.want || per != tt.per {
+			t.Errorf("unitPrice(%v, %v, %q) = %v %q, want %v %q", tt.price, tt.nett, tt.unit, p, per, tt.want, tt.per)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * CONFIGURATION
+ * Defaults, then the JSON file given by -config (or CONFIG_FILE), then environment
+ * variables. See config.example.json for the file layout and the env names below.
+ */
+type Config struct {
+	Listen string    `json:"listen"` //e.g. ":4000"
+	TLS    TLSConfig `json:"tls"`
+	CORS   []string  `json:"cors_origins"`
+
+	Store          string       `json:"store"`            //"arango" or "memory"
+	BootstrapAdmin string       `json:"bootstrap_admin"`  //Made admin (and created) at startup while there is no admin
+	MigrateOnStart bool         `json:"migrate_on_start"` //Migrate every tenant at startup, see migrate.go
+	Arango         ArangoConfig `json:"arango"`
+
+	Auth  AuthConfig  `json:"auth"`
+	Cache CacheConfig `json:"cache"`
+
+	ArchiveDir string `json:"archive_dir"` //Where user data is exported before deletion. Empty disables export.
+}
+
+type TLSConfig struct {
+	Cert string `json:"cert"` //PEM files. Both or neither.
+	Key  string `json:"key"`
+}
+
+type ArangoConfig struct {
+	Endpoints      []string `json:"endpoints"`
+	User           string   `json:"user"`
+	Password       string   `json:"password"`
+	ConnLimit      int      `json:"conn_limit"` //Per server, -1 for no limit
+	IdleConns      int      `json:"idle_conns"`
+	IdleTimeout    duration `json:"idle_timeout"`
+	HealthInterval duration `json:"health_interval"`
+}
+
+// Either a single Auth0 tenant (issuer/audience, as before) or a list of providers
+type AuthConfig struct {
+	Issuer     string           `json:"issuer"` //Auth0 domain incl. trailing slash, e.g. https://example.eu.auth0.com/
+	Audience   string           `json:"audience"`
+	EmailClaim string           `json:"email_claim"` //See ProviderConfig, for the issuer/audience pair only
+	Providers  []ProviderConfig `json:"providers"`
+	UserInfo   UserInfoConfig   `json:"userinfo"`
+}
+
+// Client for the providers' /userinfo endpoints
+type UserInfoConfig struct {
+	Timeout  duration `json:"timeout"`   //Per attempt
+	Retries  int      `json:"retries"`   //Extra attempts on network errors, 429 and 5xx
+	CacheTTL duration `json:"cache_ttl"` //Responses are cached per token
+}
+
+// One token issuer. Tokens are matched to a provider on their iss claim.
+type ProviderConfig struct {
+	Name     string   `json:"name"`     //Shown in logs
+	Type     string   `json:"type"`     //"auth0", "oidc" or "static"
+	Issuer   string   `json:"issuer"`   //Must equal the token's iss exactly
+	Audience []string `json:"audience"` //Token must carry one of these
+
+	//auth0 and oidc: keys are fetched from the issuer's discovery document, or jwks_url
+	JWKSURL string   `json:"jwks_url"`
+	JWKSTTL duration `json:"jwks_ttl"`
+
+	//static: algorithm (default RS256) and key. HS* takes the shared secret itself,
+	//anything else the path to a PEM public key.
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"key"`
+
+	//Where to look up the user's email. Defaults to <issuer>userinfo for auth0.
+	UserInfo string `json:"userinfo"`
+
+	//Offline mode: take the email from this claim of the verified token (e.g. "email" or
+	//"https://shopapp/email") and only fall back to userinfo when the claim is missing.
+	//If verified_claim is set, that claim must be true as well (e.g. "email_verified").
+	EmailClaim    string `json:"email_claim"`
+	VerifiedClaim string `json:"verified_claim"`
+}
+
+type CacheConfig struct {
+	TTL  duration `json:"ttl"`
+	Size int      `json:"size"`
+}
+
+// time.Duration read from strings such as "90s" or "10m"
+type duration time.Duration
+
+func (du *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*du = duration(v)
+	return nil
+}
+
+func (du duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(du).String())
+}
+
+// Active configuration, set in main()
+var conf Config
+
+func defaultConfig() Config {
+	return Config{
+		Listen:         ":4000",
+		CORS:           []string{"*"},
+		Store:          "arango",
+		MigrateOnStart: true,
+		Arango: ArangoConfig{
+			User:           "root",
+			ConnLimit:      32,
+			IdleConns:      64,
+			IdleTimeout:    duration(90 * time.Second),
+			HealthInterval: duration(30 * time.Second),
+		},
+		Auth: AuthConfig{
+			UserInfo: UserInfoConfig{
+				Timeout:  duration(5 * time.Second),
+				Retries:  2,
+				CacheTTL: duration(5 * time.Minute),
+			},
+		},
+		Cache: CacheConfig{
+			TTL:  duration(10 * time.Minute),
+			Size: 1000,
+		},
+	}
+}
+
+// Load defaults, file (if path is not empty) and environment, then validate
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("config: %w", err)
+		}
+
+		dec := json.NewDecoder(strings.NewReader(string(b)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("config: %s: %w", path, err)
+		}
+	}
+
+	//Report bad env values together with everything validate finds
+	if err := errors.Join(cfg.fromEnv(), cfg.validate()); err != nil {
+		return cfg, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	return cfg, nil
+}
+
+// Environment overrides
+func (cfg *Config) fromEnv() error {
+	var errs []error
+
+	str := func(env string, dst *string) {
+		if v, ok := os.LookupEnv(env); ok {
+			*dst = v
+		}
+	}
+	list := func(env string, dst *[]string) {
+		if v, ok := os.LookupEnv(env); ok {
+			*dst = splitList(v)
+		}
+	}
+	num := func(env string, dst *int) {
+		if v, ok := os.LookupEnv(env); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: not a number: %q", env, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	flag := func(env string, dst *bool) {
+		if v, ok := os.LookupEnv(env); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: not a boolean: %q", env, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	dur := func(env string, dst *duration) {
+		if v, ok := os.LookupEnv(env); ok {
+			t, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+				return
+			}
+			*dst = duration(t)
+		}
+	}
+
+	str("LISTEN_ADDR", &cfg.Listen)
+	str("TLS_CERT", &cfg.TLS.Cert)
+	str("TLS_KEY", &cfg.TLS.Key)
+	list("CORS_ORIGINS", &cfg.CORS)
+
+	str("STORE_BACKEND", &cfg.Store)
+	str("STORE_ADMIN", &cfg.BootstrapAdmin) //Older name
+	str("BOOTSTRAP_ADMIN", &cfg.BootstrapAdmin)
+	flag("MIGRATE_ON_START", &cfg.MigrateOnStart)
+
+	list("ADB_HOST", &cfg.Arango.Endpoints)
+	str("ADB_USER", &cfg.Arango.User)
+	str("ADB_PASS", &cfg.Arango.Password)
+	num("ADB_CONN_LIMIT", &cfg.Arango.ConnLimit)
+	num("ADB_IDLE_CONNS", &cfg.Arango.IdleConns)
+	dur("ADB_IDLE_TIMEOUT", &cfg.Arango.IdleTimeout)
+	dur("ADB_HEALTH_INTERVAL", &cfg.Arango.HealthInterval)
+
+	str("AUTH0_ISS", &cfg.Auth.Issuer)
+	str("AUTH0_AUD", &cfg.Auth.Audience)
+	str("AUTH_EMAIL_CLAIM", &cfg.Auth.EmailClaim)
+	dur("AUTH_USERINFO_TIMEOUT", &cfg.Auth.UserInfo.Timeout)
+	num("AUTH_USERINFO_RETRIES", &cfg.Auth.UserInfo.Retries)
+	dur("AUTH_USERINFO_CACHE_TTL", &cfg.Auth.UserInfo.CacheTTL)
+
+	str("ARCHIVE_DIR", &cfg.ArchiveDir)
+
+	dur("CACHE_TTL", &cfg.Cache.TTL)
+	num("CACHE_SIZE", &cfg.Cache.Size)
+
+	return errors.Join(errs...)
+}
+
+// Configured providers. The legacy issuer/audience pair counts as an auth0 provider.
+func (a AuthConfig) providers() []ProviderConfig {
+	if len(a.Providers) > 0 {
+		return a.Providers
+	}
+	if a.Issuer == "" {
+		return nil
+	}
+
+	return []ProviderConfig{{
+		Name:       "auth0",
+		Type:       "auth0",
+		Issuer:     a.Issuer,
+		Audience:   splitList(a.Audience),
+		EmailClaim: a.EmailClaim,
+	}}
+}
+
+// Comma separated list, blanks dropped
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+// Check the whole config and report every problem at once
+func (cfg Config) validate() error {
+	var errs []error
+	bad := func(f string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(f, a...))
+	}
+
+	if cfg.Listen == "" {
+		bad("listen: address not set (LISTEN_ADDR)")
+	}
+
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		bad("tls: cert and key must be set together (TLS_CERT, TLS_KEY)")
+	}
+	for _, f := range []string{cfg.TLS.Cert, cfg.TLS.Key} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			bad("tls: %v", err)
+		}
+	}
+
+	if len(cfg.CORS) == 0 {
+		bad("cors_origins: at least one origin (or \"*\") required (CORS_ORIGINS)")
+	}
+
+	switch cfg.Store {
+	case "arango":
+		if len(cfg.Arango.Endpoints) == 0 {
+			bad("arango.endpoints: Arango DB host not set (ADB_HOST)")
+		}
+		for _, ep := range cfg.Arango.Endpoints {
+			if u, err := url.Parse(ep); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				bad("arango.endpoints: %q is not an http(s) URL", ep)
+			}
+		}
+		if cfg.Arango.User == "" {
+			bad("arango.user: not set (ADB_USER)")
+		}
+		if cfg.Arango.ConnLimit == 0 || cfg.Arango.ConnLimit < -1 {
+			bad("arango.conn_limit: must be positive, or -1 for no limit (ADB_CONN_LIMIT)")
+		}
+		if cfg.Arango.IdleConns <= 0 {
+			bad("arango.idle_conns: must be positive (ADB_IDLE_CONNS)")
+		}
+		if cfg.Arango.IdleTimeout <= 0 || cfg.Arango.HealthInterval <= 0 {
+			bad("arango: idle_timeout and health_interval must be positive")
+		}
+	case "memory":
+	default:
+		bad("store: unknown backend %q, use \"arango\" or \"memory\" (STORE_BACKEND)", cfg.Store)
+	}
+
+	if len(cfg.Auth.Providers) == 0 && cfg.Auth.Issuer == "" {
+		bad("auth: no issuer (AUTH0_ISS) or providers set")
+	}
+	iss := make(map[string]bool)
+	for i, p := range cfg.Auth.providers() {
+		at := fmt.Sprintf("auth.providers[%d] (%s)", i, p.Name)
+		if iss[p.Issuer] {
+			bad("%s: issuer %q used twice", at, p.Issuer)
+		}
+		iss[p.Issuer] = true
+
+		if len(p.Audience) == 0 {
+			bad("%s: audience not set (AUTH0_AUD)", at)
+		}
+		if p.VerifiedClaim != "" && p.EmailClaim == "" {
+			bad("%s: verified_claim needs email_claim", at)
+		}
+
+		switch p.Type {
+		case "auth0", "oidc":
+			if u, err := url.Parse(p.Issuer); err != nil || u.Scheme == "" || u.Host == "" {
+				bad("%s: issuer %q is not a URL (AUTH0_ISS)", at, p.Issuer)
+			} else if p.Type == "auth0" && !strings.HasSuffix(p.Issuer, "/") {
+				bad("%s: auth0 issuer must end with \"/\" (AUTH0_ISS)", at)
+			}
+			if p.JWKSURL != "" {
+				if u, err := url.Parse(p.JWKSURL); err != nil || u.Scheme == "" || u.Host == "" {
+					bad("%s: jwks_url %q is not a URL", at, p.JWKSURL)
+				}
+			}
+		case "static":
+			if p.UserInfo == "" && p.EmailClaim == "" {
+				bad("%s: static issuers need email_claim (or userinfo) to resolve users", at)
+			}
+			if p.Issuer == "" {
+				bad("%s: issuer not set", at)
+			}
+			if p.Key == "" {
+				bad("%s: key not set", at)
+			}
+		default:
+			bad("%s: unknown type %q, use \"auth0\", \"oidc\" or \"static\"", at, p.Type)
+		}
+	}
+
+	if cfg.Auth.UserInfo.Timeout <= 0 || cfg.Auth.UserInfo.Retries < 0 || cfg.Auth.UserInfo.CacheTTL < 0 {
+		bad("auth.userinfo: timeout must be positive, retries and cache_ttl not negative")
+	}
+
+	if cfg.ArchiveDir != "" {
+		if fi, err := os.Stat(cfg.ArchiveDir); err == nil && !fi.IsDir() {
+			bad("archive_dir: %s is not a directory (ARCHIVE_DIR)", cfg.ArchiveDir)
+		}
+	}
+
+	if cfg.Cache.TTL <= 0 || cfg.Cache.Size <= 0 {
+		bad("cache: ttl and size must be positive (CACHE_TTL, CACHE_SIZE)")
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Valid config for the memory store and one static issuer
+func testConfig() Config {
+	cfg := defaultConfig()
+	cfg.Store = "memory"
+	cfg.Auth.Providers = []ProviderConfig{{
+		Name: "local", Type: "static", Issuer: "local-dev", Audience: []string{"api"},
+		Algorithm: "HS256", Key: "sekret", EmailClaim: "email",
+	}}
+
+	return cfg
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := testConfig().validate(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(*Config)
+		want string //In the error
+	}{
+		{"no listen", func(c *Config) { c.Listen = "" }, "listen:"},
+		{"cert without key", func(c *Config) { c.TLS.Cert = "x.pem" }, "cert and key must be set together"},
+		{"no cors", func(c *Config) { c.CORS = nil }, "cors_origins:"},
+		{"unknown store", func(c *Config) { c.Store = "redis" }, `unknown backend "redis"`},
+		{"arango without endpoints", func(c *Config) { c.Store = "arango" }, "ADB_HOST"},
+		{"arango endpoint not a URL", func(c *Config) { c.Store, c.Arango.Endpoints = "arango", []string{"arango:8529"} }, "not an http(s) URL"},
+		{"arango conn limit", func(c *Config) {
+			c.Store, c.Arango.Endpoints, c.Arango.ConnLimit = "arango", []string{"http://arango:8529"}, -2
+		}, "conn_limit"},
+		{"no issuer", func(c *Config) { c.Auth.Providers = nil }, "no issuer"},
+		{"issuer twice", func(c *Config) { c.Auth.Providers = append(c.Auth.Providers, c.Auth.Providers[0]) }, "used twice"},
+		{"no audience", func(c *Config) { c.Auth.Providers[0].Audience = nil }, "audience not set"},
+		{"static without email", func(c *Config) { c.Auth.Providers[0].EmailClaim = "" }, "need email_claim"},
+		{"verified without email", func(c *Config) {
+			c.Auth.Providers[0].EmailClaim, c.Auth.Providers[0].UserInfo, c.Auth.Providers[0].VerifiedClaim = "", "http://x/userinfo", "email_verified"
+		}, "verified_claim needs email_claim"},
+		{"unknown provider type", func(c *Config) { c.Auth.Providers[0].Type = "saml" }, `unknown type "saml"`},
+		{"auth0 issuer without slash", func(c *Config) { c.Auth.Providers = nil; c.Auth.Issuer, c.Auth.Audience = "https://x.auth0.com", "api" }, `must end with "/"`},
+		{"userinfo timeout", func(c *Config) { c.Auth.UserInfo.Timeout = 0 }, "auth.userinfo:"},
+		{"cache size", func(c *Config) { c.Cache.Size = 0 }, "cache:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Auth.Providers = append([]ProviderConfig(nil), cfg.Auth.Providers...)
+			tt.edit(&cfg)
+
+			err := cfg.validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("validate() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	//Every problem at once
+	cfg := testConfig()
+	cfg.Listen, cfg.Cache.TTL = "", 0
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "listen:") || !strings.Contains(err.Error(), "cache:") {
+		t.Errorf("validate() = %v, want both listen and cache", err)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("LISTEN_ADDR", ":5000")
+	t.Setenv("CORS_ORIGINS", "https://a.io, ,https://b.io")
+	t.Setenv("STORE_BACKEND", "memory")
+	t.Setenv("MIGRATE_ON_START", "false")
+	t.Setenv("ADB_CONN_LIMIT", "8")
+	t.Setenv("CACHE_TTL", "2m")
+	t.Setenv("STORE_ADMIN", "old@x.io")
+	t.Setenv("BOOTSTRAP_ADMIN", "new@x.io") //Wins over the older name
+
+	cfg := defaultConfig()
+	if err := cfg.fromEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != ":5000" || cfg.Store != "memory" || cfg.MigrateOnStart || cfg.Arango.ConnLimit != 8 {
+		t.Errorf("fromEnv gave %+v", cfg)
+	}
+	if want := []string{"https://a.io", "https://b.io"}; !reflect.DeepEqual(cfg.CORS, want) {
+		t.Errorf("CORS = %v, want %v", cfg.CORS, want)
+	}
+	if time.Duration(cfg.Cache.TTL) != 2*time.Minute {
+		t.Errorf("cache TTL = %v, want 2m", time.Duration(cfg.Cache.TTL))
+	}
+	if cfg.BootstrapAdmin != "new@x.io" {
+		t.Errorf("bootstrap admin = %s, want new@x.io", cfg.BootstrapAdmin)
+	}
+
+	//Bad values are all reported, and leave the setting as it was
+	t.Setenv("CACHE_SIZE", "lots")
+	t.Setenv("MIGRATE_ON_START", "maybe")
+	t.Setenv("ADB_IDLE_TIMEOUT", "90")
+
+	cfg = defaultConfig()
+	err := cfg.fromEnv()
+	for _, env := range []string{"CACHE_SIZE", "MIGRATE_ON_START", "ADB_IDLE_TIMEOUT"} {
+		if err == nil || !strings.Contains(err.Error(), env) {
+			t.Errorf("fromEnv error = %v, want %s", err, env)
+		}
+	}
+	if def := defaultConfig(); cfg.Cache.Size != def.Cache.Size || cfg.Arango.IdleTimeout != def.Arango.IdleTimeout {
+		t.Errorf("bad values changed the config: %+v", cfg)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	good := write("good.json", `{"store": "memory", "cache": {"ttl": "30s"},
+		"auth": {"providers": [{"name": "local", "type": "static", "issuer": "local-dev",
+			"audience": ["api"], "algorithm": "HS256", "key": "sekret", "email_claim": "email"}]}}`)
+	t.Setenv("LISTEN_ADDR", ":4012") //Env over file
+
+	cfg, err := loadConfig(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":4012" || time.Duration(cfg.Cache.TTL) != 30*time.Second || cfg.Cache.Size != 1000 {
+		t.Errorf("loadConfig gave listen %s, cache %+v", cfg.Listen, cfg.Cache)
+	}
+
+	if _, err := loadConfig(write("typo.json", `{"stroe": "memory"}`)); err == nil || !strings.Contains(err.Error(), "stroe") {
+		t.Errorf("unknown field: error = %v", err)
+	}
+	if _, err := loadConfig(write("dur.json", `{"cache": {"ttl": 30}}`)); err == nil {
+		t.Error("numeric duration accepted")
+	}
+	if _, err := loadConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing file accepted")
+	}
+}
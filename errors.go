@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	driver "github.com/arangodb/go-driver"
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * STORE ERRORS
+ * Every error leaving a Store is a *storeError carrying one of the kinds below.
+ * Test with errors.Is(err, errNotFound) etc, and use errStatus for the HTTP status.
+ */
+var (
+	errNotFound    = errors.New("not found")
+	errConflict    = errors.New("conflict")
+	errUnavailable = errors.New("database unavailable")
+	errBadQuery    = errors.New("bad query")
+	errInternal    = errors.New("internal error")
+)
+
+type storeError struct {
+	kind error  //One of the kinds above
+	op   string //What was being done, e.g. "get item 123"
+	err  error  //Underlying error, if any
+}
+
+func (e *storeError) Error() string {
+	if e.err == nil {
+		return e.op + ": " + e.kind.Error()
+	}
+
+	return e.op + ": " + e.kind.Error() + ": " + e.err.Error()
+}
+
+// What clients are told: op and kind, without the underlying error, which may hold
+// endpoints or connection details. httpError logs that instead.
+func (e *storeError) public() string {
+	return e.op + ": " + e.kind.Error()
+}
+
+// Matches both the kind and the underlying error
+func (e *storeError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// Not found error for op
+func notFound(op string) error {
+	return &storeError{errNotFound, op, nil}
+}
+
+// Conflict error for op
+func conflict(op string) error {
+	return &storeError{errConflict, op, nil}
+}
+
+// Wrap err from the driver (or anything else) as a storeError. Already wrapped errors are kept as is.
+func storeErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var se *storeError
+	if errors.As(err, &se) {
+		return err
+	}
+
+	return &storeError{errKind(err), op, err}
+}
+
+// Classify a driver error. Only connection problems and timeouts are unavailable, as
+// clients retry those; anything else unexpected, e.g. a result that won't decode, is internal.
+func errKind(err error) error {
+	var ne net.Error
+
+	switch {
+	case driver.IsNoMoreDocuments(err): //Reading past the end of a cursor is a bug, not an outage
+		return errInternal
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), driver.IsCanceled(err), driver.IsTimeout(err):
+		return errUnavailable
+	case driver.IsNotFoundGeneral(err):
+		return errNotFound
+	case driver.IsConflict(err), driver.IsPreconditionFailed(err):
+		return errConflict
+	case driver.IsInvalidRequest(err), driver.IsInvalidArgument(err):
+		return errBadQuery
+	case driver.IsArangoErrorWithCode(err, http.StatusServiceUnavailable), driver.IsUnauthorized(err), driver.IsNoLeaderOrOngoing(err):
+		return errUnavailable
+	case driver.IsArangoError(err):
+		return errInternal
+	case driver.IsResponse(err), errors.As(err, &ne): //No (complete) answer from ArangoDB
+		return errUnavailable
+	}
+
+	return errInternal
+}
+
+// HTTP status for a store error
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errConflict):
+		return http.StatusConflict
+	case errors.Is(err, errBadQuery):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnavailable):
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+// Machine readable code for a store error
+func errCode(err error) string {
+	switch {
+	case errors.Is(err, errNotFound):
+		return "not_found"
+	case errors.Is(err, errConflict):
+		return "conflict"
+	case errors.Is(err, errBadQuery):
+		return "bad_request"
+	case errors.Is(err, errUnavailable):
+		return "unavailable"
+	}
+
+	return "internal"
+}
+
+/*
+ * ERROR RESPONSES
+ * Handlers and middleware return errors, and httpError (echo's HTTPErrorHandler) writes
+ * every one of them in the same shape:
+ *   {"code": "not_found", "message": "get item 12: not found", "details": ..., "request_id": "..."}
+ * Store errors, validation errors and echo errors are mapped here. Anything else is a 500.
+ */
+type apiError struct {
+	status    int
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// Error with extra details for the client, e.g. what blocked a delete
+func apiErr(status int, msg string, details interface{}) error {
+	return &apiError{status: status, Code: statusCode(status), Message: msg, Details: details}
+}
+
+// Code for errors that only have an HTTP status
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusUnprocessableEntity:
+		return "unprocessable"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+
+	if status >= 500 {
+		return "internal"
+	}
+
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+func toAPIError(err error) *apiError {
+	var ae *apiError
+	var ve validationError
+	var he *echo.HTTPError
+	var se *storeError
+
+	switch {
+	case errors.As(err, &ae):
+		return ae
+	case errors.As(err, &ve):
+		return &apiError{status: http.StatusUnprocessableEntity, Code: "validation_failed", Message: "validation failed", Details: ve}
+	case errors.As(err, &he):
+		return &apiError{status: he.Code, Code: statusCode(he.Code), Message: fmt.Sprint(he.Message)}
+	case errors.As(err, &se):
+		status := errStatus(err)
+		if status == http.StatusInternalServerError {
+			return &apiError{status: status, Code: "internal", Message: "internal error"}
+		}
+		return &apiError{status: status, Code: errCode(err), Message: se.public()}
+	}
+
+	//Unknown errors are not shown to clients
+	return &apiError{status: http.StatusInternalServerError, Code: "internal", Message: "internal error"}
+}
+
+// echo.HTTPErrorHandler, set in main()
+func httpError(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	e := toAPIError(err)
+	e.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+
+	//Log whatever the client wasn't shown
+	var se *storeError
+	if e.status >= 500 || (errors.As(err, &se) && se.err != nil) {
+		fmt.Println("Error:", e.RequestID, c.Request().Method, c.Request().URL.Path, err)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(e.status)
+	} else {
+		err = c.JSON(e.status, e)
+	}
+	if err != nil {
+		fmt.Println("Error: writing error response:", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	driver "github.com/arangodb/go-driver"
+	"github.com/labstack/echo/v4"
+)
+
+func TestErrKind(t *testing.T) {
+	arango := func(code, num int) error {
+		return driver.ArangoError{HasError: true, Code: code, ErrorNum: num, ErrorMessage: "test"}
+	}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	var decode error = json.Unmarshal([]byte(`"x"`), new(int))
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"not found", arango(http.StatusNotFound, 1202), errNotFound},
+		{"conflict", arango(http.StatusConflict, 1210), errConflict},
+		{"precondition failed", arango(http.StatusPreconditionFailed, 1200), errConflict},
+		{"bad query", arango(http.StatusBadRequest, 1501), errBadQuery},
+		{"server unavailable", arango(http.StatusServiceUnavailable, 503), errUnavailable},
+		{"unauthorized", arango(http.StatusUnauthorized, 11), errUnavailable},
+		{"other arango error", arango(http.StatusInternalServerError, 4), errInternal},
+		{"deadline", context.DeadlineExceeded, errUnavailable},
+		{"wrapped deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), errUnavailable},
+		{"canceled", context.Canceled, errUnavailable},
+		{"connection refused", refused, errUnavailable},
+		{"url error", &url.Error{Op: "Post", URL: "http://arango:8529", Err: refused}, errUnavailable},
+		{"no response", &driver.ResponseError{Err: io.ErrUnexpectedEOF}, errUnavailable},
+		{"no more documents", driver.NoMoreDocumentsError{}, errInternal},
+		{"decode", decode, errInternal},
+		{"programming error", errors.New("nil map"), errInternal},
+	}
+
+	for _, tt := range tests {
+		if got := errKind(tt.err); got != tt.want {
+			t.Errorf("%s: errKind(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// Errors that can't succeed on retry are 500s, connection problems 503s
+func TestToAPIErrorStoreKinds(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{storeErr("read query result", json.Unmarshal([]byte(`"x"`), new(int))), http.StatusInternalServerError, "internal"},
+		{storeErr("query", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), http.StatusServiceUnavailable, "unavailable"},
+	}
+
+	for _, tt := range tests {
+		ae := toAPIError(tt.err)
+		if ae.status != tt.status || ae.Code != tt.code {
+			t.Errorf("toAPIError(%v) = %d %s, want %d %s", tt.err, ae.status, ae.Code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestToAPIError(t *testing.T) {
+	ve := validationError{{"name", "is required"}}
+	secret := errors.New("dial tcp 10.0.0.5:8529")
+
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{"api error", apiErr(http.StatusConflict, "shop has lists", []string{"7"}), http.StatusConflict, "conflict", "shop has lists"},
+		{"wrapped api error", fmt.Errorf("delete: %w", apiErr(http.StatusForbidden, "no", nil)), http.StatusForbidden, "forbidden", "no"},
+		{"validation", ve, http.StatusUnprocessableEntity, "validation_failed", "validation failed"},
+		{"echo", echo.NewHTTPError(http.StatusMethodNotAllowed, "method not allowed"), http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed"},
+		{"echo teapot", echo.NewHTTPError(http.StatusTeapot, "tea"), http.StatusTeapot, "i'm_a_teapot", "tea"},
+		{"not found", notFound("get item 12"), http.StatusNotFound, "not_found", "get item 12: not found"},
+		{"conflict", conflict("create user"), http.StatusConflict, "conflict", "create user: conflict"},
+		{"bad query", &storeError{errBadQuery, "query items", secret}, http.StatusBadRequest, "bad_request", "query items: bad query"},
+		{"unavailable", &storeError{errUnavailable, "get item 12", secret}, http.StatusServiceUnavailable, "unavailable", "get item 12: database unavailable"},
+		{"internal", &storeError{errInternal, "get item 12", secret}, http.StatusInternalServerError, "internal", "internal error"},
+		{"wrapped store error", fmt.Errorf("handler: %w", notFound("get shop 3")), http.StatusNotFound, "not_found", "get shop 3: not found"},
+		{"plain error", secret, http.StatusInternalServerError, "internal", "internal error"},
+	}
+
+	for _, tt := range tests {
+		ae := toAPIError(tt.err)
+		if ae.status != tt.status || ae.Code != tt.code || ae.Message != tt.message {
+			t.Errorf("%s: toAPIError = %d %s %q, want %d %s %q", tt.name, ae.status, ae.Code, ae.Message, tt.status, tt.code, tt.message)
+		}
+		if strings.Contains(ae.Message, "10.0.0.5") {
+			t.Errorf("%s: message %q shows the underlying error", tt.name, ae.Message)
+		}
+	}
+
+	if ae := toAPIError(ve); !reflect.DeepEqual(ae.Details, ve) {
+		t.Errorf("validation details = %v, want %v", ae.Details, ve)
+	}
+}
+
+func TestHttpError(t *testing.T) {
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/items/12", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Response().Header().Set(echo.HeaderXRequestID, "req1")
+	httpError(validationError{{"name", "is required"}}, c)
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want 422", rec.Code)
+	}
+	var body struct {
+		Code      string       `json:"code"`
+		Message   string       `json:"message"`
+		Details   []fieldError `json:"details"`
+		RequestID string       `json:"request_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "validation_failed" || body.RequestID != "req1" || len(body.Details) != 1 || body.Details[0].Field != "name" {
+		t.Errorf("body = %s", rec.Body)
+	}
+
+	//HEAD gets the status only
+	req = httptest.NewRequest(http.MethodHead, "/items/12", nil)
+	rec = httptest.NewRecorder()
+	httpError(notFound("get item 12"), e.NewContext(req, rec))
+	if rec.Code != http.StatusNotFound || rec.Body.Len() != 0 {
+		t.Errorf("HEAD: status %d, body %q", rec.Code, rec.Body)
+	}
+}
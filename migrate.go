@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	driver "github.com/arangodb/go-driver"
+)
+
+/*
+ * TENANT SCHEMA MIGRATIONS
+ * Each tenant database records its schema version in Meta/schema. Migrations run in
+ * order from that version up to the latest, and the version is saved after each one,
+ * so a failed run resumes where it stopped. Every migration must be idempotent.
+ * New tenants are brought to the latest version when provisioned (see provisionDB).
+ *
+ * To change the tenant layout, append a migration. Never edit or reorder old ones.
+ */
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, db dbase) error
+}
+
+var migrations = []migration{
+	{1, "base collections", migrateBase},
+	{2, "indexes", migrateIndexes},
+	{3, "schema validation", migrateSchema},
+	{4, "backfill list hidden and label", migrateListDefaults},
+	{5, "list entries", migrateListEntries},
+	{6, "exchange rates", migrateRates},
+}
+
+// Version of a fully migrated tenant
+func schemaLatest() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Outcome for one tenant, see migrateAll
+type migrateResult struct {
+	Db    string `json:"db"`
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+	Error string `json:"error,omitempty"`
+}
+
+// Bring every tenant up to date. A failing tenant is reported and skipped.
+func migrateAll(ctx context.Context) ([]migrateResult, error) {
+	dbs, err := store.TenantDBs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []migrateResult
+	for _, n := range dbs {
+		from, to, err := store.SchemaMigrate(ctx, n)
+
+		r := migrateResult{Db: n, From: from, To: to}
+		if err != nil {
+			r.Error = err.Error()
+			fmt.Println("Migrate:", n, "stopped at version", to, err)
+		} else if from != to {
+			fmt.Println("Migrate:", n, "from version", from, "to", to)
+		}
+		out = append(out, r)
+	}
+
+	return out, nil
+}
+
+/*
+ * ArangoDB runner
+ */
+
+// Current schema version of db, 0 if never migrated. Only reads, so Meta is left for
+// migrate to create.
+func (db dbase) schemaVersion(ctx context.Context) (int, error) {
+	dbx, err := aranDB(ctx, db.db)
+	if err != nil {
+		return 0, err
+	}
+
+	if ok, err := dbx.CollectionExists(ctx, "Meta"); err != nil {
+		return 0, storeErr("check collection Meta", err)
+	} else if !ok {
+		return 0, nil
+	}
+
+	v, err := dbQuery[int](ctx, db, "FOR m IN Meta FILTER m._key == 'schema' RETURN m.version", nil)
+	if err != nil || v == nil {
+		return 0, err
+	}
+
+	return v[0], nil
+}
+
+// Apply pending migrations, returns the version before and after
+func (db dbase) migrate(ctx context.Context) (int, int, error) {
+	from, err := db.schemaVersion(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := db.colEnsure(ctx, "Meta"); err != nil {
+		return from, from, err
+	}
+
+	cur := from
+	for _, m := range migrations {
+		if m.version <= cur {
+			continue
+		}
+
+		if err := m.up(ctx, db); err != nil {
+			return from, cur, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+
+		q := `UPSERT {_key: 'schema'}
+			INSERT {_key: 'schema', version: @v, applied: [@entry]}
+			UPDATE {version: @v, applied: PUSH(OLD.applied, @entry)} IN Meta`
+		entry := d{"version": m.version, "name": m.name, "at": time.Now().Unix()}
+		if _, err := dbQuery[d](ctx, db, q, d{"v": m.version, "entry": entry}); err != nil {
+			return from, cur, err
+		}
+		cur = m.version
+	}
+
+	return from, cur, nil
+}
+
+/*
+ * Migrations
+ */
+
+// Collections every tenant had from the start. Templates are created on demand.
+func migrateBase(ctx context.Context, db dbase) error {
+	for _, c := range []string{"Items", "Shops", "ShoppingLists"} {
+		if err := db.colEnsure(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateIndexes(ctx context.Context, db dbase) error {
+	for _, ix := range []struct {
+		col    string
+		fields []string
+	}{
+		{"Items", []string{"name"}},
+		{"Shops", []string{"name"}},
+		{"ShoppingLists", []string{"hidden"}},
+	} {
+		if err := db.indexEnsure(ctx, ix.col, ix.fields, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// JSON schema rules matching ItemNew and ShopNew. "moderate", so documents that were
+// already invalid can still be changed, but nothing new may be invalid. ArangoDB
+// validates against JSON Schema draft 4, where exclusiveMinimum is a flag on minimum.
+func migrateSchema(ctx context.Context, db dbase) error {
+	str := d{"type": "string"}
+	name := d{"type": "string", "minLength": 1}
+
+	rules := map[string]d{
+		"Items": {
+			"type": "object",
+			"properties": d{
+				"name":      name,
+				"nett":      d{"type": "number", "minimum": 0, "exclusiveMinimum": true},
+				"nett_unit": name,
+				"brand":     str,
+			},
+			"required": []string{"name", "nett", "nett_unit", "brand"},
+		},
+		"Shops": {
+			"type": "object",
+			"properties": d{
+				"name":    name,
+				"branch":  str,
+				"city":    str,
+				"country": str,
+			},
+			"required": []string{"name", "branch", "city", "country"},
+		},
+	}
+
+	dbx, err := aranDB(ctx, db.db)
+	if err != nil {
+		return err
+	}
+
+	for c, rule := range rules {
+		col, err := dbx.Collection(ctx, c)
+		if err != nil {
+			return storeErr("get collection "+c, err)
+		}
+
+		err = col.SetProperties(ctx, driver.SetCollectionPropertiesOptions{
+			Schema: &driver.CollectionSchemaOptions{
+				Rule:    rule,
+				Level:   driver.CollectionSchemaLevelModerate,
+				Message: c + " document does not match the schema",
+			},
+		})
+		if err != nil {
+			return storeErr("set schema on "+c, err)
+		}
+	}
+
+	return nil
+}
+
+// Old lists may lack hidden, which hides them from /allvisible, or label
+func migrateListDefaults(ctx context.Context, db dbase) error {
+	for _, q := range []string{
+		"FOR l IN ShoppingLists FILTER l.hidden == null UPDATE l WITH {hidden: false} IN ShoppingLists",
+		"FOR l IN ShoppingLists FILTER l.label == null UPDATE l WITH {label: ''} IN ShoppingLists",
+	} {
+		if _, err := dbQuery[d](ctx, db, q, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Exchange rates for list totals, see totals.go. Filled in by the user.
+func migrateRates(ctx context.Context, db dbase) error {
+	return db.colEnsure(ctx, "Rates")
+}
+
+// Entries used to live in an edge collection per list and template, named after it
+// (ShoppingListX, TemplateX). They move to ListEntries, each carrying the document id
+// of its list.
+func migrateListEntries(ctx context.Context, db dbase) error {
+	if err := db.edgeEnsure(ctx, "ListEntries"); err != nil {
+		return err
+	}
+
+	//Lookups are always within one list, by shop (trolley, shop delete) or item (trend)
+	for _, f := range [][]string{{"list", "_from"}, {"list", "_to"}} {
+		if err := db.indexEnsure(ctx, "ListEntries", f, false); err != nil {
+			return err
+		}
+	}
+
+	dbx, err := aranDB(ctx, db.db)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range []string{"ShoppingLists", "Templates"} {
+		ok, err := dbx.CollectionExists(ctx, c)
+		if err != nil {
+			return storeErr("check collection "+c, err)
+		}
+		if !ok {
+			continue //Templates were never enabled
+		}
+
+		lists, err := dbQuery[struct {
+			Id   string `json:"_id"`
+			Name string `json:"name"`
+		}](ctx, db, "FOR l IN @@c RETURN {_id: l._id, name: l.name}", d{"@c": c})
+		if err != nil {
+			return err
+		}
+
+		for _, l := range lists {
+			if err := db.moveEntries(ctx, l.Id, l.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Copy edge collection src into ListEntries as the entries of list, then drop src. The
+// copy is one transaction, so a rerun finds src either untouched or fully copied, and
+// only has to drop it. Keys are kept unless another list's entry already has them.
+func (db dbase) moveEntries(ctx context.Context, list, src string) error {
+	dbx, err := aranDB(ctx, db.db)
+	if err != nil {
+		return err
+	}
+
+	if ok, err := dbx.CollectionExists(ctx, src); err != nil {
+		return storeErr("check collection "+src, err)
+	} else if !ok {
+		return nil //Already moved
+	}
+
+	bind := d{"@src": src, "list": list}
+	cnt, err := dbQuery[[]int](ctx, db, "RETURN [LENGTH(@@src), LENGTH(FOR e IN ListEntries FILTER e.list == @list RETURN 1)]", bind)
+	if err != nil {
+		return err
+	}
+
+	switch want, have := cnt[0][0], cnt[0][1]; {
+	case have == 0 && want > 0:
+		err := db.inTx(ctx, []string{"ListEntries", src}, func(ctx context.Context) error {
+			taken, err := dbQuery[string](ctx, db, "FOR e IN @@src FILTER DOCUMENT('ListEntries', e._key) != null RETURN e._key", d{"@src": src})
+			if err != nil {
+				return err
+			}
+
+			q := "FOR e IN @@src INSERT MERGE(UNSET(e, '_id', '_rev', '_key'), {list: @list}, e._key IN @taken ? {} : {_key: e._key}) INTO ListEntries"
+			_, err = dbQuery[d](ctx, db, q, d{"@src": src, "list": list, "taken": taken})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	case have < want:
+		//Entries were added to the list some other way, so src can't be told apart from them
+		return conflict(fmt.Sprintf("move %s: %s already has %d of its %d entries", src, list, have, want))
+	}
+
+	col, err := dbx.Collection(ctx, src)
+	if err != nil {
+		return storeErr("get collection "+src, err)
+	}
+
+	if err := col.Remove(ctx); err != nil {
+		return storeErr("remove collection "+src, err)
+	}
+
+	return nil
+}
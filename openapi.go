@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * OPENAPI
+ * The spec served at /openapi.json is built from the registered echo routes, with the
+ * entry for each route in routeDocs below. Request and response schemas are generated
+ * from the Go types handlers bind and return, so they follow struct changes.
+ * A route without an entry, or an entry without a route, fails TestRoutesDocumented
+ * (see checkRoutes), so the spec can't silently drift from the route table.
+ */
+type routeDoc struct {
+	summary string
+	body    interface{} //Request body, nil if none
+	resp    interface{} //Success response body, nil for no content
+	status  int         //Success status, 200 if 0
+	query   []string    //Query parameters
+	public  bool        //No token or API key needed
+}
+
+// Response shapes handlers build as d{}
+type (
+	DeleteResult struct {
+		Id    string `json:"id"`
+		Mode  string `json:"mode"`
+		Edges int    `json:"edges"` //List and template entries affected
+		To    string `json:"to,omitempty"`
+	}
+	ListDoc struct {
+		Key    string  `json:"_key"`
+		Id     string  `json:"_id"`
+		Name   string  `json:"name"`
+		Hidden bool    `json:"hidden"`
+		Date   float64 `json:"date"`
+	}
+	ListLabel struct {
+		Label string `json:"label"`
+	}
+	Health struct {
+		Healthy bool      `json:"healthy"`
+		Checked time.Time `json:"checked,omitempty"`
+		Error   string    `json:"error,omitempty"`
+	}
+	CacheInvalidated struct {
+		Invalidated int `json:"invalidated"`
+	}
+	UserCreated struct {
+		Email   string `json:"email"`
+		Db      string `json:"db"`
+		Created bool   `json:"created"`
+	}
+	RoleChanged struct {
+		Email string `json:"email"`
+		From  string `json:"from"`
+		Role  string `json:"role"`
+	}
+	UserDeleted struct {
+		Email    string `json:"email"`
+		Db       string `json:"db"`
+		Archive  string `json:"archive,omitempty"`
+		Sessions int    `json:"sessions"`
+	}
+	SchemaStatus struct {
+		Latest  int `json:"latest"`
+		Tenants []struct {
+			Db      string `json:"db"`
+			Version int    `json:"version"`
+			Error   string `json:"error,omitempty"`
+		} `json:"tenants"`
+	}
+	KeyCreated struct {
+		Key     string `json:"key"` //Shown only once
+		Details ApiKey `json:"details"`
+	}
+)
+
+// Query parameters of trendGetHistory
+var priceQuery = []string{"from", "to", "shop", "currency", "group", "limit", "offset"}
+
+// Keyed by "METHOD path" as registered with echo
+var routeDocs = map[string]routeDoc{
+	"GET /openapi.json": {summary: "This document", resp: map[string]interface{}{}, public: true},
+
+	"GET /items/view/:id":     {summary: "Get an item", resp: Item{}},
+	"GET /items/all":          {summary: "All items", resp: []Item{}},
+	"GET /items/like/:part":   {summary: "Items with part in their name", resp: []Item{}},
+	"POST /items/new":         {summary: "Create an item, returns its key", body: ItemNew{}, resp: ""},
+	"PATCH /items/update/:id": {summary: "Replace an item", body: ItemNew{}, resp: ""},
+	"DELETE /items/delete/:id": {summary: "Delete an item. mode: restrict (default), cascade or soft",
+		resp: DeleteResult{}, query: []string{"mode"}},
+
+	"GET /shops/view/:id":     {summary: "Get a shop", resp: Shop{}},
+	"GET /shops/all":          {summary: "All shops", resp: []Shop{}},
+	"GET /shops/like/:part":   {summary: "Shops with part in their name", resp: []Shop{}},
+	"POST /shops/new":         {summary: "Create a shop", body: ShopNew{}, resp: ""},
+	"PATCH /shops/update/:id": {summary: "Replace a shop", body: ShopNew{}, resp: ""},
+	"DELETE /shops/delete/:id": {summary: "Delete a shop. mode: restrict (default), cascade or reassign with to",
+		resp: DeleteResult{}, query: []string{"mode", "to"}},
+
+	"GET /shoppinglist/allvisible":       {summary: "Shopping lists that aren't hidden", resp: []ShopListsAll{}},
+	"GET /shoppinglist/all":              {summary: "All shopping lists", resp: []ShopListsAll{}},
+	"GET /shoppinglist/view/:id":         {summary: "Entries of a shopping list, by shop", resp: []SList{}},
+	"GET /shoppinglist/trolley/:id/:key": {summary: "Entries in the trolley for shop key", resp: []SListItems{}},
+	"GET /shoppinglist/totals/:id": {summary: "Totals of a shopping list per shop, overall and in the trolley, per currency. in: currency to convert to",
+		resp: ListTotals{}, query: []string{"in"}},
+	"GET /shoppinglist/name/:id":                {summary: "Label of a shopping list", resp: []ListLabel{}},
+	"POST /shoppinglist/new":                    {summary: "Create a shopping list", resp: []ListDoc{}},
+	"POST /shoppinglist/make/:id":               {summary: "Create a shopping list from template id", resp: ""},
+	"PATCH /shoppinglist/hide/:id":              {summary: "Update a shopping list, e.g. hidden", body: ShopListsAll{}, resp: ""},
+	"PATCH /shoppinglist/edit/:id":              {summary: "Update a shopping list, label required", body: ShopListsAll{}, resp: ""},
+	"PATCH /shoppinglist/trolley/:id/:key":      {summary: "Update entry key", body: SlistEdgeItem{}, resp: ""},
+	"PATCH /shoppinglist/additem/:id":           {summary: "Add an entry, returns its key", body: SlistEdge{}, resp: ""},
+	"PATCH /shoppinglist/moveitem/:id/:key":     {summary: "Replace entry key, returns the new key", body: SlistEdge{}, resp: ""},
+	"DELETE /shoppinglist/delete/item/:id/:key": {summary: "Remove entry key", resp: ""},
+
+	"GET /shoppinglist/templates":                     {summary: "All templates", resp: []ShopListsAll{}},
+	"GET /shoppinglist/templates/details/:id":         {summary: "Entries of a template, by shop", resp: []Tpl{}},
+	"GET /shoppinglist/templates/name/:id":            {summary: "Label of a template", resp: []ListLabel{}},
+	"POST /shoppinglist/templates":                    {summary: "Create a template", resp: []ListDoc{}},
+	"POST /shoppinglist/templates/:id":                {summary: "Create a template from shopping list id", resp: ""},
+	"POST /shoppinglist/templates/enable":             {summary: "Enable templates for the user", resp: ""},
+	"PATCH /shoppinglist/templates/:id":               {summary: "Update a template, label required", body: ShopListsAll{}, resp: ""},
+	"PATCH /shoppinglist/templates/details/:id":       {summary: "Add a template entry, returns its key", body: TplEdge{}, resp: ""},
+	"PATCH /shoppinglist/templates/moveitem/:id/:key": {summary: "Replace template entry key, returns the new key", body: TplEdge{}, resp: ""},
+	"PATCH /shoppinglist/templates/details/:id/:key":  {summary: "Update template entry key", body: TplEdgeItem{}, resp: ""},
+	"DELETE /shoppinglist/templates/details/:id/:key": {summary: "Remove template entry key", resp: ""},
+	"DELETE /shoppinglist/templates/:id":              {summary: "Delete a template", resp: ""},
+
+	"GET /trend/item/:id": {summary: "Latest 10 prices of an item, newest first", resp: []ItemTrend{}},
+	"GET /trend/item/:id/history": {summary: "Price history of an item with stats per currency. from/to: YYYY-MM-DD, group: shop",
+		resp: PriceHistory{}, query: priceQuery},
+	"GET /compare/item/:id": {summary: "Latest and average price of an item per shop and currency, per unit too, cheapest flagged", resp: ItemCompare{}},
+
+	"GET /rates":              {summary: "Exchange rates used to convert list totals", resp: []Rate{}},
+	"PUT /rates/:from/:to":    {summary: "Set how much 1 from is in to", body: RateNew{}, resp: Rate{}},
+	"DELETE /rates/:from/:to": {summary: "Remove an exchange rate", status: http.StatusNoContent},
+
+	"GET /keys":        {summary: "The caller's API keys", resp: []ApiKey{}},
+	"POST /keys":       {summary: "Mint an API key. Not allowed with an API key.", body: ApiKeyNew{}, resp: KeyCreated{}, status: http.StatusCreated},
+	"DELETE /keys/:id": {summary: "Revoke an API key", resp: ""},
+
+	"GET /admin/maybe":               {summary: "Role of the caller", resp: ""},
+	"GET /admin/health":              {summary: "Database health, 503 when unhealthy", resp: Health{}},
+	"GET /admin/cache":               {summary: "User cache statistics", resp: cacheStats{}},
+	"DELETE /admin/cache":            {summary: "Clear the user cache", resp: ""},
+	"DELETE /admin/cache/:email":     {summary: "Drop a user from the cache", resp: CacheInvalidated{}},
+	"GET /admin/users":               {summary: "All users", resp: []UserNew{}},
+	"POST /admin/users":              {summary: "Create a user, with the user role. 200 if they already existed.", body: UserNew{}, resp: UserCreated{}, status: http.StatusCreated},
+	"DELETE /admin/users/:email":     {summary: "Delete a user and their database", resp: UserDeleted{}, query: []string{"export"}},
+	"PATCH /admin/users/:email/role": {summary: "Change a user's role", body: UserNew{}, resp: RoleChanged{}},
+	"GET /admin/audit":               {summary: "Latest audit entries", resp: []AuditEntry{}, query: []string{"limit"}},
+	"GET /admin/schema":              {summary: "Schema version of every tenant", resp: SchemaStatus{}},
+	"POST /admin/schema/migrate":     {summary: "Run pending migrations, for every tenant or db", resp: []migrateResult{}, query: []string{"db"}},
+
+	"GET /v2/items":                             {summary: "Items, optionally matching q", resp: []Item{}, query: []string{"q"}},
+	"POST /v2/items":                            {summary: "Create an item", body: ItemNew{}, resp: Item{}, status: http.StatusCreated},
+	"GET /v2/items/:id":                         {summary: "Get an item", resp: Item{}},
+	"PATCH /v2/items/:id":                       {summary: "Update an item", body: ItemNew{}, resp: Item{}},
+	"DELETE /v2/items/:id":                      {summary: "Delete an item. mode: restrict (default), cascade or soft", resp: DeleteResult{}, query: []string{"mode"}},
+	"GET /v2/items/:id/trend":                   {summary: "Latest 10 prices of an item, newest first", resp: []ItemTrend{}},
+	"GET /v2/items/:id/prices":                  {summary: "Price history of an item, as /trend/item/:id/history", resp: PriceHistory{}, query: priceQuery},
+	"GET /v2/items/:id/compare":                 {summary: "Latest and average price of an item per shop, as /compare/item/:id", resp: ItemCompare{}},
+	"GET /v2/shops":                             {summary: "Shops, optionally matching q", resp: []Shop{}, query: []string{"q"}},
+	"POST /v2/shops":                            {summary: "Create a shop", body: ShopNew{}, resp: Shop{}, status: http.StatusCreated},
+	"GET /v2/shops/:id":                         {summary: "Get a shop", resp: Shop{}},
+	"PATCH /v2/shops/:id":                       {summary: "Update a shop", body: ShopNew{}, resp: Shop{}},
+	"DELETE /v2/shops/:id":                      {summary: "Delete a shop. mode: restrict (default), cascade or reassign with to", resp: DeleteResult{}, query: []string{"mode", "to"}},
+	"GET /v2/lists":                             {summary: "Shopping lists", resp: []ShopListsAll{}, query: []string{"visible"}},
+	"POST /v2/lists":                            {summary: "Create a shopping list, optionally from a template", body: ListNew{}, resp: ShopListsAll{}, status: http.StatusCreated},
+	"GET /v2/lists/:id":                         {summary: "Get a shopping list", resp: ShopListsAll{}},
+	"GET /v2/lists/:id/totals":                  {summary: "Totals of a shopping list, as /shoppinglist/totals/:id", resp: ListTotals{}, query: []string{"in"}},
+	"PATCH /v2/lists/:id":                       {summary: "Update a shopping list", body: ShopListsAll{}, resp: ShopListsAll{}},
+	"GET /v2/lists/:id/entries":                 {summary: "Entries of a shopping list", resp: []SListItems{}, query: []string{"shop", "trolley"}},
+	"POST /v2/lists/:id/entries":                {summary: "Add an entry", body: SlistEdge{}, resp: SListItems{}, status: http.StatusCreated},
+	"GET /v2/lists/:id/entries/:entryId":        {summary: "Get an entry", resp: SListItems{}},
+	"PATCH /v2/lists/:id/entries/:entryId":      {summary: "Update an entry", body: SlistEdgeItem{}, resp: SListItems{}},
+	"PUT /v2/lists/:id/entries/:entryId":        {summary: "Replace an entry, giving it a new id", body: SlistEdge{}, resp: SListItems{}},
+	"DELETE /v2/lists/:id/entries/:entryId":     {summary: "Remove an entry", status: http.StatusNoContent},
+	"GET /v2/templates":                         {summary: "Templates", resp: []ShopListsAll{}},
+	"POST /v2/templates":                        {summary: "Create a template, optionally from a list", body: TemplateNew{}, resp: ShopListsAll{}, status: http.StatusCreated},
+	"GET /v2/templates/:id":                     {summary: "Get a template", resp: ShopListsAll{}},
+	"PATCH /v2/templates/:id":                   {summary: "Update a template", body: ShopListsAll{}, resp: ShopListsAll{}},
+	"DELETE /v2/templates/:id":                  {summary: "Delete a template", status: http.StatusNoContent},
+	"GET /v2/templates/:id/entries":             {summary: "Entries of a template", resp: []TplItem{}},
+	"POST /v2/templates/:id/entries":            {summary: "Add a template entry", body: TplEdge{}, resp: TplItem{}, status: http.StatusCreated},
+	"GET /v2/templates/:id/entries/:entryId":    {summary: "Get a template entry", resp: TplItem{}},
+	"PATCH /v2/templates/:id/entries/:entryId":  {summary: "Update a template entry", body: TplEdgeItem{}, resp: TplItem{}},
+	"PUT /v2/templates/:id/entries/:entryId":    {summary: "Replace a template entry, giving it a new id", body: TplEdge{}, resp: TplItem{}},
+	"DELETE /v2/templates/:id/entries/:entryId": {summary: "Remove a template entry", status: http.StatusNoContent},
+	"GET /v2/rates":                             {summary: "Exchange rates used to convert list totals", resp: []Rate{}},
+	"PUT /v2/rates/:from/:to":                   {summary: "Set how much 1 from is in to", body: RateNew{}, resp: Rate{}},
+	"DELETE /v2/rates/:from/:to":                {summary: "Remove an exchange rate", status: http.StatusNoContent},
+	"GET /v2/keys":                              {summary: "The caller's API keys", resp: []ApiKey{}},
+	"POST /v2/keys":                             {summary: "Mint an API key. Not allowed with an API key.", body: ApiKeyNew{}, resp: KeyCreated{}, status: http.StatusCreated},
+	"DELETE /v2/keys/:id":                       {summary: "Revoke an API key", resp: ""},
+}
+
+// Routes that bypass middleJWT
+func publicRoute(path string) bool {
+	return path == "/openapi.json"
+}
+
+// "METHOD path" of every registered route, without echo's not-found catch-alls
+func routeKeys(routes []*echo.Route) []string {
+	var out []string
+	for _, r := range routes {
+		if r.Method == echo.RouteNotFound {
+			continue
+		}
+		out = append(out, r.Method+" "+r.Path)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// Compare the registered routes with routeDocs
+func checkRoutes(routes []*echo.Route) error {
+	var missing, stale []string
+
+	seen := make(map[string]bool)
+	for _, k := range routeKeys(routes) {
+		seen[k] = true
+		if _, ok := routeDocs[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	for k := range routeDocs {
+		if !seen[k] {
+			stale = append(stale, k)
+		}
+	}
+	sort.Strings(stale)
+
+	if missing == nil && stale == nil {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("openapi: route table and routeDocs differ")
+	for _, k := range missing {
+		b.WriteString("\n\tundocumented route: " + k)
+	}
+	for _, k := range stale {
+		b.WriteString("\n\tno such route: " + k)
+	}
+
+	return fmt.Errorf("%s", b.String())
+}
+
+// Build the spec. Call once all routes are registered.
+func openAPISpec(routes []*echo.Route) d {
+	sg := &schemaGen{defs: d{}}
+	paths := d{}
+
+	for _, k := range routeKeys(routes) {
+		method, path, _ := strings.Cut(k, " ")
+		rd := routeDocs[k]
+
+		op := d{"summary": rd.summary, "operationId": strings.ToLower(method) + opName(path)}
+
+		//Path parameters are all strings, e.g. :id becomes {id}
+		var params []d
+		segs := strings.Split(path, "/")
+		for i, s := range segs {
+			if p, ok := strings.CutPrefix(s, ":"); ok {
+				segs[i] = "{" + p + "}"
+				params = append(params, d{"name": p, "in": "path", "required": true, "schema": d{"type": "string"}})
+			}
+		}
+		for _, q := range rd.query {
+			params = append(params, d{"name": q, "in": "query", "schema": d{"type": "string"}})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if rd.body != nil {
+			bs := sg.schema(reflect.TypeOf(rd.body))
+			if method == http.MethodPatch {
+				bs = sg.partial(reflect.TypeOf(rd.body))
+			}
+			op["requestBody"] = d{
+				"required": true,
+				"content":  d{"application/json": d{"schema": bs}},
+			}
+		}
+
+		status := rd.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		res := d{"description": http.StatusText(status)}
+		if rd.resp != nil {
+			res["content"] = d{"application/json": d{"schema": sg.schema(reflect.TypeOf(rd.resp))}}
+		}
+		op["responses"] = d{fmt.Sprint(status): res, "default": d{"$ref": "#/components/responses/Error"}}
+
+		if rd.public {
+			op["security"] = []d{}
+		}
+
+		p := strings.Join(segs, "/")
+		if paths[p] == nil {
+			paths[p] = d{}
+		}
+		paths[p].(d)[strings.ToLower(method)] = op
+	}
+
+	errSchema := sg.schema(reflect.TypeOf(apiError{}))
+	sg.schema(reflect.TypeOf(validationError{}))
+
+	return d{
+		"openapi": "3.0.3",
+		"info": d{
+			"title":       "ShopApp API",
+			"version":     "2",
+			"description": "Errors share one shape (apiError). On 422 its details hold a validationError.",
+		},
+		"paths": paths,
+		"components": d{
+			"schemas": sg.defs,
+			"responses": d{
+				"Error": d{
+					"description": "Error",
+					"content":     d{"application/json": d{"schema": errSchema}},
+				},
+			},
+			"securitySchemes": d{
+				"bearer": d{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey": d{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+		"security": []d{{"bearer": []string{}}, {"apiKey": []string{}}},
+	}
+}
+
+// e.g. /v2/lists/:id/entries becomes V2ListsIdEntries
+func opName(path string) string {
+	var b strings.Builder
+	for _, s := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == ':' || r == '.' }) {
+		b.WriteString(strings.ToUpper(s[:1]) + s[1:])
+	}
+
+	return b.String()
+}
+
+// Derives JSON schemas from Go types. Named structs go to defs and are referenced.
+type schemaGen struct {
+	defs d
+}
+
+func (sg *schemaGen) schema(t reflect.Type) d {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return d{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return d{"type": "string"}
+	case reflect.Bool:
+		return d{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return d{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return d{"type": "integer", "format": "int64"}
+	case reflect.Float32:
+		return d{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return d{"type": "number", "format": "double"}
+	case reflect.Slice, reflect.Array:
+		s := d{"type": "array", "items": sg.schema(t.Elem())}
+		if t.Name() != "" {
+			return sg.define(t.Name(), s)
+		}
+		return s
+	case reflect.Map:
+		return d{"type": "object", "additionalProperties": sg.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sg.object(t)
+		}
+		if _, ok := sg.defs[t.Name()]; !ok {
+			sg.defs[t.Name()] = d{} //Placeholder, in case the type refers to itself
+			sg.defs[t.Name()] = sg.object(t)
+		}
+		return d{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	//interface{}: anything
+	return d{}
+}
+
+func (sg *schemaGen) define(name string, s d) d {
+	sg.defs[name] = s
+	return d{"$ref": "#/components/schemas/" + name}
+}
+
+// Properties from exported fields and their json tags
+func (sg *schemaGen) object(t reflect.Type) d {
+	props := d{}
+	var req []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		props[name] = sg.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			req = append(req, name)
+		}
+	}
+
+	s := d{"type": "object", "properties": props}
+	if req != nil {
+		s["required"] = req
+	}
+
+	return s
+}
+
+// As object, with no field required. PATCH bodies only hold the fields to change.
+func (sg *schemaGen) partial(t reflect.Type) d {
+	s := sg.object(t)
+	delete(s, "required")
+
+	return s
+}
+
+// Built in main() once the routes are registered
+var apiSpec d
+
+// GET /openapi.json
+func openAPIHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, apiSpec)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * SCOPES
+ * Each route names the scope it needs, e.g. r1.GET("/all", itemGetAll, needScope(scopeReadItems)).
+ * Scopes come from the token (see CtxVerify) and are checked after middleJWT.
+ * Read and write are separate, so a dashboard can be given read:* scopes only.
+ */
+const (
+	scopeReadItems   = "read:items"
+	scopeWriteItems  = "write:items"
+	scopeReadShops   = "read:shops"
+	scopeWriteShops  = "write:shops"
+	scopeReadLists   = "read:lists" //Shopping lists, templates and trends
+	scopeWriteLists  = "write:lists"
+	scopeReadKeys    = "read:keys" //The user's own API keys
+	scopeWriteKeys   = "write:keys"
+	scopeAdminUsers  = "admin:users"
+	scopeAdminSystem = "admin:system" //Health and cache
+)
+
+// Scopes of the token, from either claim form
+func (c Claims) scopes() []string {
+	return append(strings.Fields(c.Scope), c.Scp...)
+}
+
+// Scopes granted to the request, as set by middleJWT
+func ctxScopes(c echo.Context) []string {
+	ver, ok := c.Request().Context().Value("verify").(CtxVerify)
+	if !ok {
+		return nil
+	}
+
+	return ver.Scopes
+}
+
+func hasScope(granted []string, s string) bool {
+	for _, g := range granted {
+		if g == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Route middleware requiring every scope in need
+func needScope(need ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			granted := ctxScopes(c)
+
+			for _, s := range need {
+				if !hasScope(granted, s) {
+					return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("missing scope %s", s))
+				}
+			}
+
+			return next(c) //Proceed to next.
+		}
+	}
+}
+
+// As needScope, for /admin routes: the user's stored role must be admin as well, so
+// demoting a user takes effect whatever scopes their tokens carry. Role is set by middleAdmin.
+func needAdmin(need ...string) echo.MiddlewareFunc {
+	scoped := needScope(need...)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		check := scoped(next)
+
+		return func(c echo.Context) error {
+			if ctxRole(c) != roleAdmin {
+				return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+			}
+
+			return check(c)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Request to path on e as a token for email with scopes, past middleJWT
+func callAs(e *echo.Echo, method, path, email string, scopes ...string) int {
+	ver := CtxVerify{Sub: "local-dev|" + email, Iss: "local-dev", Scopes: scopes, Email: email}
+
+	req := httptest.NewRequest(method, path, nil)
+	req = req.WithContext(context.WithValue(req.Context(), "verify", ver))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec.Code
+}
+
+// Every /admin route but /admin/maybe needs both the admin role and its scope
+func TestAdminRoutesNeedRoleAndScope(t *testing.T) {
+	m := newMemStore()
+	store = m
+	cache = newUserCache(time.Minute, 10)
+	if _, err := m.addUser("admin@x.io", roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.addUser("user@x.io", roleUser); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = httpError
+	routes(e)
+
+	all := []string{scopeAdminUsers, scopeAdminSystem}
+	n := 0
+	for _, r := range e.Routes() {
+		if !strings.HasPrefix(r.Path, "/admin/") || r.Path == "/admin/maybe" || r.Method == echo.RouteNotFound {
+			continue
+		}
+		n++
+		path := strings.NewReplacer(":email", "nobody@x.io").Replace(r.Path)
+
+		if code := callAs(e, r.Method, path, "user@x.io", all...); code != http.StatusForbidden {
+			t.Errorf("%s %s as a user with admin scopes = %d, want 403", r.Method, path, code)
+		}
+		if code := callAs(e, r.Method, path, "admin@x.io"); code != http.StatusForbidden {
+			t.Errorf("%s %s as an admin without scopes = %d, want 403", r.Method, path, code)
+		}
+		if code := callAs(e, r.Method, path, "admin@x.io", all...); code == http.StatusForbidden || code == http.StatusUnauthorized {
+			t.Errorf("%s %s as an admin with admin scopes = %d", r.Method, path, code)
+		}
+	}
+	if n == 0 {
+		t.Fatal("no /admin routes")
+	}
+
+	//Still open to any user, to ask whether they are an admin
+	if code := callAs(e, http.MethodGet, "/admin/maybe", "user@x.io"); code != http.StatusOK {
+		t.Errorf("GET /admin/maybe as a user = %d, want 200", code)
+	}
+}
+
+func TestNeedScope(t *testing.T) {
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }
+
+	tests := []struct {
+		granted []string
+		need    []string
+		allowed bool
+	}{
+		{[]string{scopeReadItems}, []string{scopeReadItems}, true},
+		{[]string{scopeReadItems, scopeWriteItems}, []string{scopeReadItems, scopeWriteItems}, true},
+		{[]string{scopeReadItems}, []string{scopeWriteItems}, false},
+		{[]string{scopeReadItems}, []string{scopeReadItems, scopeWriteItems}, false},
+		{nil, []string{scopeReadItems}, false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "verify", CtxVerify{Scopes: tt.granted}))
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+
+		err := needScope(tt.need...)(ok)(c)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("needScope(%v) with %v: error = %v, want allowed %v", tt.need, tt.granted, err, tt.allowed)
+		}
+	}
+}
@@ -1,29 +1,22 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"sort"
-	"strings"
 	"time"
 
 	"net/http"
+	"net/mail"
 	"os"
-	_ "strconv"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-/*ARANGODB SECTION*/
-/* Sensitive/custom settings */
-//Arangodb Host
-var ah, ahok = os.LookupEnv("ADB_HOST")
-var ap, _ = os.LookupEnv("ADB_PASS")
-
-// Connection test
-var ct bool = false
-
 // Local cache of users, db and jwt sub
 type user struct {
 	email string
@@ -31,23 +24,18 @@ type user struct {
 	role  string
 }
 
-type Cache map[string]user
+// ["iss|sub"]{user struct}, set up in main(). See cache.go
+var cache *userCache
 
-// Initiate "cache" - if this ever gets BIG, then rather use redis or even just go-cache
-// ["sub"]{user struct}
-var cache = make(Cache)
+/* end */
 
-// Simple db type for methods
-type dbase struct {
-	db string
+// Role of the requesting user, as set by middleAdmin
+func ctxRole(c echo.Context) string {
+	return fmt.Sprintf("%v", c.Request().Context().Value("role"))
 }
 
-/* end */
-
 func adminMaybe(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	cta := fmt.Sprintf("%v", c.Request().Context().Value("sub"))
-	r := cache[cta].role
+	r := ctxRole(c)
 
 	if r == "admin" {
 		return c.JSON(http.StatusOK, "admin")
@@ -56,162 +44,111 @@ func adminMaybe(c echo.Context) error {
 	}
 }
 
-/* #############
- * GET Functions
- * #############
- */
-
-// Common function to run getQueries
-// q is the query
-// b1 is the @bind, b2 is the value
-func (db dbase) getQueries(q, b1, b2 string) ([]d, error) {
-
-	//Some queries have no bind. In that case, create as blank, or nil. If present, assign bind
-	var bind d
-	if b1 != "" {
-		bind = d{b1: b2}
-	}
-
-	dbx, ctx := aranDB(ah, db.db)
-
-	var execQ []d
-
-	if ct {
-		data := aranQuery{q, bind, dbx, ctx}
-		execQ = data.aranQ()
-	} else {
-		fmt.Println("Failed to connect. Troubleshoot connection to ", ah)
-		var err = errors.New("failed to connect to db")
-		return nil, err
-	}
+// Tenant db of the request, as set by middleUser
+func ctxDB(c echo.Context) string {
+	//Get db from context, convert from interface to string
+	return fmt.Sprintf("%v", c.Request().Context().Value("db"))
+}
 
-	return execQ, nil
+// Plain address only, e.g. "a@b.com" but not "A <a@b.com>"
+func validEmail(e string) bool {
+	a, err := mail.ParseAddress(e)
+	return err == nil && a.Address == e
 }
 
-func (db dbase) getShoppingList(id string) (string, error) {
+// Email of the request's user, as set by middleUser
+func ctxEmail(c echo.Context) string {
+	return fmt.Sprintf("%v", c.Request().Context().Value("email"))
+}
 
-	//DB query - get ShoppingList name
-	query := "FOR a in ShoppingLists FILTER a._key == @id RETURN {'edge': a.name}"
+// Shape of a freshly inserted ShoppingLists/Templates document, as returned by "RETURN NEW"
+func newDoc(col string, l ShopListsAll) []d {
+	return []d{{"_key": l.Id, "_id": col + "/" + l.Id, "name": l.Name, "hidden": l.Hidden, "date": l.Date}}
+}
 
-	slistQ, err := db.getQueries(query, "id", id)
+// Health of the storage backend
+func adminHealth(c echo.Context) error {
+	//The in-memory store has no connection to track
+	if pool == nil {
+		return c.JSON(http.StatusOK, d{"healthy": true})
+	}
 
-	//Catch error from the query
+	ok, at, err := pool.health()
+	out := d{"healthy": ok, "checked": at}
 	if err != nil {
-		return "", err
+		out["error"] = err.Error()
 	}
 
-	if slistQ == nil {
-		return "", errors.New("no such id")
+	if !ok {
+		return c.JSON(http.StatusServiceUnavailable, out)
 	}
 
-	//Convert received value from interface to string
-	sl := fmt.Sprint(slistQ[0]["edge"])
-
-	return sl, nil
-
+	return c.JSON(http.StatusOK, out)
 }
 
-func (db dbase) getTemplate(id string) (string, error) {
-
-	//DB query - get ShoppingList name
-	query := "FOR a in Templates FILTER a._key == @id RETURN {'edge': a.name}"
-
-	slistQ, err := db.getQueries(query, "id", id)
+// User cache metrics
+func adminCacheStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, cache.stats())
+}
 
-	//Catch error from the query
-	if err != nil {
-		return "", err
+// Drop cached user(s): all of them, or only those of :email
+func adminCacheInvalidate(c echo.Context) error {
+	if eml := c.Param("email"); eml != "" {
+		n := cache.invalidateEmail(eml)
+		return c.JSON(http.StatusOK, d{"invalidated": n})
 	}
 
-	//Convert received value from interface to string
-	sl := fmt.Sprint(slistQ[0]["edge"])
-
-	return sl, nil
-
+	cache.purge()
+	return c.JSON(http.StatusOK, "cache cleared")
 }
 
-func itemGetSpecific(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
+/* #############
+ * GET Functions
+ * #############
+ */
 
+func itemGetSpecific(c echo.Context) error {
 	//Get item id
 	id := c.Param("id")
-	id = "Items/" + id
 
-	//DB query
-	query := "FOR item IN Items FILTER item._id == @itemID RETURN { 'id': item._key, 'name': item.name, 'nett': item.nett, 'nett_unit': item.nett_unit, 'brand': item.brand }"
+	execQ, err := store.ItemGet(c.Request().Context(), ctxDB(c), id)
 
-	//Run query and response
-	execQ, err := db.getQueries(query, "itemID", id)
-
-	//Catch error from the query
+	//Catch error from the query, including a non-existent id
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
-	}
-
-	//Blank data returned indicates request was for a non-existent id
-	if execQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		return err
 	}
 
 	//All good, send 200OK and data
-	return c.JSON(http.StatusOK, execQ[0])
+	return c.JSON(http.StatusOK, execQ)
 
 }
 
 func shopGetSpecific(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get shop id
 	id := c.Param("id")
-	id = "Shops/" + id
-
-	//DB query
-	query := "FOR shop IN Shops FILTER shop._id == @shopID RETURN { 'id': shop._key, 'name': shop.name, 'branch': shop.branch, 'city': shop.city, 'country': shop.country }"
 
-	//Run query and response
-	execQ, err := db.getQueries(query, "shopID", id)
+	execQ, err := store.ShopGet(c.Request().Context(), ctxDB(c), id)
 
-	//Catch error from the query
+	//Catch error from the query, including a non-existent id
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
-	}
-
-	//Blank data returned indicates request was for a non-existent id
-	if execQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		return err
 	}
 
 	//All good, send 200OK and data
-	return c.JSON(http.StatusOK, execQ[0])
+	return c.JSON(http.StatusOK, execQ)
 
 }
 
 func itemGetAll(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//DB query
-	query := "FOR item IN Items RETURN { 'id': item._key, 'name': item.name, 'nett': item.nett, 'nett_unit': item.nett_unit, 'brand': item.brand }"
-	var bind string
-
-	//Run query and response. bind is a null string "" since no binding takes place for the query
-	execQ, err := db.getQueries(query, bind, bind)
+	execQ, err := store.ItemAll(c.Request().Context(), ctxDB(c))
 
 	//Catch error from the query
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if execQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		execQ = []Item{}
 	}
 
 	return c.JSON(http.StatusOK, execQ)
@@ -219,53 +156,30 @@ func itemGetAll(c echo.Context) error {
 }
 
 func shopGetAll(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//DB query
-	query := "FOR shop IN Shops RETURN { 'id': shop._key, 'name': shop.name, 'branch': shop.branch, 'city': shop.city, 'country': shop.country }"
-	var bind string
-
-	//Run query and response. bind is a null string "" since no binding takes place for the query
-	execQ, err := db.getQueries(query, bind, bind)
+	execQ, err := store.ShopAll(c.Request().Context(), ctxDB(c))
 
 	//Catch error from the query
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if execQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		execQ = []Shop{}
 	}
 
 	return c.JSON(http.StatusOK, execQ)
 }
 
-// TODO: LIKE() with caseInsensitive. https://www.arangodb.com/docs/3.9/aql/functions-string.html#like
 func itemGetLike(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
-	find := "%" + c.Param("part") + "%"
-
-	//DB query
-	query := "FOR item IN Items FILTER item.name LIKE @find RETURN { 'id': item._key, 'name': item.name, 'nett': item.nett, 'nett_unit': item.nett_unit, 'brand': item.brand }"
-
-	//Run query and response
-	execQ, err := db.getQueries(query, "find", find)
+	execQ, err := store.ItemLike(c.Request().Context(), ctxDB(c), c.Param("part"))
 
 	//Catch error from the query
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if execQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		execQ = []Item{}
 	}
 
 	return c.JSON(http.StatusOK, execQ)
@@ -273,326 +187,152 @@ func itemGetLike(c echo.Context) error {
 }
 
 func shopGetLike(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
-	find := "%" + c.Param("part") + "%"
-
-	//DB query
-	query := "FOR shop IN Shops FILTER shop.name LIKE @find RETURN { 'id': shop._key, 'name': shop.name, 'branch': shop.branch, 'city': shop.city, 'country': shop.country }"
-
-	//Run query and response
-	execQ, err := db.getQueries(query, "find", find)
+	execQ, err := store.ShopLike(c.Request().Context(), ctxDB(c), c.Param("part"))
 
 	//Catch error from the query
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if execQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		execQ = []Shop{}
 	}
 
 	return c.JSON(http.StatusOK, execQ)
 }
 
 func listGetVisible(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//DB query
-	query := "FOR list in ShoppingLists FILTER list.hidden == false RETURN {'name': list.name, 'date': list.date, 'id': list._key, 'label': list.label}"
-	var bind string
-
-	//Run query and response. bind is a null string "" since no binding takes place for the query
-	listQ, err := db.getQueries(query, bind, bind)
+	listQ, err := store.ListAll(c.Request().Context(), ctxDB(c), true)
 
 	//Catch error from the query
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if listQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		listQ = []ShopListsAll{}
 	}
 
 	return c.JSON(http.StatusOK, listQ)
 }
 
-// ShoppingList id - i, database - d,p - query params
-func getNameCore(i, d, p string) ([]d, error) {
-	db := dbase{d}
-
-	var bind string
-	bind2 := i
-	var query string
-
-	//DB query
-	if p == "sl" {
-		query = "FOR sl in ShoppingLists FILTER sl._key == @sl RETURN {'label': sl.label}"
-		bind = "sl"
-	} else if p == "tpl" {
-		query = "FOR tpl in Templates FILTER tpl._key == @tpl RETURN {'label': tpl.label}"
-		bind = "tpl"
-	}
-
-	//Run query and response.
-	listQ, err := db.getQueries(query, bind, bind2)
-
-	return listQ, err
-
-}
-
 func listGetName(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-
-	//Get item id
+	//Get list id
 	id := c.Param("id")
 
-	listQ, err := getNameCore(id, dbv, "sl")
+	l, err := store.ListLabel(c.Request().Context(), ctxDB(c), id)
 
-	//Catch error from the query
+	//Catch error from the query, including a non-existent id
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
-	}
-
-	if listQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		return err
 	}
 
-	return c.JSON(http.StatusOK, listQ)
+	return c.JSON(http.StatusOK, []d{{"label": l}})
 }
 
 func listTemplateName(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-
-	//Get item id
+	//Get template id
 	id := c.Param("id")
 
-	listQ, err := getNameCore(id, dbv, "tpl")
+	l, err := store.TemplateLabel(c.Request().Context(), ctxDB(c), id)
 
-	//Catch error from the query
+	//Catch error from the query, including a non-existent id
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
-	}
-
-	if listQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		return err
 	}
 
-	return c.JSON(http.StatusOK, listQ)
+	return c.JSON(http.StatusOK, []d{{"label": l}})
 }
 
 func listGetAll(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//DB query
-	query := "FOR list in ShoppingLists RETURN {'name': list.name, 'date': list.date, 'hidden': list.hidden, 'id': list._key, 'label': list.label}"
-	var bind string
-
-	//Run query and response. bind is a null string "" since no binding takes place for the query
-	listQ, err := db.getQueries(query, bind, bind)
+	listQ, err := store.ListAll(c.Request().Context(), ctxDB(c), false)
 
 	//Catch error from the query
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if listQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		listQ = []ShopListsAll{}
 	}
 
 	return c.JSON(http.StatusOK, listQ)
 }
 
 func listGetShopping(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-
-	//Get item id
+	//Get list id
 	id := c.Param("id")
 
-	shQ, err := listGetShoppingCore(id, dbv, "full")
+	shQ, err := store.ListView(c.Request().Context(), ctxDB(c), id)
 
 	//Catch errors
 	if err != nil {
-		fmt.Println("ShoppingList error2:", err)
-
-		if err.Error() == "id error" {
-			return c.JSON(http.StatusBadRequest, "invalid id")
-		} else if err.Error() == "server error" {
-			return c.JSON(http.StatusInternalServerError, "server error")
-		}
+		return err
 	}
 
 	if shQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		shQ = []SList{}
 	}
+	setUnitPrices(shQ)
+	setSubtotals(shQ)
 
 	return c.JSON(http.StatusOK, shQ)
 }
 
-// ShoppingList id - i, database - d,p - query params
-func listGetShoppingCore(i, dbv, p string) ([]d, error) {
-	//Assign database
-	db := dbase{dbv}
-
-	//Get ShoppingList id
-	id := i
-
-	s, err := db.getShoppingList(id)
-	if err != nil {
-		return nil, errors.New("id error")
-	}
-
-	//DB query - get shopping list contents
-	//"p" is query parameter
-	// - "full" returns the full ShoppingList Edge Item
-	// - "qty" returns only Template Edge item (see listMakeTemplate)
-	var query2 string
-	var qb string
-	if p == "full" {
-		query2 = "FOR c in Shops let b = c.name let sub = (FOR v, e IN 1..1 OUTBOUND c @slist let a = {'label': v.name, 'nett': v.nett, 'nett_unit': v.nett_unit, 'price': e.price, 'currency': e.currency, 'qty': e.qty, 'trolley': e.trolley, 'special': e.special, 'edge_id': e._key, 'item_id': v._key, 'shop_id': c._key} RETURN a ) FILTER sub != [] RETURN {'shop': b, 'items': sub}"
-		qb = "slist"
-	} else if p == "qty" {
-		query2 = "FOR c in Shops let b = c.name let sub = (FOR v, e IN 1..1 OUTBOUND c @tpl let a = {'label': v.name, 'nett': v.nett, 'nett_unit': v.nett_unit, 'qty': e.qty, 'edge_id': e._key, 'item_id': v._key, 'shop_id': c._key} RETURN a ) FILTER sub != [] RETURN {'shop': b, 'items': sub}"
-		qb = "tpl"
-	}
-
-	shQ, err2 := db.getQueries(query2, qb, s)
-
-	//Catch error from the query
-	if err2 != nil {
-		return nil, errors.New("server error")
-	}
-
-	if shQ == nil {
-		return nil, nil
-	}
-
-	return shQ, nil
-}
-
 func listGetTrolley(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get list id
 	id := c.Param("id")
 
 	//Get Shop id
-	sh := c.Param("key")
-
-	s, err := db.getShoppingList(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
-	}
+	shop := "Shops/" + c.Param("key")
 
-	shop := "Shops/" + sh
+	shQ, err := store.ListTrolley(c.Request().Context(), ctxDB(c), id, shop)
 
-	//DB query - get shopping list contents
-	query := "FOR v, e IN 1..1 OUTBOUND '" + shop + "' @slist let a = {'label': v.name, 'nett': v.nett, 'nett_unit': v.nett_unit, 'price': e.price, 'currency': e.currency, 'qty': e.qty, 'trolley': e.trolley, 'special': e.special, 'edge_id': e._key, 'item_id': v._key} FILTER e.trolley == true RETURN a"
-
-	shQ, err := db.getQueries(query, "slist", s)
-
-	//Catch error from the query
+	//Catch error from the query, including a non-existent id
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	if shQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		shQ = []SListItems{}
+	}
+	for n := range shQ {
+		shQ[n].setUnitPrice()
 	}
 
 	return c.JSON(http.StatusOK, shQ)
 }
 
 func listGetTemplates(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//DB query
-	query := "FOR tpl in Templates RETURN {'name': tpl.name, 'date': tpl.date, 'hidden': tpl.hidden, 'id': tpl._key, 'label': tpl.label}"
-	var bind string
-
-	//Run query and response. bind is a null string "" since no binding takes place for the query
-	listQ, err := db.getQueries(query, bind, bind)
+	listQ, err := store.TemplateAll(c.Request().Context(), ctxDB(c))
 
 	//Catch error from the query
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
-		//TODO: return specific error for "AQL: collection or view not found: Templates (while parsing)"
-		// This will allow frontend code to differentiate between 500 errors
+		//"collection or view not found: Templates" comes back as 404, i.e. Templates not enabled
+		return err
 	}
 
 	if listQ == nil {
-		fault := "No data returned"
-		return c.JSON(http.StatusBadRequest, fault)
+		listQ = []ShopListsAll{}
 	}
 
 	return c.JSON(http.StatusOK, listQ)
 
 }
 
-func listTemplateDetailsCore(i, dbv string) ([]d, error) {
-
-	db := dbase{dbv}
-	s, err := db.getTemplate(i)
-	if err != nil {
-		return nil, errors.New("id error")
-	}
-
-	//DB query - get template's contents
-	query2 := "FOR c in Shops let b = c.name let sub = (FOR v, e IN 1..1 OUTBOUND c @tpl let a = {'label': v.name, 'nett': v.nett, 'nett_unit': v.nett_unit, 'qty': e.qty, 'edge_id': e._key, 'item_id': v._key, 'shop_id': c._key} RETURN a ) FILTER sub != [] RETURN {'shop': b, 'items': sub}"
-
-	tplQ, err := db.getQueries(query2, "tpl", s)
-
-	//Catch error from the query
-	if err != nil {
-		return nil, errors.New("server error")
-	}
-
-	return tplQ, nil
-
-}
-
 func listTemplateDetails(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-
-	//Get item id
+	//Get template id
 	id := c.Param("id")
 
-	tplQ, err := listTemplateDetailsCore(id, dbv)
+	tplQ, err := store.TemplateView(c.Request().Context(), ctxDB(c), id)
 
 	//Catch errors
 	if err != nil {
-		if err.Error() == "id error" {
-			return c.JSON(http.StatusBadRequest, "invalid id")
-		} else if err.Error() == "server error" {
-			return c.JSON(http.StatusInternalServerError, "server error")
-		}
+		return err
 	}
 
 	if tplQ == nil {
-		fault := "No data to return."
-		return c.JSON(http.StatusNoContent, fault) //204 is returned, indicating connection successful but no data
+		tplQ = []Tpl{}
 	}
 
 	return c.JSON(http.StatusOK, tplQ)
@@ -600,186 +340,139 @@ func listTemplateDetails(c echo.Context) error {
 }
 
 func adminGetUsers(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	cta := fmt.Sprintf("%v", c.Request().Context().Value("sub"))
-	r := cache[cta].role
-	db := dbase{"_system"}
-
-	var bind string
-	query := "FOR d in users RETURN {'email': d.email, 'role': d.role}"
-
-	if r == "admin" {
-		//Run query and response
-		userQ, err := db.getQueries(query, bind, bind)
-
-		//Catch error from the query
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, err)
-		}
-
-		if userQ == nil {
-			fault := "No data returned"
-			return c.JSON(http.StatusBadRequest, fault)
-		}
+	//Run query and response
+	userQ, err := store.UserAll(c.Request().Context())
 
-		return c.JSON(http.StatusOK, userQ)
+	//Catch error from the query
+	if err != nil {
+		return err
+	}
 
+	if userQ == nil {
+		userQ = []UserNew{}
 	}
 
-	return echo.ErrUnauthorized
+	return c.JSON(http.StatusOK, userQ)
 
 }
 
-// TODO: This is too verbose, too many repeated calls. Manual sorting because item's date != shopping list date.
+// Latest 10 prices of an item, newest first. See trendGetHistory for the rest.
 func trendGetItem(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
 	//Get item id
 	id := c.Param("id")
-	it := "Items/" + id
 
-	//Query to retrieve all ShoppingLists
-	query_sl := "FOR s in ShoppingLists SORT s.date DESC RETURN {'list': s.name, 'date': s.date}"
-	var bind string
-	trQ, err := db.getQueries(query_sl, bind, bind)
-
-	//Catch error from the query
+	h, err := store.PriceHistory(c.Request().Context(), ctxDB(c), id, PriceFilter{Limit: 10})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
+	h.setUnitPrices()
 
-	//Query and map price trend
-	var trend []d
-	trI := 0
+	return c.JSON(http.StatusOK, h.Prices)
+}
+
+// Price history of an item with min/max/avg/median per currency, filtered by
+// ?from=&to= (YYYY-MM-DD, inclusive), ?shop= and ?currency=. ?group=shop adds the stats
+// per shop, ?limit=&offset= page the prices (not the stats).
+func trendGetHistory(c echo.Context) error {
+	f, err := priceFilter(c)
+	if err != nil {
+		return err
+	}
 
-	//Test if trQ is empty.
-	if len(trQ) == 0 {
-		return c.JSON(http.StatusOK, "No trend data available")
+	h, err := store.PriceHistory(c.Request().Context(), ctxDB(c), c.Param("id"), f)
+	if err != nil {
+		return err
 	}
+	h.setUnitPrices()
 
-	var trS []int //Sorting slice
-	dbx, ctx := aranDB(ah, db.db)
-	query_tr := "FOR v, e IN 1..1 INBOUND @item @sl RETURN {'shop': v.name, 'branch': v.branch, 'city': v.city, 'country': v.country, 'currency': e.currency, 'price': e.price, 'date': e.date, 'special': e.special, 'list_id': e._id}"
-	for _, trR := range trQ {
-		var tres []d
-		sl := trR["list"]
-		b := d{"item": it, "sl": sl}
+	return c.JSON(http.StatusOK, h)
+}
 
-		if ct {
-			data := aranQuery{query_tr, b, dbx, ctx}
-			tres = data.aranQ()
-		} else {
-			fmt.Println("Failed to connect. Troubleshoot connection to ", ah)
-			return c.JSON(http.StatusInternalServerError, err)
-		}
+// Query parameters of trendGetHistory, any problems as a validationError
+func priceFilter(c echo.Context) (PriceFilter, error) {
+	var f PriceFilter
+	var chk checker
 
-		//If trend result is valid (not ""), then add to trend slice, increase counter
-		if len(tres) > 0 {
-			trS = append(trS, int(tres[0]["date"].(float64)))
-			trend = append(trend, tres[0])
-			trI++
+	//Entry dates are unix seconds, to runs to the end of its day
+	day := func(field string, end bool) int64 {
+		v := c.QueryParam(field)
+		if v == "" {
+			return 0
 		}
-
-		//Only return 10 results
-		if trI > 10 {
-			break
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			chk.add(field, "must be a date, e.g. 2024-01-31")
+			return 0
+		}
+		if end {
+			return t.AddDate(0, 0, 1).Unix() - 1
 		}
+		return t.Unix()
+	}
+	f.From = day("from", false)
+	f.To = day("to", true)
+	if f.From != 0 && f.To != 0 && f.To < f.From {
+		chk.add("to", "must not be before from")
 	}
 
-	//Sort trend by date (trendS is sorted trend)
-	trendS := []d{}
-	if len(trS) > 0 {
-		sort.Sort(sort.Reverse(sort.IntSlice(trS)))
+	if s := c.QueryParam("shop"); s != "" {
+		f.Shop = "Shops/" + s
+	}
+	if cur := strings.ToUpper(c.QueryParam("currency")); cur != "" {
+		chk.currency("currency", cur)
+		f.Currency = cur
+	}
 
-		for _, srt := range trS {
-			for _, unsrt := range trend {
-				if unsrt["date"] == float64(srt) {
-					trendS = append(trendS, unsrt)
-				}
-			}
+	switch c.QueryParam("group") {
+	case "":
+	case "shop":
+		f.ByShop = true
+	default:
+		chk.add("group", "must be shop")
+	}
+
+	count := func(field string) int {
+		v := c.QueryParam(field)
+		if v == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			chk.add(field, "must be a whole number, 0 or more")
 		}
+		return n
 	}
+	f.Limit = count("limit")
+	f.Offset = count("offset")
 
-	return c.JSON(http.StatusOK, trendS)
+	return f, chk.err()
 }
 
 /* ++++++++++++++
  * POST Functions
  * ++++++++++++++++
  */
-//TODO: the postQueries methods can be tidied up to be less redundant/repeated
-
-// c for collection name
-func (i ItemNew) postQueries(c string, db dbase) (string, error) {
-
-	var insertQ string
-	dbx, ctx := aranDB(ah, db.db)
-
-	if ct {
-		data := aranInsertItem{c, i, dbx, ctx}
-		insertQ = data.aranIns()
-		fmt.Println("Meta key:", insertQ)
-	} else {
-		fmt.Println("Meta Key ", ah)
-		var err = errors.New("failed to connect to db")
-		return "", err
-	}
-
-	return insertQ, nil
-
-}
-
-func (i ShopNew) postQueries(c string, db dbase) (string, error) {
-
-	var insertQ string
-	dbx, ctx := aranDB(ah, db.db)
-
-	if ct {
-		data := aranInsertShop{c, i, dbx, ctx}
-		insertQ = data.aranIns()
-		fmt.Println("Meta key:", insertQ)
-	} else {
-		fmt.Println("Meta Key ", ah)
-		var err = errors.New("failed to connect to db")
-		return "", err
-	}
-
-	return insertQ, nil
-
-}
 
 func itemCreate(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
 	var data ItemNew
 	var insertQ string
-	coll := "Items"
 
 	if err := c.Bind(&data); err != nil {
 		return err
 	} else if err == nil {
 
+		data.normalize()
+
 		//Verify data, because Arango does not by default
-		if data.Nett <= 0 {
-			return c.JSON(http.StatusBadRequest, "cannot have zero as nett")
-		}
-		if data.Brand == "" || data.Name == "" || data.Ntt_un == "" {
-			return c.JSON(http.StatusBadRequest, "all options must be set")
+		if err := data.validate(); err != nil {
+			return err
 		}
 
-		n := strings.ToLower(data.Name)
-		b := strings.ToLower(data.Brand)
-		data.Name, data.Brand = n, b
-
 		//Run query and response
-		insertQ, err = data.postQueries(coll, db)
+		insertQ, err = store.ItemCreate(c.Request().Context(), ctxDB(c), data)
 
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, err)
+			return err
 		}
 
 	}
@@ -788,34 +481,25 @@ func itemCreate(c echo.Context) error {
 }
 
 func shopCreate(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
 	var data ShopNew
 	var insertQ string
-	coll := "Shops"
 
 	if err := c.Bind(&data); err != nil {
 		return err
 	} else if err == nil {
 
+		data.normalize()
+
 		//Verify data, because Arango does not by default
-		if data.Branch == "" || data.Name == "" || data.City == "" || data.Country == "" {
-			return c.JSON(http.StatusBadRequest, "all options must be set")
+		if err := data.validate(); err != nil {
+			return err
 		}
 
-		n := strings.ToLower(data.Name)
-		b := strings.ToLower(data.Branch)
-		ci := strings.ToLower(data.City)
-		cy := strings.ToLower(data.Country)
-		data.Name, data.Branch, data.City, data.Country = n, b, ci, cy
-
 		//Run query and response
-		insertQ, err = data.postQueries(coll, db)
+		insertQ, err = store.ShopCreate(c.Request().Context(), ctxDB(c), data)
 
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, err)
+			return err
 		}
 
 	}
@@ -823,128 +507,64 @@ func shopCreate(c echo.Context) error {
 	return c.JSON(http.StatusOK, "data submitted: "+insertQ)
 }
 
-// dbv - db name, returns data, edge name and error
-func listCreateCore(dbv string) ([]d, string, error) {
-	db := dbase{dbv}
-
-	t := time.Now().Unix()
-	n := "ShoppingList" + fmt.Sprint(t)
-	e, err := db.edgeCreate(n)
-
-	//Catch error from the query
-	if err != nil {
-		//Since Unix time will always be unqiue in this situation, any error means something has gone wrong server / code side
-		return nil, "", errors.New("server error")
-	}
-
-	//Update ShoppingLists:
-	query := "INSERT { name: @name, 'hidden': false, 'date': DATE_NOW(),} INTO ShoppingLists RETURN NEW"
-	bind := "name"
-
-	execQ, err := db.getQueries(query, bind, e.Name())
-
-	if err != nil {
-		return nil, "", errors.New("server error")
-	}
-
-	return execQ, e.Name(), nil
-}
-
 func listCreate(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-
-	execQ, _, err := listCreateCore(dbv)
+	l, err := store.ListCreate(c.Request().Context(), ctxDB(c))
 
 	//Catch errors
 	if err != nil {
-		if err.Error() == "id error" {
-			return c.JSON(http.StatusBadRequest, "invalid id")
-		} else if err.Error() == "server error" {
-			return c.JSON(http.StatusInternalServerError, "server error")
-		}
+		return err
 	}
 
-	return c.JSON(http.StatusOK, execQ)
+	return c.JSON(http.StatusOK, newDoc("ShoppingLists", l))
 
 }
 
 // Create ShoppingList from Template id
 func listMake(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
+	if _, err := listFromTemplate(c.Request().Context(), ctxDB(c), c.Param("id")); err != nil {
+		return err
+	}
 
-	//Get item id
-	id := c.Param("id")
+	return c.JSON(http.StatusOK, "template created from shopping list")
 
-	//Retrieve Template based on id
-	tpl, err := listTemplateDetailsCore(id, dbv)
+}
 
-	//Catch errors
+// New shopping list holding the entries of template id, without prices
+func listFromTemplate(ctx context.Context, dbv, id string) (ShopListsAll, error) {
+	//Retrieve Template based on id
+	tpl, err := store.TemplateView(ctx, dbv, id)
 	if err != nil {
-		if err.Error() == "id error" {
-			return c.JSON(http.StatusBadRequest, "invalid id")
-		} else if err.Error() == "server error" {
-			return c.JSON(http.StatusInternalServerError, "server error")
-		}
+		return ShopListsAll{}, err
 	}
 
 	if tpl == nil {
-		fault := "No data to return."
-		return c.JSON(http.StatusNoContent, fault) //204 is returned, indicating connection successful but no data
+		return ShopListsAll{}, echo.NewHTTPError(http.StatusUnprocessableEntity, "template "+id+" is empty")
 	}
 
-	//Create new shopping list collection listCreateCore()
-	_, edN, err := listCreateCore(dbv)
-
-	//Catch errors
+	//Create new shopping list
+	l, err := store.ListCreate(ctx, dbv)
 	if err != nil {
-		if err.Error() == "id error" {
-			return c.JSON(http.StatusBadRequest, "invalid id")
-		} else if err.Error() == "server error" {
-			return c.JSON(http.StatusInternalServerError, "server error")
-		}
+		return ShopListsAll{}, err
 	}
 
 	//Add items & shops to new shopping list
-	// - Iterate Template tpl and enter into ShoppingList using ?
+	d := time.Now().Unix()
 	for _, k := range tpl {
-		u := k["items"]
-		v, ok := u.([]interface{})
-		if !ok {
-			fmt.Println("Not OK!") //return error!!
-		}
-
-		for w := range v {
-			u := v[w]
-			r, ok := u.(map[string]interface{})
-			if !ok {
-				fmt.Println("Not OK2!") //return error!!
-			}
-			f := fmt.Sprintf("%v", r["shop_id"]) //From
-			t := fmt.Sprintf("%v", r["item_id"]) //To
-			q := float32(r["qty"].(float64))     //Qty
-			shl := SlistEdge{t, f, 0, 0, "", false, false, q, ""}
-			_, err = listAddItemCore(shl, dbv, edN) //Note that this function sets the date, hence 0 above.
-			if err != nil {
-				fmt.Println("Not OK3!") //return error!!
+		for _, r := range k.Items {
+			shl := SlistEdge{"Items/" + r.Item_id, "Shops/" + r.Shop_id, d, 0, "", false, false, r.Qty, ""}
+			if _, err = store.ListAddItem(ctx, dbv, l.Id, shl); err != nil {
+				return l, err
 			}
 		}
-
 	}
 
-	return c.JSON(http.StatusOK, "template created from shopping list")
-
+	return l, nil
 }
 
 func listEnableTemplates(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	_, err := db.colCreate("Templates")
+	err := store.TemplatesEnable(c.Request().Context(), ctxDB(c))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
 	return c.JSON(http.StatusOK, "Templates enabled")
@@ -952,302 +572,237 @@ func listEnableTemplates(c echo.Context) error {
 }
 
 func listCreateTemplate(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	t := time.Now().Unix()
-	n := "Template" + fmt.Sprint(t)
-	e, err := db.edgeCreate(n)
+	l, err := store.TemplateCreate(c.Request().Context(), ctxDB(c))
 
 	//Catch error from the query
 	if err != nil {
-		//Since Unix time will always be unqiue in this situation, any error means something has gone wrong server / code side
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
-	//Update Templates:
-	query := "INSERT { name: @name, 'hidden': false, 'date': DATE_NOW(),} INTO Templates RETURN NEW"
-	bind := "name"
+	return c.JSON(http.StatusOK, newDoc("Templates", l))
 
-	execQ, err := db.getQueries(query, bind, e.Name())
+}
 
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+func listMakeTemplate(c echo.Context) error {
+	if _, err := templateFromList(c.Request().Context(), ctxDB(c), c.Param("id")); err != nil {
+		return err
 	}
 
-	return c.JSON(http.StatusOK, execQ)
+	return c.JSON(http.StatusOK, "template created from shopping list")
 
 }
 
-func listMakeTemplate(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get ShoppingList id
-	id := c.Param("id")
-
+// New template holding the items and quantities of shopping list id
+func templateFromList(ctx context.Context, dbv, id string) (ShopListsAll, error) {
 	//Retrieve ShoppingList based on id
-	// - Only retrieve what is needed for a Template
+	// - Only qty is needed for a Template
 	// - (not needed: price, currency, trolley, special)
-	shQ, err := listGetShoppingCore(id, dbv, "qty")
-
-	// - Catch errors
+	shQ, err := store.ListView(ctx, dbv, id)
 	if err != nil {
-
-		if err.Error() == "id error" {
-			return c.JSON(http.StatusBadRequest, "invalid id")
-		} else if err.Error() == "server error" {
-			return c.JSON(http.StatusInternalServerError, "server error")
-		}
+		return ShopListsAll{}, err
 	}
 
 	if shQ == nil {
-		fault := "empty shopping list"
-		return c.JSON(http.StatusNoContent, fault)
+		return ShopListsAll{}, echo.NewHTTPError(http.StatusUnprocessableEntity, "shopping list "+id+" is empty")
 	}
 
-	//Create Template collection - TODO: this is verbose. Create Core function. See listCreateTemplate
-
-	t := time.Now().Unix()
-	n := "Template" + fmt.Sprint(t)
-	e, err := db.edgeCreate(n)
-
-	// - Catch error from the query
-	if err != nil {
-		//Since Unix time will always be unqiue in this situation, any error means something has gone wrong server / code side
-		return c.JSON(http.StatusInternalServerError, err)
-	}
-
-	//Update Templates with reference to new Template:
-	query := "INSERT { name: @name, 'hidden': false, 'date': DATE_NOW(),} INTO Templates RETURN NEW"
-	bind := "name"
-
-	_, err = db.getQueries(query, bind, e.Name())
-
+	//Create Template and add reference to it in Templates
+	t, err := store.TemplateCreate(ctx, dbv)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return ShopListsAll{}, err
 	}
 
-	//Add entries to Template collection based on ShoppingList
-	// - Iterate reduced ShoppingList shQ and enter into Template using addToTmpltCore()
+	//Add entries to Template based on ShoppingList
 	for _, k := range shQ {
-		u := k["items"]
-		v, ok := u.([]interface{})
-		if !ok {
-			fmt.Println("Not OK!") //return error!!
-		}
-
-		for w := range v {
-			u := v[w]
-			r, ok := u.(map[string]interface{})
-			if !ok {
-				fmt.Println("Not OK2!") //return error!!
-			}
-			f := fmt.Sprintf("%v", r["shop_id"]) //From
-			t := fmt.Sprintf("%v", r["item_id"]) //To
-			q := float32(r["qty"].(float64))     //Qty
-			tdp := TplEdge{t, f, q}
-			_, err = addToTmpltCore(tdp, dbv, e.Name())
-			if err != nil {
-				fmt.Println("Not OK3!") //return error!!
+		for _, r := range k.Items {
+			tdp := TplEdge{"Items/" + r.Item_id, "Shops/" + r.Shop_id, r.Qty}
+			if _, err = store.TemplateAddItem(ctx, dbv, t.Id, tdp); err != nil {
+				return t, err
 			}
 		}
-
 	}
 
-	return c.JSON(http.StatusOK, "template created from shopping list")
-
+	return t, nil
 }
 
 func adminCreateUser(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	cta := fmt.Sprintf("%v", c.Request().Context().Value("sub"))
-	r := cache[cta].role
-	db := dbase{"_system"}
-
 	var data UserNew
-	var dbnew string
-
-	if r == "admin" {
-		//DB is a random ID
-		n := makeID()
-
-		//Create DB
-		dbn, err := dbCreate(ah, n)
-		if err != nil {
-			fmt.Println("Error creating new database", err)
-		}
-
-		fmt.Println("Database created, ", dbn)
-		dbnew = dbn
-
-		//Add to /users
-		if err := c.Bind(&data); err != nil {
-			return err
-		} else if err == nil {
 
-			query := "INSERT {'email': @email, 'db': '" + n + "', 'role': 'user'} INTO users"
-			bind := "email"
-
-			uQ, err := db.getQueries(query, bind, data.Email)
-
-			if err != nil {
-				return c.JSON(http.StatusInternalServerError, err)
-			}
-
-			fmt.Println(uQ)
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
 
-		}
+	if err := data.validate(); err != nil {
+		return err
+	}
+	//New users always start as user, they're promoted with adminSetRole
+	if data.Role != "" && data.Role != roleUser {
+		return validationError{{"role", "must be user, promote with PATCH /admin/users/{email}/role"}}
+	}
 
-		//Create collections: Items, Shops, ShoppingLists
-		//Temlates not created by default
-		db2 := dbase{dbnew}
-		_, err = db2.colCreate("Items")
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, err)
-		}
-		_, err = db2.colCreate("Shops")
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, err)
-		}
-		_, err = db2.colCreate("ShoppingLists")
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, err)
-		}
+	//Safe to retry: an existing user is returned as is, a half-built one is finished
+	dbn, created, err := store.UserCreate(c.Request().Context(), data)
+	if err != nil {
+		return err
+	}
 
-		return c.JSON(http.StatusOK, "")
+	out := d{"email": data.Email, "db": dbn, "created": created}
+	if !created {
+		return c.JSON(http.StatusOK, out)
 	}
 
-	return echo.ErrUnauthorized
+	return c.JSON(http.StatusCreated, out)
 
 }
 
-/*????????????
-*
-* PATCH
-*
-*?????????????
- */
-func (d ItemNew) patchQueries(c, k string, db dbase) (string, error) {
-
-	var upd string
-	var err error
-
-	dbx, ctx := aranDB(ah, db.db)
+// Promote or demote a user. The last admin can't be demoted.
+func adminSetRole(c echo.Context) error {
+	eml := c.Param("email")
 
-	n := strings.ToLower(d.Name)
-	b := strings.ToLower(d.Brand)
-	d.Name, d.Brand = n, b
+	var data UserNew
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+	data.Email = eml
+	if err := data.validate(); err != nil {
+		return err
+	}
+	if data.Role == "" {
+		return validationError{{"role", "is required"}}
+	}
 
-	if ct {
-		data := aranUpdateItem{c, k, d, dbx, ctx}
-		upd, err = data.aranUp()
+	old, err := store.UserSetRole(c.Request().Context(), eml, data.Role)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			return "", err
-		}
+	if old != data.Role {
+		audit(c.Request().Context(), AuditEntry{Actor: ctxEmail(c), Action: "role", Target: eml, From: old, To: data.Role})
 	}
 
-	return upd, nil
+	//Role is cached with the user
+	cache.invalidateEmail(eml)
 
+	return c.JSON(http.StatusOK, d{"email": eml, "from": old, "role": data.Role})
 }
 
-func (d ShopNew) patchQueries(c, k string, db dbase) (string, error) {
-
-	var upd string
-	var err error
-
-	dbx, ctx := aranDB(ah, db.db)
+// Schema version of every tenant
+func adminGetSchema(c echo.Context) error {
+	ctx := c.Request().Context()
 
-	n := strings.ToLower(d.Name)
-	b := strings.ToLower(d.Branch)
-	ci := strings.ToLower(d.City)
-	cy := strings.ToLower(d.Country)
-	d.Name, d.Branch, d.City, d.Country = n, b, ci, cy
-
-	if ct {
-		data := aranUpdateShop{c, k, d, dbx, ctx}
-		upd, err = data.aranUp()
+	dbs, err := store.TenantDBs(ctx)
+	if err != nil {
+		return err
+	}
 
+	out := []d{}
+	for _, n := range dbs {
+		v, err := store.SchemaVersion(ctx, n)
+		r := d{"db": n, "version": v}
 		if err != nil {
-			return "", err
+			r["error"] = err.Error()
 		}
+		out = append(out, r)
 	}
 
-	return upd, nil
-
+	return c.JSON(http.StatusOK, d{"latest": schemaLatest(), "tenants": out})
 }
 
-func (d SlistEdgeItem) patchQueries(c, k string, db dbase) (string, error) {
-
-	var upd string
-	var err error
-
-	dbx, ctx := aranDB(ah, db.db)
-
-	if ct {
-		data := aranUpdateSlist{c, k, d, dbx, ctx}
-		upd, err = data.aranUp()
+// Run pending migrations for every tenant, or only ?db=
+func adminMigrate(c echo.Context) error {
+	ctx := c.Request().Context()
 
+	if n := c.QueryParam("db"); n != "" {
+		from, to, err := store.SchemaMigrate(ctx, n)
 		if err != nil {
-			return "", err
+			return err
 		}
+		return c.JSON(http.StatusOK, []migrateResult{{Db: n, From: from, To: to}})
 	}
 
-	return upd, nil
+	out, err := migrateAll(ctx)
+	if err != nil {
+		return err
+	}
 
+	return c.JSON(http.StatusOK, out)
 }
 
-func (d ShopListsAll) patchQueries(c, k string, db dbase) (string, error) {
+// Most recent audit entries, ?limit= (default 100)
+func adminGetAudit(c echo.Context) error {
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
 
-	var upd string
-	var err error
+	out, err := store.AuditAll(c.Request().Context(), limit)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		out = []AuditEntry{}
+	}
 
-	dbx, ctx := aranDB(ah, db.db)
+	return c.JSON(http.StatusOK, out)
+}
 
-	if ct {
-		data := aranUpdateSlistAll{c, k, d, dbx, ctx}
-		upd, err = data.aranUp()
+// Offboarding: drops the user's database and removes them from _system/users.
+// With ?export=true everything is first archived to archive_dir, and nothing is deleted if that fails.
+func adminDeleteUser(c echo.Context) error {
+	eml := c.Param("email")
+	ctx := c.Request().Context()
 
-		if err != nil {
-			return "", err
-		}
+	if eml == ctxEmail(c) {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot delete yourself")
 	}
 
-	return upd, nil
-
-}
-
-func (d TplEdgeItem) patchQueries(c, k string, db dbase) (string, error) {
+	u, err := store.UserGet(ctx, eml)
+	if err != nil {
+		return err
+	}
 
-	var upd string
-	var err error
+	out := d{"email": eml, "db": u.db}
 
-	dbx, ctx := aranDB(ah, db.db)
+	if c.QueryParam("export") == "true" {
+		if conf.ArchiveDir == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "export requested but archive_dir is not configured")
+		}
 
-	if ct {
-		data := aranUpdateTpl{c, k, d, dbx, ctx}
-		upd, err = data.aranUp()
+		a, err := exportUser(ctx, u)
+		if err != nil {
+			return err
+		}
 
+		f, err := writeArchive(conf.ArchiveDir, a)
 		if err != nil {
-			return "", err
+			fmt.Println("Archive failed:", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "export failed, user not deleted")
 		}
+		out["archive"] = f
 	}
 
-	return upd, nil
+	if _, err := store.UserDelete(ctx, eml); err != nil {
+		return err
+	}
 
+	//Drop every cached sub (tokens and API keys) of the user
+	out["sessions"] = cache.invalidateEmail(eml)
+
+	fmt.Println("User deleted, ", eml, u.db)
+
+	return c.JSON(http.StatusOK, out)
 }
 
-func itemEdit(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
+/*????????????
+*
+* PATCH
+*
+*?????????????
+ */
 
+func itemEdit(c echo.Context) error {
 	//Get item id
 	docKey := c.Param("id")
-	col := "Items"
 
 	var data ItemNew
 	var update string
@@ -1256,19 +811,17 @@ func itemEdit(c echo.Context) error {
 		return err
 	} else if err == nil {
 
+		data.normalize()
+
 		//Verify data, because Arango does not by default
-		if data.Nett <= 0 {
-			return c.JSON(http.StatusBadRequest, "cannot have zero as nett")
-		}
-		if data.Brand == "" || data.Name == "" || data.Ntt_un == "" {
-			return c.JSON(http.StatusBadRequest, "all options must be set")
+		if err := data.validate(); err != nil {
+			return err
 		}
 
-		update, err = data.patchQueries(col, docKey, db)
+		update, err = store.ItemUpdate(c.Request().Context(), ctxDB(c), docKey, data)
 
 		if err != nil {
-			//Since data was verified, any error is likely server related?
-			return c.JSON(http.StatusInternalServerError, err)
+			return err
 		}
 
 	}
@@ -1278,13 +831,8 @@ func itemEdit(c echo.Context) error {
 }
 
 func shopEdit(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get shop id
 	docKey := c.Param("id")
-	col := "Shops"
 
 	var data ShopNew
 	var update string
@@ -1293,16 +841,17 @@ func shopEdit(c echo.Context) error {
 		return err
 	} else if err == nil {
 
+		data.normalize()
+
 		//Verify data, because Arango does not by default
-		if data.Branch == "" || data.Name == "" || data.City == "" || data.Country == "" {
-			return c.JSON(http.StatusBadRequest, "all options must be set")
+		if err := data.validate(); err != nil {
+			return err
 		}
 
-		update, err = data.patchQueries(col, docKey, db)
+		update, err = store.ShopUpdate(c.Request().Context(), ctxDB(c), docKey, data)
 
 		if err != nil {
-			//Since data was verified, any error is likely server related?
-			return c.JSON(http.StatusInternalServerError, err)
+			return err
 		}
 
 	}
@@ -1311,13 +860,8 @@ func shopEdit(c echo.Context) error {
 }
 
 func listSetHidden(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get list id
 	id := c.Param("id")
-	col := "ShoppingLists"
 
 	var data ShopListsAll
 	var update string
@@ -1327,15 +871,14 @@ func listSetHidden(c echo.Context) error {
 	} else if err == nil {
 
 		//Verify data, because Arango does not by default
-		if data.Date == 0 || data.Name == "" || data.Id == "" {
-			return c.JSON(http.StatusBadRequest, "all options must be set")
+		if err := data.validate(false); err != nil {
+			return err
 		}
 
-		update, err = data.patchQueries(col, id, db)
+		update, err = store.ListUpdate(c.Request().Context(), ctxDB(c), id, data)
 
 		if err != nil {
-			//Since data was verified, any error is likely server related?
-			return c.JSON(http.StatusInternalServerError, err)
+			return err
 		}
 
 	}
@@ -1345,13 +888,8 @@ func listSetHidden(c echo.Context) error {
 }
 
 func listEdit(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get list id
 	id := c.Param("id")
-	col := "ShoppingLists"
 
 	var data ShopListsAll
 	var update string
@@ -1361,15 +899,14 @@ func listEdit(c echo.Context) error {
 	} else if err == nil {
 
 		//Verify data, because Arango does not by default
-		if data.Date == 0 || data.Name == "" || data.Id == "" || data.Label == "" {
-			return c.JSON(http.StatusBadRequest, "all options must be set")
+		if err := data.validate(true); err != nil {
+			return err
 		}
 
-		update, err = data.patchQueries(col, id, db)
+		update, err = store.ListUpdate(c.Request().Context(), ctxDB(c), id, data)
 
 		if err != nil {
-			//Since data was verified, any error is likely server related?
-			return c.JSON(http.StatusInternalServerError, err)
+			return err
 		}
 
 	}
@@ -1380,13 +917,8 @@ func listEdit(c echo.Context) error {
 
 // TODO: identical to above func. Tidy up!!
 func listTemplateEdit(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get template id
 	id := c.Param("id")
-	col := "Templates"
 
 	var data ShopListsAll
 	var update string
@@ -1396,15 +928,14 @@ func listTemplateEdit(c echo.Context) error {
 	} else if err == nil {
 
 		//Verify data, because Arango does not by default
-		if data.Date == 0 || data.Name == "" || data.Id == "" || data.Label == "" {
-			return c.JSON(http.StatusBadRequest, "all options must be set")
+		if err := data.validate(true); err != nil {
+			return err
 		}
 
-		update, err = data.patchQueries(col, id, db)
+		update, err = store.TemplateUpdate(c.Request().Context(), ctxDB(c), id, data)
 
 		if err != nil {
-			//Since data was verified, any error is likely server related?
-			return c.JSON(http.StatusInternalServerError, err)
+			return err
 		}
 
 	}
@@ -1416,35 +947,27 @@ func listTemplateEdit(c echo.Context) error {
 // Can update edge doc contents, but not change _from and _to
 // Updates shopping lists qty, price, trolley, etc
 func listSetTrolley(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get list id and edge key
 	id := c.Param("id")
 	key := c.Param("key")
-	fmt.Println("id:", id)
-	fmt.Println("Key:", key)
 
-	d := time.Now().Unix()
 	var trolley SlistEdgeItem
 	var update string
 
-	s, err := db.getShoppingList(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
-	}
-
 	if err := c.Bind(&trolley); err != nil {
 		return err
 	} else if err == nil {
 
-		trolley.Date = d
-		update, err = trolley.patchQueries(s, key, db)
+		trolley.normalize()
+		if err := trolley.validate(); err != nil {
+			return err
+		}
+
+		trolley.Date = time.Now().Unix()
+		update, err = store.ListUpdateItem(c.Request().Context(), ctxDB(c), id, key, trolley)
 
 		if err != nil {
-			//Since data was verified, any error is likely server related?
-			return c.JSON(http.StatusInternalServerError, err)
+			return err
 		}
 
 	}
@@ -1452,58 +975,32 @@ func listSetTrolley(c echo.Context) error {
 	return c.JSON(http.StatusOK, "update successful: "+update)
 }
 
-// c = collection name
-func listAddItemCore(s SlistEdge, dbv, c string) (string, error) {
-	db := dbase{dbv}
-
-	s.Date = time.Now().Unix()
-	s.From = "Shops/" + s.From
-	s.To = "Items/" + s.To
-
-	dbx, ctx := aranDB(ah, db.db)
-	col, err := dbx.Collection(ctx, c)
-	if err != nil {
-		return "", errors.New("server error")
-	}
-
-	meta, err := col.CreateDocument(ctx, s)
-	if err != nil {
-		return "", errors.New("server error")
-	}
-
-	return meta.Key, nil
-
-}
-
 func listAddItem(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get list id
 	id := c.Param("id")
 
 	var sledge SlistEdge
 	var ins string
 
-	//Use id to retrieve ShoppingList name from ShoppingLists
-	s, err := db.getShoppingList(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
-	}
-
 	//Add Edge
-	//let d = DATE_NOW() INSERT { _to: "Items/382", _from: "Shops/246", date: d, price: 80.20, currency: "NAD", special: false, trolley: false, qty: 6, tag: ""} INTO ShoppingList20220717001 RETURN NEW
+	//let d = DATE_NOW() INSERT { _to: "Items/382", _from: "Shops/246", date: d, price: 80.20, currency: "NAD", special: false, trolley: false, qty: 6, tag: "", list: "ShoppingLists/1234"} INTO ListEntries RETURN NEW
 	if err := c.Bind(&sledge); err != nil {
 		return err
 	} else if err == nil {
 
-		ins, err = listAddItemCore(sledge, dbv, s)
+		sledge.normalize()
+		if err := sledge.validate(c.Request().Context(), ctxDB(c)); err != nil {
+			return err
+		}
+
+		sledge.Date = time.Now().Unix()
+		sledge.From = "Shops/" + sledge.From
+		sledge.To = "Items/" + sledge.To
+
+		ins, err = store.ListAddItem(c.Request().Context(), ctxDB(c), id, sledge)
 
 		if err != nil {
-			if err.Error() == "server error" {
-				return c.JSON(http.StatusInternalServerError, "server error")
-			}
+			return err
 		}
 
 	}
@@ -1512,96 +1009,40 @@ func listAddItem(c echo.Context) error {
 }
 
 func listMoveItem(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get list id and edge key
 	id := c.Param("id")
 	key := c.Param("key")
 
-	//Use id to retrieve ShoppingList name from ShoppingLists
-	s, err := db.getShoppingList(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
-	}
-
 	//Bind body: the _from should contain the id of the new shop
 	var sledge SlistEdge
 	if err := c.Bind(&sledge); err != nil {
-		return c.JSON(http.StatusBadRequest, "Move item: error binding")
-	} else if err == nil {
-
-		sledge.Date = time.Now().Unix()
-		sledge.From = "Shops/" + sledge.From
-		sledge.To = "Items/" + sledge.To
+		return echo.NewHTTPError(http.StatusBadRequest, "Move item: error binding")
 	}
 
-	//Link to Edge Collection
-	dbx, ctx := aranDB(ah, db.db)
-	col, err := dbx.Collection(ctx, s)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+	sledge.normalize()
+	if err := sledge.validate(c.Request().Context(), ctxDB(c)); err != nil {
+		return err
 	}
 
-	//Delete old edge
-	_, err = col.RemoveDocument(ctx, key)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
-	}
+	sledge.Date = time.Now().Unix()
+	sledge.From = "Shops/" + sledge.From
+	sledge.To = "Items/" + sledge.To
 
-	//Insert new edge
-	//Already have db and correct collection
-	meta, err := col.CreateDocument(ctx, sledge)
+	new, err := store.ListMoveItem(c.Request().Context(), ctxDB(c), id, key, sledge)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
-	new := meta.Key
 
 	return c.JSON(http.StatusOK, new)
 
-	//
-
-}
-
-// Edge data, database ref, collection name
-func addToTmpltCore(t TplEdge, dbv, c string) (string, error) {
-
-	t.From = "Shops/" + t.From
-	t.To = "Items/" + t.To
-
-	dbx, ctx := aranDB(ah, dbv)
-	col, err := dbx.Collection(ctx, c)
-	if err != nil {
-		return "", errors.New("server error")
-	}
-
-	meta, err := col.CreateDocument(ctx, t)
-	if err != nil {
-		return "", errors.New("server error")
-	}
-
-	return meta.Key, nil
-
 }
 
 func listAddToTemplate(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get template id
 	id := c.Param("id")
 
 	var tpledge TplEdge
 	var ins string
-	var err2 error
-
-	//Use id to retrieve Template name from Templates
-	s, err := db.getTemplate(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
-	}
 
 	//Add Edge
 	//let d = DATE_NOW() INSERT { _to: "Items/382", _from: "Shops/246", qty: 6} INTO Template20220717001 RETURN NEW
@@ -1609,12 +1050,17 @@ func listAddToTemplate(c echo.Context) error {
 		return err
 	} else if err == nil {
 
-		ins, err2 = addToTmpltCore(tpledge, db.db, s)
+		if err := tpledge.validate(c.Request().Context(), ctxDB(c)); err != nil {
+			return err
+		}
 
-		if err2 != nil {
-			if err2.Error() == "server error" {
-				return c.JSON(http.StatusInternalServerError, "server error")
-			}
+		tpledge.From = "Shops/" + tpledge.From
+		tpledge.To = "Items/" + tpledge.To
+
+		ins, err = store.TemplateAddItem(c.Request().Context(), ctxDB(c), id, tpledge)
+
+		if err != nil {
+			return err
 		}
 
 	}
@@ -1623,87 +1069,52 @@ func listAddToTemplate(c echo.Context) error {
 }
 
 func listTemplateMoveItem(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get template id and edge key
 	id := c.Param("id")
 	key := c.Param("key")
 
-	//Use id to retrieve ShoppingList name from ShoppingLists
-	s, err := db.getTemplate(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
-	}
-
 	//Bind body: the _from should contain the id of the new shop
 	var tpledge TplEdge
 	if err := c.Bind(&tpledge); err != nil {
-		return c.JSON(http.StatusBadRequest, "Move item: error binding")
-	} else if err == nil {
-
-		tpledge.From = "Shops/" + tpledge.From
-		tpledge.To = "Items/" + tpledge.To
+		return echo.NewHTTPError(http.StatusBadRequest, "Move item: error binding")
 	}
 
-	//Link to Edge Collection
-	dbx, ctx := aranDB(ah, db.db)
-	col, err := dbx.Collection(ctx, s)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+	if err := tpledge.validate(c.Request().Context(), ctxDB(c)); err != nil {
+		return err
 	}
 
-	//Delete old edge
-	_, err = col.RemoveDocument(ctx, key)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
-	}
+	tpledge.From = "Shops/" + tpledge.From
+	tpledge.To = "Items/" + tpledge.To
 
-	//Insert new edge
-	//Already have db and correct collection
-	meta, err := col.CreateDocument(ctx, tpledge)
+	new, err := store.TemplateMoveItem(c.Request().Context(), ctxDB(c), id, key, tpledge)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
-	new := meta.Key
 
 	return c.JSON(http.StatusOK, new)
-
-	//
 }
 
 func listUpdateTplItem(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get template id and edge key
 	id := c.Param("id")
 	key := c.Param("key")
 
 	var tpi TplEdgeItem
 	var update string
 
-	s, err := db.getTemplate(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
-	}
-
 	if err := c.Bind(&tpi); err != nil {
 		return err
 	} else if err == nil {
 
 		//Verify qty is more than 0
-		if tpi.Qty != 0 {
-
-			update, err = tpi.patchQueries(s, key, db)
+		if err := tpi.validate(); err != nil {
+			return err
+		}
 
-			if err != nil {
-				//Since data was verified, any error is likely server related?
-				return c.JSON(http.StatusInternalServerError, err)
-			}
+		update, err = store.TemplateUpdateItem(c.Request().Context(), ctxDB(c), id, key, tpi)
 
+		if err != nil {
+			return err
 		}
 
 	}
@@ -1717,155 +1128,211 @@ func listUpdateTplItem(c echo.Context) error {
 *
  DDDDDDD*/
 
-func (db dbase) delTemplate(id string) error {
-
-	//DB query - delete reference to TemplateX in Templates
-	query := "REMOVE @id in Templates"
-
-	//The query will return an empty array. If you want to test or view , replace the _ with a variable
-	_, err := db.getQueries(query, "id", id)
-
-	//Catch error from the query
-	if err != nil {
-		return err
-	}
-
-	return nil
-
-}
-
-// Deleting an item: this should also remove history, i.e. remove the edge docs associated
+// Deleting an item. ?mode= picks what happens to list and template entries using it:
+// restrict (default) refuses while there are any, cascade removes them, soft keeps them
+// (and so the price history) and only hides the item.
 func itemDelete(c echo.Context) error {
 	//Get item id
 	id := c.Param("id")
-	id = "Items/" + id
-
-	//Get all edge docs associated
-	//Uses an http query: https://www.arangodb.com/docs/stable/http/collection-getting.html#reads-all-collections
 
-	//Loop through array, and delete Edge doc where _to is the item
+	mode := c.QueryParam("mode")
+	if mode == "" {
+		mode = delRestrict
+	}
+	if mode != delRestrict && mode != delCascade && mode != delSoft {
+		return echo.NewHTTPError(http.StatusBadRequest, "mode must be restrict, cascade or soft")
+	}
 
-	//Delete the item doc
+	n, err := store.ItemDelete(c.Request().Context(), ctxDB(c), id, mode)
+	if errors.Is(err, errConflict) {
+		return apiErr(http.StatusConflict, err.Error(), d{"edges": n})
+	} else if err != nil {
+		return err
+	}
 
-	return c.JSON(http.StatusOK, "still developing this one... ")
+	return c.JSON(http.StatusOK, d{"id": id, "mode": mode, "edges": n})
 }
 
+// Deleting a shop, e.g. a closed branch. ?mode= picks what happens to list and template
+// entries from it: restrict (default) refuses while there are any, cascade removes them,
+// reassign moves them to shop ?to= first. All or nothing.
 func shopDelete(c echo.Context) error {
-	//Get item id
+	//Get shop id
 	id := c.Param("id")
-	id = "Shops/" + id
+	to := c.QueryParam("to")
 
-	//Get all edge docs associated
-	//Uses an http query: https://www.arangodb.com/docs/stable/http/collection-getting.html#reads-all-collections
+	mode := c.QueryParam("mode")
+	if mode == "" {
+		mode = delRestrict
+	}
+	if mode != delRestrict && mode != delCascade && mode != delReassign {
+		return echo.NewHTTPError(http.StatusBadRequest, "mode must be restrict, cascade or reassign")
+	}
+	if (mode == delReassign) != (to != "") {
+		return echo.NewHTTPError(http.StatusBadRequest, "to is required with, and only with, mode=reassign")
+	}
 
-	//Loop through array, and delete Edge doc where _from is the shop
+	n, err := store.ShopDelete(c.Request().Context(), ctxDB(c), id, mode, to)
+	if errors.Is(err, errConflict) {
+		return apiErr(http.StatusConflict, err.Error(), d{"edges": n})
+	} else if err != nil {
+		return err
+	}
 
-	//Delete the shop doc
+	out := d{"id": id, "mode": mode, "edges": n}
+	if to != "" {
+		out["to"] = to
+	}
 
-	return c.JSON(http.StatusOK, "still developing this one... ")
+	return c.JSON(http.StatusOK, out)
 }
 
 // Removes edge document (shopping list item) from Edge Collection (ShoppngListxyz123)
 func listItemRemove(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get list id and edge key
 	id := c.Param("id")
 	key := c.Param("key")
 
-	//Use id to retrieve ShoppingList name from ShoppingLists
-	s, err := db.getShoppingList(id)
+	rem, err := store.ListRemoveItem(c.Request().Context(), ctxDB(c), id, key)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
-	}
-
-	dbx, ctx := aranDB(ah, db.db)
-	col, err := dbx.Collection(ctx, s)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
-	}
-
-	meta, err := col.RemoveDocument(ctx, key)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
-	rem := meta.Key
-
 	return c.JSON(http.StatusOK, rem)
 }
 
 func listTemplateItemRemove(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
-	//Get item id
+	//Get template id and edge key
 	id := c.Param("id")
 	key := c.Param("key")
 
-	//Use id to retrieve Template name from Templates
-	s, err := db.getTemplate(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
-	}
-
-	dbx, ctx := aranDB(ah, db.db)
-	col, err := dbx.Collection(ctx, s)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
-	}
-
-	meta, err := col.RemoveDocument(ctx, key)
+	rem, err := store.TemplateRemoveItem(c.Request().Context(), ctxDB(c), id, key)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err)
+		return err
 	}
 
-	rem := meta.Key
-
 	return c.JSON(http.StatusOK, rem)
 }
 
 func listRemoveTemplate(c echo.Context) error {
-	//Get db from context, convert from interface to string
-	dbv := fmt.Sprintf("%v", c.Request().Context().Value("db"))
-	db := dbase{dbv}
-
 	//Get template id
 	id := c.Param("id")
 
-	//Use id to retrieve Template name from Templates
-	s, err := db.getTemplate(id)
+	err := store.TemplateRemove(c.Request().Context(), ctxDB(c), id)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, "invalid id")
+		return err
 	}
 
-	dbx, ctx := aranDB(ah, db.db)
+	return c.JSON(http.StatusOK, c.Param("id"))
 
-	//Remove TemplateX collection
-	col, err := dbx.Collection(ctx, s)
-	if err != nil {
-		fmt.Println("Error0 deleting", err)
-		return c.JSON(http.StatusInternalServerError, err)
-	}
+}
 
-	err = col.Remove(ctx)
-	if err != nil {
-		fmt.Println("Error1 deleting", err)
-		return c.JSON(http.StatusInternalServerError, err)
-	}
+// Every route of the API, with the scope each needs
+func routes(e *echo.Echo) {
+	//Every route names the scope it needs, see scope.go
+	readItems, writeItems := needScope(scopeReadItems), needScope(scopeWriteItems)
+	readShops, writeShops := needScope(scopeReadShops), needScope(scopeWriteShops)
+	readLists, writeLists := needScope(scopeReadLists), needScope(scopeWriteLists)
+	readKeys, writeKeys := needScope(scopeReadKeys), needScope(scopeWriteKeys)
+	adminUsers, adminSystem := needAdmin(scopeAdminUsers), needAdmin(scopeAdminSystem)
 
-	//Remove document from Templates collection
-	err = db.delTemplate(id)
-	if err != nil {
-		fmt.Println("Error2 deleting", err)
-		return c.JSON(http.StatusInternalServerError, err)
-	}
+	// Router 1 - ITEMS
+	r1 := e.Group("/items", middleUser)
+	r1.GET("/view/:id", itemGetSpecific, readItems)
+	r1.GET("/all", itemGetAll, readItems)
+	r1.GET("/like/:part", itemGetLike, readItems)
+	r1.POST("/new", itemCreate, writeItems)
+	r1.PATCH("/update/:id", itemEdit, writeItems)
+	r1.DELETE("/delete/:id", itemDelete, writeItems)
 
-	return c.JSON(http.StatusOK, c.Param("id"))
+	// Router 2 - SHOPS
+	r2 := e.Group("/shops", middleUser)
+	r2.GET("/view/:id", shopGetSpecific, readShops)
+	r2.GET("/all", shopGetAll, readShops)
+	r2.GET("/like/:part", shopGetLike, readShops)
+	r2.POST("/new", shopCreate, writeShops)
+	r2.PATCH("/update/:id", shopEdit, writeShops)
+	r2.DELETE("/delete/:id", shopDelete, writeShops)
+
+	//Router 3
+	r3 := e.Group("/shoppinglist", middleUser)
+
+	//Shopping List, Trolley
+	r3.GET("/allvisible", listGetVisible, readLists)
+	r3.GET("/all", listGetAll, readLists)
+	r3.GET("/view/:id", listGetShopping, readLists)
+	r3.GET("/trolley/:id/:key", listGetTrolley, readLists)
+	r3.GET("/totals/:id", listGetTotals, readLists) //?in= to convert, see totals.go
+	r3.GET("/name/:id", listGetName, readLists)
+	r3.POST("/new", listCreate, writeLists)
+	r3.POST("/make/:id", listMake, writeLists) //new based on Template id
+	r3.PATCH("/hide/:id", listSetHidden, writeLists)
+	r3.PATCH("/edit/:id", listEdit, writeLists)
+	r3.PATCH("/trolley/:id/:key", listSetTrolley, writeLists)
+	r3.PATCH("/additem/:id", listAddItem, writeLists)
+	r3.PATCH("/moveitem/:id/:key", listMoveItem, writeLists)
+	r3.DELETE("/delete/item/:id/:key", listItemRemove, writeLists)
+
+	//Shopping list Templates
+	r3.GET("/templates", listGetTemplates, readLists)
+	r3.GET("/templates/details/:id", listTemplateDetails, readLists)
+	r3.GET("/templates/name/:id", listTemplateName, readLists)
+	r3.POST("/templates", listCreateTemplate, writeLists)
+	r3.POST("/templates/:id", listMakeTemplate, writeLists) //new based on ShoppingList id
+	r3.POST("/templates/enable", listEnableTemplates, writeLists)
+	r3.PATCH("/templates/:id", listTemplateEdit, writeLists)          //edit template - temnplate name, date
+	r3.PATCH("/templates/details/:id", listAddToTemplate, writeLists) //edit template - add item to template
+	r3.PATCH("/templates/moveitem/:id/:key", listTemplateMoveItem, writeLists)
+	r3.PATCH("/templates/details/:id/:key", listUpdateTplItem, writeLists)       //edit template - edit individual item within template
+	r3.DELETE("/templates/details/:id/:key", listTemplateItemRemove, writeLists) //edit template - remove item from template
+	r3.DELETE("/templates/:id", listRemoveTemplate, writeLists)                  //delete template - delete edge and entry in Templates
+	/*
+
+		r3.DELETE("/templates/:id", listRemoveTemplate) 	//delete template...or rather hide? Delete edge and enrty in Templates
+
+	*/
+
+	//Router 4 - SHOPPINGlist, Trolley
+	r4 := e.Group("/trend", middleUser)
+	r4.GET("/item/:id", trendGetItem, readLists) //Note: This returns a sorted array (highest to lowest date), top 10 results.
+	r4.GET("/item/:id/history", trendGetHistory, readLists)
 
+	//Router 5 - API keys of the calling user, see apikey.go
+	r5 := e.Group("/keys", middleUser)
+	r5.GET("", keyGetAll, readKeys)
+	r5.POST("", keyCreate, writeKeys)
+	r5.DELETE("/:id", keyRevoke, writeKeys)
+
+	//Admin routes need both the admin role and an admin:* scope, see needAdmin
+	r6 := e.Group("/admin", middleAdmin)
+	r6.GET("/maybe", adminMaybe)
+	r6.GET("/health", adminHealth, adminSystem)
+	r6.GET("/cache", adminCacheStats, adminSystem)
+	r6.DELETE("/cache", adminCacheInvalidate, adminSystem)
+	r6.DELETE("/cache/:email", adminCacheInvalidate, adminSystem)
+	r6.GET("/users", adminGetUsers, adminUsers)
+	r6.POST("/users", adminCreateUser, adminUsers)
+	r6.DELETE("/users/:email", adminDeleteUser, adminUsers)
+	r6.PATCH("/users/:email/role", adminSetRole, adminUsers)
+	r6.GET("/audit", adminGetAudit, adminUsers)
+	r6.GET("/schema", adminGetSchema, adminSystem)
+	r6.POST("/schema/migrate", adminMigrate, adminSystem)
+
+	//Router 7 - price comparison across shops, see compare.go
+	r7 := e.Group("/compare", middleUser)
+	r7.GET("/item/:id", compareGetItem, readLists)
+
+	//Router 8 - exchange rates for list totals, see totals.go
+	r8 := e.Group("/rates", middleUser)
+	r8.GET("", rateGetAll, readLists)
+	r8.PUT("/:from/:to", rateSet, writeLists)
+	r8.DELETE("/:from/:to", rateDelete, writeLists)
+
+	//Resource oriented API, see v2.go. The routes above are kept for existing clients.
+	v2Routes(e)
+
+	//Spec of every route above. TestRoutesDocumented fails on an undocumented route.
+	e.GET("/openapi.json", openAPIHandler)
 }
 
 /* !!!!!!!!!!!!!!
@@ -1874,15 +1341,65 @@ func listRemoveTemplate(c echo.Context) error {
  */
 func main() {
 
+	//Settings: -config file (or CONFIG_FILE), overridden by env. See config.go
+	path := flag.String("config", os.Getenv("CONFIG_FILE"), "path to JSON config file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	conf = cfg
+
+	//Storage backend: "arango" or "memory" for running without ArangoDB
+	s, err := newStore(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	store = s
+
+	//Token validators, one set per issuer. See auth.go
+	a, err := newAuth(conf.Auth.providers())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	auth = a
+	userInfo = newUserInfoClient(conf.Auth.UserInfo)
+
+	//User cache: entries live for cache.ttl, at most cache.size are kept
+	cache = newUserCache(time.Duration(conf.Cache.TTL), conf.Cache.Size)
+
+	//Bring every tenant database to the latest schema, see migrate.go
+	if conf.MigrateOnStart {
+		if _, err := migrateAll(context.Background()); err != nil {
+			fmt.Println("Migrate:", err)
+		}
+	}
+
+	//First admin, e.g. for a fresh install or the in-memory store
+	if conf.BootstrapAdmin != "" {
+		if err := bootstrapAdmin(context.Background(), conf.BootstrapAdmin); err != nil {
+			fmt.Fprintln(os.Stderr, "Bootstrap admin:", err)
+			os.Exit(1)
+		}
+	}
+
 	// Echo instance
 	e := echo.New()
 
+	//Every error leaves in the same JSON shape, see errors.go
+	e.HTTPErrorHandler = httpError
+
 	// Middleware
+	e.Use(middleware.RequestID()) //X-Request-ID, echoed in error bodies
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"}, //Can be *. localhost != 127.0.0.1 when evaluated.
+		AllowOrigins: conf.CORS, //Can be *. localhost != 127.0.0.1 when evaluated.
 		AllowMethods: []string{echo.GET, echo.PUT, echo.POST, echo.PATCH, echo.DELETE},
 	}))
 
@@ -1893,74 +1410,12 @@ func main() {
 	e.Use(middleJWT)
 
 	// Routes
+	routes(e)
+	apiSpec = openAPISpec(e.Routes())
 
-	// Router 1 - ITEMS
-	r1 := e.Group("/items", middleUser)
-	r1.GET("/view/:id", itemGetSpecific)
-	r1.GET("/all", itemGetAll)
-	r1.GET("/like/:part", itemGetLike)
-	r1.POST("/new", itemCreate)
-	r1.PATCH("/update/:id", itemEdit)
-	r1.DELETE("delete/:id", itemDelete)
-
-	// Router 2 - SHOPS
-	r2 := e.Group("/shops", middleUser)
-	r2.GET("/view/:id", shopGetSpecific)
-	r2.GET("/all", shopGetAll)
-	r2.GET("/like/:part", shopGetLike)
-	r2.POST("/new", shopCreate)
-	r2.PATCH("/update/:id", shopEdit)
-	r2.DELETE("delete/:id", shopDelete)
-
-	//Router 3
-	r3 := e.Group("/shoppinglist", middleUser)
-
-	//Shopping List, Trolley
-	r3.GET("/allvisible", listGetVisible)
-	r3.GET("/all", listGetAll)
-	r3.GET("/view/:id", listGetShopping)
-	r3.GET("/trolley/:id/:key", listGetTrolley)
-	r3.GET("/name/:id", listGetName)
-	r3.POST("/new", listCreate)
-	r3.POST("/make/:id", listMake) //new based on Template id
-	r3.PATCH("/hide/:id", listSetHidden)
-	r3.PATCH("/edit/:id", listEdit)
-	r3.PATCH("/trolley/:id/:key", listSetTrolley)
-	r3.PATCH("/additem/:id", listAddItem)
-	r3.PATCH("/moveitem/:id/:key", listMoveItem)
-	r3.DELETE("/delete/item/:id/:key", listItemRemove)
-
-	//Shopping list Templates
-	r3.GET("/templates", listGetTemplates)
-	r3.GET("/templates/details/:id", listTemplateDetails)
-	r3.GET("/templates/name/:id", listTemplateName)
-	r3.POST("/templates", listCreateTemplate)
-	r3.POST("/templates/:id", listMakeTemplate) //new based on ShoppingList id
-	r3.POST("/templates/enable", listEnableTemplates)
-	r3.PATCH("/templates/:id", listTemplateEdit)          //edit template - temnplate name, date
-	r3.PATCH("/templates/details/:id", listAddToTemplate) //edit template - add item to template
-	r3.PATCH("/templates/moveitem/:id/:key", listTemplateMoveItem)
-	r3.PATCH("/templates/details/:id/:key", listUpdateTplItem)       //edit template - edit individual item within template
-	r3.DELETE("/templates/details/:id/:key", listTemplateItemRemove) //edit template - remove item from template
-	r3.DELETE("/templates/:id", listRemoveTemplate)                  //delete template - delete edge and entry in Templates
-	/*
-
-		r3.DELETE("/templates/:id", listRemoveTemplate) 	//delete template...or rather hide? Delete edge and enrty in Templates
-
-	*/
-
-	//Router 4 - SHOPPINGlist, Trolley
-	r4 := e.Group("/trend", middleUser)
-	r4.GET("/item/:id", trendGetItem) //Note: This returns a sorted array (highest to lowest date), top 10 results.
-
-	//Each method here must verify cache[sub].role == admin !!!!!
-	r6 := e.Group("/admin", middleAdmin)
-	r6.GET("/maybe", adminMaybe)
-	r6.GET("/users", adminGetUsers)
-	r6.POST("/users", adminCreateUser)
-	//DELETE user (drop DB, remove from _system/users)
-	//Setting as admin currently only possible by logging into container and running this query:
-
-	e.Logger.Fatal(e.Start(":4000"))
+	if conf.TLS.Cert != "" {
+		e.Logger.Fatal(e.StartTLS(conf.Listen, conf.TLS.Cert, conf.TLS.Key))
+	}
+	e.Logger.Fatal(e.Start(conf.Listen))
 
 }
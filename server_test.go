@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A tenant in a fresh in-memory store, which becomes the store handlers use
+func newTestTenant(t *testing.T) string {
+	t.Helper()
+
+	m := newMemStore()
+	store = m
+
+	dbv, _, err := m.UserCreate(context.Background(), UserNew{Email: "t@x.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dbv
+}
+
+// Runs h on a JSON body as a request of the owner of tenant dbv, errors answered as
+// httpError would. params are path parameter names and values in turn.
+func callHandler(h echo.HandlerFunc, method, body, dbv string, params ...string) *httptest.ResponseRecorder {
+	e := echo.New()
+
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req = req.WithContext(context.WithValue(req.Context(), "db", dbv))
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	var names, values []string
+	for n := 0; n+1 < len(params); n += 2 {
+		names, values = append(names, params[n]), append(values, params[n+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+
+	if err := h(c); err != nil {
+		httpError(err, c)
+	}
+
+	return rec
+}
+
+// A list made from a template with one entry, and that entry's key. The entry has no
+// price or currency yet.
+func newTemplateList(t *testing.T, dbv string) (string, string) {
+	t.Helper()
+	ctx := context.Background()
+
+	item, err := store.ItemCreate(ctx, dbv, ItemNew{Name: "flour", Nett: 1, Ntt_un: "kg", Brand: "snowflake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shop, err := store.ShopCreate(ctx, dbv, ShopNew{Name: "spar", Branch: "maerua", City: "windhoek", Country: "namibia"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.TemplatesEnable(ctx, dbv); err != nil {
+		t.Fatal(err)
+	}
+	tpl, err := store.TemplateCreate(ctx, dbv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.TemplateAddItem(ctx, dbv, tpl.Id, TplEdge{"Items/" + item, "Shops/" + shop, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := listFromTemplate(ctx, dbv, tpl.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l.Id, entryOf(t, dbv, l.Id, "").Edge_id
+}
+
+// Entry key of list id, or its only entry when key is ""
+func entryOf(t *testing.T, dbv, id, key string) SListItems {
+	t.Helper()
+
+	sl, err := store.ListView(context.Background(), dbv, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sl {
+		for _, e := range s.Items {
+			if key == "" || e.Edge_id == key {
+				return e
+			}
+		}
+	}
+	t.Fatalf("list %s has no entry %q", id, key)
+
+	return SListItems{}
+}
+
+func TestListSetTrolleyFromTemplate(t *testing.T) {
+	dbv := newTestTenant(t)
+	id, key := newTemplateList(t, dbv)
+
+	rec := callHandler(listSetTrolley, http.MethodPatch, `{"trolley": true, "qty": 2}`, dbv, "id", id, "key", key)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH trolley = %d %s, want 200", rec.Code, rec.Body)
+	}
+	if e := entryOf(t, dbv, id, key); !e.Trolley {
+		t.Error("entry not in the trolley")
+	}
+
+	//A currency, once given, is still checked
+	rec = callHandler(listSetTrolley, http.MethodPatch, `{"trolley": true, "qty": 2, "currency": "XYZ"}`, dbv, "id", id, "key", key)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("PATCH with currency XYZ = %d, want 422", rec.Code)
+	}
+}
+
+// New users are always plain users, so a role in the body is refused rather than ignored
+func TestAdminCreateUserRole(t *testing.T) {
+	store = newMemStore()
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"email": "a@x.io", "role": "admin"}`, http.StatusUnprocessableEntity},
+		{`{"email": "a@x.io"}`, http.StatusCreated},
+		{`{"email": "a@x.io", "role": "user"}`, http.StatusOK}, //Already there
+	}
+
+	for _, tt := range tests {
+		if rec := callHandler(adminCreateUser, http.MethodPost, tt.body, ""); rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.body, rec.Code, tt.status, rec.Body)
+		}
+	}
+
+	if u, err := store.UserGet(context.Background(), "a@x.io"); err != nil || u.role != roleUser {
+		t.Errorf("UserGet = %+v, %v, want role user", u, err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+/*
+ * STORAGE INTERFACE
+ * Handlers only talk to the Store. The ArangoDB backend (store_arango.go) is the
+ * production store, the in-memory backend (store_memory.go) is for local runs and tests.
+ *
+ * Conventions:
+ *  - db is the tenant database name as found in the request context ("db")
+ *  - Edges are passed with full ids, i.e. _from "Shops/123" and _to "Items/456"
+ *  - Lists and templates are referenced by their key in ShoppingLists/Templates
+ *  - Errors are *storeError (see errors.go)
+ */
+type Store interface {
+	//Items
+	ItemGet(ctx context.Context, db, id string) (Item, error)
+	ItemAll(ctx context.Context, db string) ([]Item, error)
+	ItemLike(ctx context.Context, db, part string) ([]Item, error)
+	ItemCreate(ctx context.Context, db string, i ItemNew) (string, error)
+	ItemUpdate(ctx context.Context, db, id string, i ItemNew) (string, error)
+	ItemDelete(ctx context.Context, db, id, mode string) (int, error) //Number of list/template entries affected
+
+	//Shops
+	ShopGet(ctx context.Context, db, id string) (Shop, error)
+	ShopAll(ctx context.Context, db string) ([]Shop, error)
+	ShopLike(ctx context.Context, db, part string) ([]Shop, error)
+	ShopCreate(ctx context.Context, db string, s ShopNew) (string, error)
+	ShopUpdate(ctx context.Context, db, id string, s ShopNew) (string, error)
+	ShopDelete(ctx context.Context, db, id, mode, to string) (int, error) //to: target shop for delReassign
+
+	//Shopping lists
+	ListAll(ctx context.Context, db string, visibleOnly bool) ([]ShopListsAll, error)
+	ListLabel(ctx context.Context, db, id string) (string, error)
+	ListCreate(ctx context.Context, db string) (ShopListsAll, error)
+	ListUpdate(ctx context.Context, db, id string, l ShopListsAll) (string, error)
+	ListView(ctx context.Context, db, id string) ([]SList, error)
+	ListTrolley(ctx context.Context, db, id, shop string) ([]SListItems, error)
+	ListAddItem(ctx context.Context, db, id string, e SlistEdge) (string, error)
+	ListUpdateItem(ctx context.Context, db, id, key string, e SlistEdgeItem) (string, error)
+	ListMoveItem(ctx context.Context, db, id, key string, e SlistEdge) (string, error)
+	ListRemoveItem(ctx context.Context, db, id, key string) (string, error)
+
+	//Templates
+	TemplatesEnable(ctx context.Context, db string) error
+	TemplateAll(ctx context.Context, db string) ([]ShopListsAll, error)
+	TemplateLabel(ctx context.Context, db, id string) (string, error)
+	TemplateCreate(ctx context.Context, db string) (ShopListsAll, error)
+	TemplateUpdate(ctx context.Context, db, id string, l ShopListsAll) (string, error)
+	TemplateView(ctx context.Context, db, id string) ([]Tpl, error)
+	TemplateAddItem(ctx context.Context, db, id string, e TplEdge) (string, error)
+	TemplateUpdateItem(ctx context.Context, db, id, key string, e TplEdgeItem) (string, error)
+	TemplateMoveItem(ctx context.Context, db, id, key string, e TplEdge) (string, error)
+	TemplateRemoveItem(ctx context.Context, db, id, key string) (string, error)
+	TemplateRemove(ctx context.Context, db, id string) error
+
+	//Trends
+	PriceHistory(ctx context.Context, db, id string, f PriceFilter) (PriceHistory, error) //Priced shopping list entries only
+
+	//Exchange rates, see totals.go
+	RateAll(ctx context.Context, db string) ([]Rate, error)
+	RateSet(ctx context.Context, db string, r Rate) error //Adds or replaces the from-to pair
+	RateDelete(ctx context.Context, db, from, to string) error
+
+	//Users (held in _system)
+	UserGet(ctx context.Context, email string) (user, error)
+	UserAll(ctx context.Context) ([]UserNew, error)
+	UserCreate(ctx context.Context, u UserNew) (string, bool, error)     //Idempotent, reports whether the user was new
+	UserDelete(ctx context.Context, email string) (user, error)          //Drops the tenant db and the user's API keys
+	UserSetRole(ctx context.Context, email, role string) (string, error) //Returns the old role
+
+	//API keys (held in _system), see apikey.go
+	KeyCreate(ctx context.Context, k ApiKey) error
+	KeyGet(ctx context.Context, id string) (ApiKey, error)
+	KeyAll(ctx context.Context, email string) ([]ApiKey, error)
+	KeyRevoke(ctx context.Context, email, id string) error //notFound unless the key is email's
+
+	//Tenant schema, see migrate.go
+	TenantDBs(ctx context.Context) ([]string, error)
+	SchemaVersion(ctx context.Context, db string) (int, error)
+	SchemaMigrate(ctx context.Context, db string) (int, int, error) //Version before and after
+
+	//Audit trail (held in _system), see audit.go
+	AuditAdd(ctx context.Context, a AuditEntry) error
+	AuditAll(ctx context.Context, limit int) ([]AuditEntry, error) //Newest first
+}
+
+// User roles
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// Returned (as a conflict) when a change would leave no admin
+var errLastAdmin = conflict("last admin cannot be removed or demoted")
+
+// Item and shop delete modes, see ItemDelete and ShopDelete
+const (
+	delRestrict = "restrict" //Refuse (conflict) while any list or template uses the item/shop
+	delCascade  = "cascade"  //Remove those entries along with the item/shop
+	delSoft     = "soft"     //Items only: hide the item but keep the entries, and with them its price history
+	delReassign = "reassign" //Shops only: move the entries to another shop first
+)
+
+// Active store, set in main()
+var store Store
+
+// Select backend from the config. Config is validated in loadConfig.
+func newStore(cfg Config) (Store, error) {
+	switch cfg.Store {
+	case "arango":
+		a := cfg.Arango
+		p, err := newAranPool(a.Endpoints, a.User, a.Password, aranLimits{a.ConnLimit, a.IdleConns, time.Duration(a.IdleTimeout)})
+		if err != nil {
+			return nil, err
+		}
+		pool = p
+
+		//Health is checked in the background, see /admin/health
+		go pool.watch(context.Background(), time.Duration(a.HealthInterval))
+
+		return aranStore{}, nil
+	case "memory":
+		return newMemStore(), nil
+	}
+
+	return nil, fmt.Errorf("unknown store backend %q", cfg.Store)
+}
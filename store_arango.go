@@ -0,0 +1,1016 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+ * ARANGODB STORE
+ * Implements Store using the AQL queries that used to live in the handlers.
+ */
+type aranStore struct{}
+
+// Simple db type for methods
+type dbase struct {
+	db string
+}
+
+// Common function to run queries: q with bind variables on db, results decoded into T
+func dbQuery[T any](ctx context.Context, db dbase, q string, bind d) ([]T, error) {
+	dbx, err := aranDB(ctx, db.db)
+	if err != nil {
+		return nil, err
+	}
+
+	return queryAll[T](aranQuery{q: q, bind: bind, db: dbx, ctx: ctx})
+}
+
+// As dbQuery, but streaming results in batches of n
+func dbIter[T any](ctx context.Context, db dbase, q string, bind d, n int) (*cursorIter[T], error) {
+	dbx, err := aranDB(ctx, db.db)
+	if err != nil {
+		return nil, err
+	}
+
+	return queryIter[T](aranQuery{q, bind, dbx, ctx, n})
+}
+
+// Batch size for list entries, of which a list or shop can have many
+const entryBatch = 500
+
+// Stream the results of q through fn, entryBatch at a time. Stops at the first error.
+func dbEach[T any](ctx context.Context, db dbase, q string, bind d, fn func(T) error) error {
+	it, err := dbIter[T](ctx, db, q, bind, entryBatch)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		if err := fn(it.Value()); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+// Number of results of q, without holding them
+func dbCount(ctx context.Context, db dbase, q string, bind d) (int, error) {
+	n := 0
+	err := dbEach(ctx, db, q, bind, func(int) error {
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// Document id of list id in ShoppingLists/Templates (c). Its entries in ListEntries
+// carry it as list.
+func (db dbase) listID(ctx context.Context, c, id string) (string, error) {
+	query := "FOR a in " + c + " FILTER a._key == @id RETURN a._id"
+
+	listQ, err := dbQuery[string](ctx, db, query, d{"id": id})
+	if err != nil {
+		return "", err
+	}
+
+	if listQ == nil {
+		return "", notFound("get " + c + "/" + id)
+	}
+
+	return listQ[0], nil
+}
+
+func (db dbase) delTemplate(ctx context.Context, id string) error {
+
+	//DB query - delete reference to TemplateX in Templates
+	query := "REMOVE @id in Templates"
+
+	//The query will return an empty array. If you want to test or view , replace the _ with a variable
+	_, err := dbQuery[d](ctx, db, query, d{"id": id})
+
+	return err
+
+}
+
+/*
+ * Insert / update helpers
+ */
+
+// c for collection name
+func (db dbase) insert(ctx context.Context, c string, doc interface{}) (string, error) {
+	dbx, err := aranDB(ctx, db.db)
+	if err != nil {
+		return "", err
+	}
+
+	return aranInsert{c, doc, dbx, ctx}.aranIns()
+}
+
+// c for collection name, k for document key
+func (db dbase) update(ctx context.Context, c, k string, patch interface{}) (string, error) {
+	dbx, err := aranDB(ctx, db.db)
+	if err != nil {
+		return "", err
+	}
+
+	return aranUpdate{c, k, patch, dbx, ctx}.aranUp()
+}
+
+// As insert, but creates collection c first if it doesn't exist yet
+func (db dbase) insertCreate(ctx context.Context, c string, doc interface{}) (string, error) {
+	k, err := db.insert(ctx, c, doc)
+	if !errors.Is(err, errNotFound) {
+		return k, err
+	}
+
+	if _, err := db.colCreate(ctx, c); err != nil && !errors.Is(err, errConflict) {
+		return "", err
+	}
+
+	return db.insert(ctx, c, doc)
+}
+
+/*
+ * List and template entries, all in the ListEntries edge collection
+ */
+
+// Insert entry doc (SlistEdge or TplEdge) into list, a ShoppingLists/Templates document id
+func (db dbase) entryAdd(ctx context.Context, list string, doc interface{}) (string, error) {
+	query := "INSERT MERGE(@doc, {list: @list}) INTO ListEntries RETURN NEW._key"
+
+	execQ, err := dbQuery[string](ctx, db, query, d{"doc": doc, "list": list})
+	if err != nil {
+		return "", err
+	}
+
+	return execQ[0], nil
+}
+
+// Can update entry contents, but not its list, _from or _to
+func (db dbase) entryUpdate(ctx context.Context, list, key string, patch interface{}) (string, error) {
+	query := "FOR e IN ListEntries FILTER e._key == @key AND e.list == @list UPDATE e WITH @patch IN ListEntries RETURN NEW._key"
+
+	execQ, err := dbQuery[string](ctx, db, query, d{"key": key, "list": list, "patch": patch})
+	if err != nil {
+		return "", err
+	}
+
+	if execQ == nil {
+		return "", notFound("update entry " + key + " of " + list)
+	}
+
+	return execQ[0], nil
+}
+
+// Remove entry key of list and, if doc is not nil, insert doc in its place.
+func (db dbase) entryReplace(ctx context.Context, list, key string, doc interface{}) (string, error) {
+	out := key
+
+	err := db.inTx(ctx, []string{"ListEntries"}, func(ctx context.Context) error {
+		//Delete old entry
+		query := "FOR e IN ListEntries FILTER e._key == @key AND e.list == @list REMOVE e IN ListEntries RETURN OLD._key"
+		old, err := dbQuery[string](ctx, db, query, d{"key": key, "list": list})
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return notFound("remove entry " + key + " of " + list)
+		}
+
+		if doc == nil {
+			return nil
+		}
+
+		//Insert new entry
+		out, err = db.entryAdd(ctx, list, doc)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return out, nil
+}
+
+/*
+ * ITEMS
+ */
+
+const aqlItem = "{ 'id': item._key, 'name': item.name, 'nett': item.nett, 'nett_unit': item.nett_unit, 'brand': item.brand }"
+
+func (aranStore) ItemGet(ctx context.Context, dbv, id string) (Item, error) {
+	query := "FOR item IN Items FILTER item._id == @itemID AND !item.deleted RETURN " + aqlItem
+	execQ, err := dbQuery[Item](ctx, dbase{dbv}, query, d{"itemID": "Items/" + id})
+	if err != nil {
+		return Item{}, err
+	}
+
+	//Blank data returned indicates request was for a non-existent id
+	if execQ == nil {
+		return Item{}, notFound("get item " + id)
+	}
+
+	return execQ[0], nil
+}
+
+func (aranStore) ItemAll(ctx context.Context, dbv string) ([]Item, error) {
+	query := "FOR item IN Items FILTER !item.deleted RETURN " + aqlItem
+	return dbQuery[Item](ctx, dbase{dbv}, query, nil)
+}
+
+// TODO: LIKE() with caseInsensitive. https://www.arangodb.com/docs/3.9/aql/functions-string.html#like
+func (aranStore) ItemLike(ctx context.Context, dbv, part string) ([]Item, error) {
+	query := "FOR item IN Items FILTER item.name LIKE @find AND !item.deleted RETURN " + aqlItem
+	return dbQuery[Item](ctx, dbase{dbv}, query, d{"find": "%" + part + "%"})
+}
+
+func (aranStore) ItemCreate(ctx context.Context, dbv string, i ItemNew) (string, error) {
+	return dbase{dbv}.insert(ctx, "Items", i)
+}
+
+func (aranStore) ItemUpdate(ctx context.Context, dbv, id string, i ItemNew) (string, error) {
+	return dbase{dbv}.update(ctx, "Items", id, i)
+}
+
+// Removes the item, or with delSoft flags it as deleted, along with (or after counting)
+// its list and template entries in one transaction
+func (st aranStore) ItemDelete(ctx context.Context, dbv, id, mode string) (int, error) {
+	db := dbase{dbv}
+
+	if mode != delRestrict && mode != delCascade && mode != delSoft {
+		return 0, &storeError{errBadQuery, "delete item " + id + ": unknown mode " + mode, nil}
+	}
+	if _, err := st.ItemGet(ctx, dbv, id); err != nil {
+		return 0, err
+	}
+
+	//Count (or remove) the entries pointing at the item
+	edgeQ := "FOR e IN ListEntries FILTER e._to == @to RETURN 1"
+	if mode == delCascade {
+		edgeQ = "FOR e IN ListEntries FILTER e._to == @to REMOVE e IN ListEntries RETURN 1"
+	}
+
+	n := 0
+	err := db.inTx(ctx, []string{"ListEntries", "Items"}, func(ctx context.Context) error {
+		var err error
+		if n, err = dbCount(ctx, db, edgeQ, d{"to": "Items/" + id}); err != nil {
+			return err
+		}
+
+		switch mode {
+		case delRestrict:
+			if n > 0 {
+				return conflict(fmt.Sprintf("delete item %s: used by %d list entries", id, n))
+			}
+			fallthrough
+		case delCascade:
+			_, err := dbQuery[d](ctx, db, "REMOVE @key IN Items", d{"key": id})
+			return err
+		case delSoft:
+			_, err := dbQuery[d](ctx, db, "UPDATE @key WITH {deleted: true, deleted_at: @now} IN Items", d{"key": id, "now": time.Now().Unix()})
+			return err
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+/*
+ * SHOPS
+ */
+
+const aqlShop = "{ 'id': shop._key, 'name': shop.name, 'branch': shop.branch, 'city': shop.city, 'country': shop.country }"
+
+func (aranStore) ShopGet(ctx context.Context, dbv, id string) (Shop, error) {
+	query := "FOR shop IN Shops FILTER shop._id == @shopID RETURN " + aqlShop
+	execQ, err := dbQuery[Shop](ctx, dbase{dbv}, query, d{"shopID": "Shops/" + id})
+	if err != nil {
+		return Shop{}, err
+	}
+
+	//Blank data returned indicates request was for a non-existent id
+	if execQ == nil {
+		return Shop{}, notFound("get shop " + id)
+	}
+
+	return execQ[0], nil
+}
+
+func (aranStore) ShopAll(ctx context.Context, dbv string) ([]Shop, error) {
+	query := "FOR shop IN Shops RETURN " + aqlShop
+	return dbQuery[Shop](ctx, dbase{dbv}, query, nil)
+}
+
+func (aranStore) ShopLike(ctx context.Context, dbv, part string) ([]Shop, error) {
+	query := "FOR shop IN Shops FILTER shop.name LIKE @find RETURN " + aqlShop
+	return dbQuery[Shop](ctx, dbase{dbv}, query, d{"find": "%" + part + "%"})
+}
+
+func (aranStore) ShopCreate(ctx context.Context, dbv string, s ShopNew) (string, error) {
+	return dbase{dbv}.insert(ctx, "Shops", s)
+}
+
+func (aranStore) ShopUpdate(ctx context.Context, dbv, id string, s ShopNew) (string, error) {
+	return dbase{dbv}.update(ctx, "Shops", id, s)
+}
+
+// Removes the shop and, depending on mode, its list and template entries in one
+// transaction. With delReassign its entries are first moved to shop to.
+func (st aranStore) ShopDelete(ctx context.Context, dbv, id, mode, to string) (int, error) {
+	db := dbase{dbv}
+
+	if mode != delRestrict && mode != delCascade && mode != delReassign {
+		return 0, &storeError{errBadQuery, "delete shop " + id + ": unknown mode " + mode, nil}
+	}
+	if _, err := st.ShopGet(ctx, dbv, id); err != nil {
+		return 0, err
+	}
+	if mode == delReassign {
+		if to == id {
+			return 0, &storeError{errBadQuery, "delete shop " + id + ": cannot reassign to itself", nil}
+		}
+		if _, err := st.ShopGet(ctx, dbv, to); err != nil {
+			return 0, err
+		}
+	}
+
+	//Count, remove or reassign the entries bought at the shop
+	edgeQ := "FOR e IN ListEntries FILTER e._from == @from RETURN 1"
+	bind := d{"from": "Shops/" + id}
+	switch mode {
+	case delCascade:
+		edgeQ = "FOR e IN ListEntries FILTER e._from == @from REMOVE e IN ListEntries RETURN 1"
+	case delReassign:
+		edgeQ = "FOR e IN ListEntries FILTER e._from == @from UPDATE e WITH {_from: @to} IN ListEntries RETURN 1"
+		bind["to"] = "Shops/" + to
+	}
+
+	n := 0
+	err := db.inTx(ctx, []string{"ListEntries", "Shops"}, func(ctx context.Context) error {
+		var err error
+		if n, err = dbCount(ctx, db, edgeQ, bind); err != nil {
+			return err
+		}
+
+		if mode == delRestrict && n > 0 {
+			return conflict(fmt.Sprintf("delete shop %s: used by %d list entries", id, n))
+		}
+
+		_, err = dbQuery[d](ctx, db, "REMOVE @key IN Shops", d{"key": id})
+		return err
+	})
+
+	return n, err
+}
+
+/*
+ * SHOPPING LISTS
+ */
+
+func (aranStore) ListAll(ctx context.Context, dbv string, visibleOnly bool) ([]ShopListsAll, error) {
+	query := "FOR list in ShoppingLists RETURN {'name': list.name, 'date': list.date, 'hidden': list.hidden, 'id': list._key, 'label': list.label}"
+	if visibleOnly {
+		query = "FOR list in ShoppingLists FILTER list.hidden == false RETURN {'name': list.name, 'date': list.date, 'id': list._key, 'label': list.label}"
+	}
+
+	return dbQuery[ShopListsAll](ctx, dbase{dbv}, query, nil)
+}
+
+// Label of document id in ShoppingLists/Templates (c)
+func (db dbase) label(ctx context.Context, c, id string) (string, error) {
+	//Lists without a label return null, which decodes to ""
+	query := "FOR sl in " + c + " FILTER sl._key == @sl RETURN sl.label"
+
+	listQ, err := dbQuery[string](ctx, db, query, d{"sl": id})
+	if err != nil {
+		return "", err
+	}
+
+	if listQ == nil {
+		return "", notFound("get " + c + "/" + id)
+	}
+
+	return listQ[0], nil
+}
+
+func (aranStore) ListLabel(ctx context.Context, dbv, id string) (string, error) {
+	return dbase{dbv}.label(ctx, "ShoppingLists", id)
+}
+
+// Creates the ShoppingListX document in ShoppingLists. Its entries go in ListEntries.
+func (aranStore) ListCreate(ctx context.Context, dbv string) (ShopListsAll, error) {
+	return dbase{dbv}.newList(ctx, "ShoppingList", "ShoppingLists")
+}
+
+// p - prefix of the list name, c - collection holding the list documents
+func (db dbase) newList(ctx context.Context, p, c string) (ShopListsAll, error) {
+	n := p + fmt.Sprint(time.Now().Unix())
+
+	query := "INSERT { name: @name, 'hidden': false, 'date': DATE_NOW(),} INTO " + c + " RETURN {'name': NEW.name, 'date': NEW.date, 'hidden': NEW.hidden, 'id': NEW._key}"
+
+	execQ, err := dbQuery[ShopListsAll](ctx, db, query, d{"name": n})
+	if err != nil {
+		return ShopListsAll{}, err
+	}
+
+	return execQ[0], nil
+}
+
+func (aranStore) ListUpdate(ctx context.Context, dbv, id string, l ShopListsAll) (string, error) {
+	return dbase{dbv}.update(ctx, "ShoppingLists", id, l)
+}
+
+// Entries grouped by shop, in the shape of SList and Tpl. f is the fields of an entry e of item v.
+func aqlEntriesByShop(f string) string {
+	return "FOR e IN ListEntries FILTER e.list == @list LET v = DOCUMENT(e._to) COLLECT shop = e._from INTO g = MERGE(" + f + ", {'shop_id': PARSE_IDENTIFIER(e._from).key}) LET s = DOCUMENT(shop) FILTER s != null RETURN {'shop': s.name, 'items': g}"
+}
+
+const aqlListEntry = "{'label': v.name, 'nett': v.nett, 'nett_unit': v.nett_unit, 'price': e.price, 'currency': e.currency, 'qty': e.qty, 'trolley': e.trolley, 'special': e.special, 'tag': e.tag, 'edge_id': e._key, 'item_id': v._key}"
+
+func (aranStore) ListView(ctx context.Context, dbv, id string) ([]SList, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "ShoppingLists", id)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []SList
+	err = dbEach(ctx, db, aqlEntriesByShop(aqlListEntry), d{"list": l}, func(s SList) error {
+		out = append(out, s)
+		return nil
+	})
+
+	return out, err
+}
+
+func (aranStore) ListTrolley(ctx context.Context, dbv, id, shop string) ([]SListItems, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "ShoppingLists", id)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "FOR e IN ListEntries FILTER e.list == @list AND e._from == @shop AND e.trolley == true LET v = DOCUMENT(e._to) RETURN " + aqlListEntry
+
+	var out []SListItems
+	err = dbEach(ctx, db, query, d{"shop": shop, "list": l}, func(e SListItems) error {
+		out = append(out, e)
+		return nil
+	})
+
+	return out, err
+}
+
+func (aranStore) ListAddItem(ctx context.Context, dbv, id string, e SlistEdge) (string, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "ShoppingLists", id)
+	if err != nil {
+		return "", err
+	}
+
+	return db.entryAdd(ctx, l, e)
+}
+
+// Can update entry contents, but not change _from and _to
+func (aranStore) ListUpdateItem(ctx context.Context, dbv, id, key string, e SlistEdgeItem) (string, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "ShoppingLists", id)
+	if err != nil {
+		return "", err
+	}
+
+	return db.entryUpdate(ctx, l, key, e)
+}
+
+func (aranStore) ListMoveItem(ctx context.Context, dbv, id, key string, e SlistEdge) (string, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "ShoppingLists", id)
+	if err != nil {
+		return "", err
+	}
+
+	return db.entryReplace(ctx, l, key, e)
+}
+
+// Removes entry (shopping list item) key of the list
+func (aranStore) ListRemoveItem(ctx context.Context, dbv, id, key string) (string, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "ShoppingLists", id)
+	if err != nil {
+		return "", err
+	}
+
+	return db.entryReplace(ctx, l, key, nil)
+}
+
+/*
+ * TEMPLATES
+ */
+
+func (aranStore) TemplatesEnable(ctx context.Context, dbv string) error {
+	_, err := dbase{dbv}.colCreate(ctx, "Templates")
+	return err
+}
+
+func (aranStore) TemplateAll(ctx context.Context, dbv string) ([]ShopListsAll, error) {
+	query := "FOR tpl in Templates RETURN {'name': tpl.name, 'date': tpl.date, 'hidden': tpl.hidden, 'id': tpl._key, 'label': tpl.label}"
+
+	return dbQuery[ShopListsAll](ctx, dbase{dbv}, query, nil)
+}
+
+func (aranStore) TemplateLabel(ctx context.Context, dbv, id string) (string, error) {
+	return dbase{dbv}.label(ctx, "Templates", id)
+}
+
+func (aranStore) TemplateCreate(ctx context.Context, dbv string) (ShopListsAll, error) {
+	return dbase{dbv}.newList(ctx, "Template", "Templates")
+}
+
+func (aranStore) TemplateUpdate(ctx context.Context, dbv, id string, l ShopListsAll) (string, error) {
+	return dbase{dbv}.update(ctx, "Templates", id, l)
+}
+
+func (aranStore) TemplateView(ctx context.Context, dbv, id string) ([]Tpl, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "Templates", id)
+	if err != nil {
+		return nil, err
+	}
+
+	//DB query - get template's contents
+	f := "{'label': v.name, 'nett': v.nett, 'nett_unit': v.nett_unit, 'qty': e.qty, 'edge_id': e._key, 'item_id': v._key}"
+
+	var out []Tpl
+	err = dbEach(ctx, db, aqlEntriesByShop(f), d{"list": l}, func(t Tpl) error {
+		out = append(out, t)
+		return nil
+	})
+
+	return out, err
+}
+
+func (aranStore) TemplateAddItem(ctx context.Context, dbv, id string, e TplEdge) (string, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "Templates", id)
+	if err != nil {
+		return "", err
+	}
+
+	return db.entryAdd(ctx, l, e)
+}
+
+func (aranStore) TemplateUpdateItem(ctx context.Context, dbv, id, key string, e TplEdgeItem) (string, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "Templates", id)
+	if err != nil {
+		return "", err
+	}
+
+	return db.entryUpdate(ctx, l, key, e)
+}
+
+func (aranStore) TemplateMoveItem(ctx context.Context, dbv, id, key string, e TplEdge) (string, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "Templates", id)
+	if err != nil {
+		return "", err
+	}
+
+	return db.entryReplace(ctx, l, key, e)
+}
+
+func (aranStore) TemplateRemoveItem(ctx context.Context, dbv, id, key string) (string, error) {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "Templates", id)
+	if err != nil {
+		return "", err
+	}
+
+	return db.entryReplace(ctx, l, key, nil)
+}
+
+// Delete the template's entries and its document in Templates
+func (aranStore) TemplateRemove(ctx context.Context, dbv, id string) error {
+	db := dbase{dbv}
+
+	l, err := db.listID(ctx, "Templates", id)
+	if err != nil {
+		return err
+	}
+
+	return db.inTx(ctx, []string{"ListEntries", "Templates"}, func(ctx context.Context) error {
+		if _, err := dbQuery[d](ctx, db, "FOR e IN ListEntries FILTER e.list == @list REMOVE e IN ListEntries", d{"list": l}); err != nil {
+			return err
+		}
+
+		//Remove document from Templates collection
+		return db.delTemplate(ctx, id)
+	})
+}
+
+/*
+ * TRENDS
+ */
+
+// Stats per currency of the prices in array src
+func aqlPriceStats(src string) string {
+	return "(FOR x IN " + src + " COLLECT currency = x.currency INTO pg = x.price RETURN {'currency': currency, 'count': LENGTH(pg), 'min': MIN(pg), 'max': MAX(pg), 'avg': AVERAGE(pg), 'median': MEDIAN(pg)})"
+}
+
+// Every priced entry of the item across the shopping lists, in one query on the edge
+// index. Templates hold no prices.
+func (aranStore) PriceHistory(ctx context.Context, dbv, id string, f PriceFilter) (PriceHistory, error) {
+	//Soft deleted items are still in Items, and keep their history
+	query := `LET item = DOCUMENT(@item)
+		FILTER item != null
+		LET prices = (
+			FOR e IN ListEntries
+			FILTER e._to == @item AND STARTS_WITH(e.list, 'ShoppingLists/') AND e.price > 0
+			FILTER (@from == 0 OR e.date >= @from) AND (@to == 0 OR e.date <= @to)
+			FILTER (@shop == '' OR e._from == @shop) AND (@currency == '' OR e.currency == @currency)
+			SORT e.date DESC, e._key
+			LET s = DOCUMENT(e._from)
+			RETURN {'shop': s.name, 'branch': s.branch, 'city': s.city, 'country': s.country, 'currency': e.currency, 'price': e.price, 'date': e.date, 'special': e.special, 'list_id': CONCAT(DOCUMENT(e.list).name, '/', e._key), 'shop_id': PARSE_IDENTIFIER(e._from).key})
+		LET shops = !@byShop ? [] : (
+			FOR p IN prices COLLECT shop = p.shop_id INTO sg = p
+			RETURN {'shop_id': shop, 'shop': sg[0].shop, 'branch': sg[0].branch, 'city': sg[0].city, 'country': sg[0].country, 'stats': ` + aqlPriceStats("sg") + `})
+		RETURN {'item_id': @id, 'nett': item.nett, 'nett_unit': item.nett_unit, 'total': LENGTH(prices), 'stats': ` + aqlPriceStats("prices") + `, 'shops': shops,
+			'prices': @limit > 0 ? SLICE(prices, @offset, @limit) : SLICE(prices, @offset)}`
+
+	bind := d{"id": id, "item": "Items/" + id, "from": f.From, "to": f.To, "shop": f.Shop, "currency": f.Currency, "byShop": f.ByShop, "limit": f.Limit, "offset": f.Offset}
+	execQ, err := dbQuery[PriceHistory](ctx, dbase{dbv}, query, bind)
+	if err != nil {
+		return PriceHistory{}, err
+	}
+
+	if execQ == nil {
+		return PriceHistory{}, notFound("price history of item " + id)
+	}
+
+	return execQ[0], nil
+}
+
+/*
+ * EXCHANGE RATES
+ */
+
+func (aranStore) RateAll(ctx context.Context, dbv string) ([]Rate, error) {
+	q := "FOR r IN Rates SORT r.from, r.to RETURN r"
+	return dbQuery[Rate](ctx, dbase{dbv}, q, nil)
+}
+
+func (aranStore) RateSet(ctx context.Context, dbv string, r Rate) error {
+	q := "UPSERT {_key: @key} INSERT MERGE(@rate, {_key: @key}) REPLACE MERGE(@rate, {_key: @key}) IN Rates"
+	_, err := dbQuery[d](ctx, dbase{dbv}, q, d{"key": r.key(), "rate": r})
+	return err
+}
+
+func (aranStore) RateDelete(ctx context.Context, dbv, from, to string) error {
+	r := Rate{From: from, To: to}
+	q := "FOR r IN Rates FILTER r._key == @key REMOVE r IN Rates RETURN 1"
+
+	execQ, err := dbQuery[int](ctx, dbase{dbv}, q, d{"key": r.key()})
+	if err != nil {
+		return err
+	}
+
+	if execQ == nil {
+		return notFound("delete rate " + r.key())
+	}
+
+	return nil
+}
+
+/*
+ * USERS
+ */
+
+// users document in _system
+type userDoc struct {
+	Email string `json:"email"`
+	Db    string `json:"db"`
+	Role  string `json:"role"`
+}
+
+func (aranStore) UserGet(ctx context.Context, email string) (user, error) {
+	//Users still being provisioned can't log in yet
+	q := "FOR d in users FILTER d.email == @email AND d.state != 'provisioning' RETURN {db: d.db, email: d.email, role:d.role}"
+
+	execQ, err := dbQuery[userDoc](ctx, dbase{"_system"}, q, d{"email": email})
+	if err != nil {
+		return user{}, err
+	}
+
+	if execQ == nil {
+		return user{}, notFound("get user " + email) //user does not exist in system db
+	}
+
+	u := execQ[0]
+	return user{u.Email, u.Db, u.Role}, nil
+}
+
+func (aranStore) UserAll(ctx context.Context) ([]UserNew, error) {
+	query := "FOR d in users RETURN {'email': d.email, 'role': d.role}"
+	return dbQuery[UserNew](ctx, dbase{"_system"}, query, nil)
+}
+
+/*
+ * Provisioning. The users document is written first with state "provisioning", the
+ * chosen db name and an attempt ID, and only marked active once the database is complete.
+ * Whoever holds the attempt owns the database until then: other requests for the same
+ * email wait for it, and take it over (same db name, new attempt) only once it's older
+ * than provisionLease, e.g. because its server died. Finishing and rolling back both
+ * check the attempt, so a request that lost its lease never drops a database someone
+ * else is building. Every step is idempotent, so retrying is always safe.
+ */
+const (
+	provisionLease = 2 * time.Minute        //Before an unfinished attempt may be taken over
+	provisionPoll  = 250 * time.Millisecond //How often waiting requests look again
+)
+
+func (aranStore) UserCreate(ctx context.Context, u UserNew) (string, bool, error) {
+	sys := dbase{"_system"}
+
+	//One users document per email, even for concurrent requests
+	if err := sys.indexEnsure(ctx, "users", []string{"email"}, true); err != nil {
+		return "", false, err
+	}
+
+	attempt := makeID()
+	for {
+		q := `FOR d IN users FILTER d.email == @email
+			RETURN {db: d.db, state: d.state, attempt: NOT_NULL(d.attempt, ''), age: DATE_NOW() - NOT_NULL(d.started, 0)}`
+		found, err := dbQuery[struct {
+			Db      string `json:"db"`
+			State   string `json:"state"`
+			Attempt string `json:"attempt"`
+			Age     int64  `json:"age"` //ms, by the server's clock
+		}](ctx, sys, q, d{"email": u.Email})
+		if err != nil {
+			return "", false, err
+		}
+
+		var n string
+		switch {
+		case found == nil:
+			//DB is a random ID
+			n = makeID()
+			query := `INSERT {'email': @email, 'db': @db, 'role': 'user', 'state': 'provisioning', 'attempt': @attempt, 'started': DATE_NOW()}
+				INTO users`
+			_, err := dbQuery[d](ctx, sys, query, d{"email": u.Email, "db": n, "attempt": attempt})
+			if errors.Is(err, errConflict) {
+				continue //Another request got there first, wait for it
+			} else if err != nil {
+				return "", false, err
+			}
+		case found[0].State != "provisioning":
+			return found[0].Db, false, nil //Already there
+		case time.Duration(found[0].Age)*time.Millisecond > provisionLease:
+			//Take over a stalled attempt, unless someone else just did
+			query := `FOR d IN users FILTER d.email == @email AND d.state == 'provisioning' AND NOT_NULL(d.attempt, '') == @old
+				UPDATE d WITH {attempt: @attempt, started: DATE_NOW()} IN users RETURN NEW.db`
+			res, err := dbQuery[string](ctx, sys, query, d{"email": u.Email, "old": found[0].Attempt, "attempt": attempt})
+			if err != nil {
+				return "", false, err
+			}
+			if res == nil {
+				continue
+			}
+			n = res[0]
+			fmt.Println("Resuming provisioning of", u.Email, n)
+		default:
+			//Still being built by another request
+			select {
+			case <-ctx.Done():
+				return "", false, storeErr("wait for provisioning of "+u.Email, ctx.Err())
+			case <-time.After(provisionPoll):
+			}
+			continue
+		}
+
+		done, err := provisionUser(ctx, u.Email, n, attempt)
+		if err != nil {
+			return "", false, err
+		}
+		if done {
+			return n, true, nil
+		}
+		//Taken over meanwhile, so wait for whoever holds it now
+	}
+}
+
+// Build database n for email under attempt, then mark the user active. Reports false if
+// the attempt was taken over before it finished.
+func provisionUser(ctx context.Context, email, n, attempt string) (bool, error) {
+	sys := dbase{"_system"}
+	mine := d{"email": email, "attempt": attempt}
+
+	if err := provisionDB(ctx, n); err != nil {
+		//Removing the users document first releases the db name, so nobody resumes it while it's dropped
+		fmt.Println("Provisioning failed, rolling back", email, n, err)
+		q := "FOR d IN users FILTER d.email == @email AND d.state == 'provisioning' AND d.attempt == @attempt REMOVE d IN users RETURN 1"
+		res, rerr := dbQuery[int](ctx, sys, q, mine)
+		switch {
+		case rerr != nil:
+			fmt.Println("Rollback: remove user:", rerr) //users doc stays, so a retry resumes
+		case res == nil:
+			fmt.Println("Rollback: attempt was taken over, leaving", n)
+		default:
+			if rerr := dbDrop(ctx, n); rerr != nil && !errors.Is(rerr, errNotFound) {
+				fmt.Println("Rollback: drop database (orphaned):", rerr)
+			}
+		}
+		return false, err
+	}
+
+	q := `FOR d IN users FILTER d.email == @email AND d.state == 'provisioning' AND d.attempt == @attempt
+		UPDATE d WITH {state: null, attempt: null, started: null} IN users OPTIONS {keepNull: false} RETURN 1`
+	res, err := dbQuery[int](ctx, sys, q, mine)
+	if err != nil {
+		return false, err
+	}
+	if res == nil {
+		return false, nil
+	}
+
+	fmt.Println("Database created, ", n)
+
+	return true, nil
+}
+
+// Database n at the latest schema version, whatever part of it already exists
+func provisionDB(ctx context.Context, n string) error {
+	if _, err := dbEnsure(ctx, n); err != nil {
+		return err
+	}
+
+	_, _, err := dbase{n}.migrate(ctx)
+	return err
+}
+
+// Removes the user (and their API keys) from _system, then drops their database. A failed
+// drop leaves an orphaned database behind rather than a user without one.
+func (st aranStore) UserDelete(ctx context.Context, email string) (user, error) {
+	u, err := st.UserGet(ctx, email)
+	if err != nil {
+		return user{}, err
+	}
+
+	//The admin count is taken in the same query, so two admins can't remove each other.
+	//The user may also be gone by now, removed by a concurrent request.
+	sys := dbase{"_system"}
+	q := `LET admins = LENGTH(FOR a IN users FILTER a.role == 'admin' RETURN 1)
+		LET u = FIRST(FOR d IN users FILTER d.email == @email RETURN d)
+		LET removed = (FOR d IN users FILTER u != null AND d._key == u._key AND (d.role != 'admin' OR admins > 1)
+			REMOVE d IN users RETURN 1)
+		RETURN u == null ? 'missing' : LENGTH(removed) > 0 ? 'removed' : 'last_admin'`
+	res, err := dbQuery[string](ctx, sys, q, d{"email": email})
+	if err != nil {
+		return user{}, err
+	}
+	switch res[0] {
+	case "missing":
+		return user{}, notFound("delete user " + email)
+	case "last_admin":
+		return user{}, errLastAdmin
+	}
+
+	_, err = dbQuery[d](ctx, sys, "FOR k IN apikeys FILTER k.email == @email REMOVE k IN apikeys", d{"email": email})
+	if err != nil && !errors.Is(err, errNotFound) {
+		fmt.Println("ArangoDB: failed to remove api keys of", email, err)
+	}
+
+	if err := dbDrop(ctx, u.db); err != nil {
+		return u, storeErr("drop database "+u.db+" (orphaned)", err)
+	}
+
+	return u, nil
+}
+
+// Sets the role, unless that would demote the last admin
+func (st aranStore) UserSetRole(ctx context.Context, email, role string) (string, error) {
+	u, err := st.UserGet(ctx, email)
+	if err != nil {
+		return "", err
+	}
+
+	q := `LET admins = LENGTH(FOR a IN users FILTER a.role == 'admin' RETURN 1)
+		FOR d IN users FILTER d.email == @email AND (@role == 'admin' OR d.role != 'admin' OR admins > 1)
+		UPDATE d WITH {role: @role} IN users RETURN OLD.role`
+	res, err := dbQuery[string](ctx, dbase{"_system"}, q, d{"email": email, "role": role})
+	if err != nil {
+		return "", err
+	}
+	if res == nil {
+		return u.role, errLastAdmin
+	}
+
+	return res[0], nil
+}
+
+/*
+ * SCHEMA, see migrate.go
+ */
+
+// Databases of every active user
+func (aranStore) TenantDBs(ctx context.Context) ([]string, error) {
+	q := "FOR d IN users FILTER d.state != 'provisioning' SORT d.db RETURN d.db"
+	return dbQuery[string](ctx, dbase{"_system"}, q, nil)
+}
+
+func (aranStore) SchemaVersion(ctx context.Context, dbv string) (int, error) {
+	return dbase{dbv}.schemaVersion(ctx)
+}
+
+func (aranStore) SchemaMigrate(ctx context.Context, dbv string) (int, int, error) {
+	return dbase{dbv}.migrate(ctx)
+}
+
+/*
+ * API keys, in _system/apikeys. The collection is created with the first key.
+ */
+
+func (aranStore) KeyCreate(ctx context.Context, k ApiKey) error {
+	_, err := dbase{"_system"}.insertCreate(ctx, "apikeys", k)
+	return err
+}
+
+func (aranStore) KeyGet(ctx context.Context, id string) (ApiKey, error) {
+	q := "FOR k IN apikeys FILTER k._key == @id RETURN k"
+
+	execQ, err := dbQuery[ApiKey](ctx, dbase{"_system"}, q, d{"id": id})
+	if err != nil {
+		return ApiKey{}, err
+	}
+
+	if execQ == nil {
+		return ApiKey{}, notFound("get api key " + id)
+	}
+
+	return execQ[0], nil
+}
+
+func (aranStore) KeyAll(ctx context.Context, email string) ([]ApiKey, error) {
+	q := "FOR k IN apikeys FILTER k.email == @email SORT k.created RETURN k"
+
+	out, err := dbQuery[ApiKey](ctx, dbase{"_system"}, q, d{"email": email})
+	if errors.Is(err, errNotFound) {
+		return nil, nil //No key minted yet, so no collection either
+	}
+
+	return out, err
+}
+
+func (aranStore) KeyRevoke(ctx context.Context, email, id string) error {
+	q := "FOR k IN apikeys FILTER k._key == @id AND k.email == @email REMOVE k IN apikeys RETURN OLD._key"
+
+	execQ, err := dbQuery[string](ctx, dbase{"_system"}, q, d{"id": id, "email": email})
+	if err != nil {
+		return err
+	}
+
+	if execQ == nil {
+		return notFound("revoke api key " + id)
+	}
+
+	return nil
+}
+
+/*
+ * Audit trail, in _system/audit. The collection is created with the first entry.
+ */
+
+func (aranStore) AuditAdd(ctx context.Context, a AuditEntry) error {
+	_, err := dbase{"_system"}.insertCreate(ctx, "audit", a)
+	return err
+}
+
+func (aranStore) AuditAll(ctx context.Context, limit int) ([]AuditEntry, error) {
+	q := "FOR a IN audit SORT a.time DESC LIMIT @limit RETURN a"
+
+	out, err := dbQuery[AuditEntry](ctx, dbase{"_system"}, q, d{"limit": limit})
+	if errors.Is(err, errNotFound) {
+		return nil, nil //Nothing audited yet
+	}
+
+	return out, err
+}
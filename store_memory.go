@@ -0,0 +1,1088 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * IN-MEMORY STORE
+ * Mirrors the ArangoDB layout (tenant dbs, Items, Shops, ShoppingLists, Templates and
+ * their ListEntries, kept here per list) so the API behaves the same without a live ArangoDB.
+ * Nothing is persisted.
+ */
+type memStore struct {
+	mu    sync.RWMutex
+	seq   int
+	users map[string]user //keyed on email, i.e. _system/users
+	keys  map[string]ApiKey
+	audit []AuditEntry
+	dbs   map[string]*memDB
+}
+
+type memDB struct {
+	items     map[string]Item
+	deleted   map[string]bool //Soft deleted items, still in items for list entries and trends
+	shops     map[string]Shop
+	lists     map[string]*memList
+	templates map[string]*memList //nil until Templates are enabled
+	rates     map[string]Rate     //keyed on Rate.key()
+}
+
+// Document in ShoppingLists/Templates along with its entries (ListEntries in ArangoDB)
+type memList struct {
+	doc   ShopListsAll
+	edges map[string]SlistEdge //Templates only use _from, _to and qty
+}
+
+// Same as ArangoDB's error for querying Templates before they are enabled
+var errNoTemplates = notFound("collection or view Templates")
+
+func newMemStore() *memStore {
+	return &memStore{
+		users: make(map[string]user),
+		keys:  make(map[string]ApiKey),
+		dbs:   make(map[string]*memDB),
+	}
+}
+
+func newMemDB() *memDB {
+	return &memDB{
+		items:   make(map[string]Item),
+		deleted: make(map[string]bool),
+		shops:   make(map[string]Shop),
+		lists:   make(map[string]*memList),
+		rates:   make(map[string]Rate),
+	}
+}
+
+// Next document key. Callers must hold the write lock.
+func (m *memStore) key() string {
+	m.seq++
+	return strconv.Itoa(m.seq)
+}
+
+// Keys are numeric strings, so sort on their value to keep insertion order
+func sortedKeys[V any](in map[string]V) []string {
+	keys := make([]string, 0, len(in))
+	for k := range in {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(a, b int) bool {
+		ka, _ := strconv.Atoi(keys[a])
+		kb, _ := strconv.Atoi(keys[b])
+		return ka < kb
+	})
+
+	return keys
+}
+
+// Callers must hold the lock
+func (m *memStore) db(name string) (*memDB, error) {
+	dbx, ok := m.dbs[name]
+	if !ok {
+		return nil, notFound("database " + name)
+	}
+
+	return dbx, nil
+}
+
+// Callers must hold the lock
+func (m *memStore) list(dbv, id string, tpl bool) (*memDB, *memList, error) {
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lists := dbx.lists
+	if tpl {
+		if dbx.templates == nil {
+			return nil, nil, errNoTemplates
+		}
+		lists = dbx.templates
+	}
+
+	l, ok := lists[id]
+	if !ok {
+		return nil, nil, notFound("list " + id)
+	}
+
+	return dbx, l, nil
+}
+
+/*
+ * ITEMS
+ */
+
+func (m *memStore) ItemGet(ctx context.Context, dbv, id string) (Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return Item{}, err
+	}
+
+	i, ok := dbx.items[id]
+	if !ok || dbx.deleted[id] {
+		return Item{}, notFound("get item " + id)
+	}
+
+	return i, nil
+}
+
+func (m *memStore) ItemAll(ctx context.Context, dbv string) ([]Item, error) {
+	return m.itemFind(dbv, "")
+}
+
+func (m *memStore) ItemLike(ctx context.Context, dbv, part string) ([]Item, error) {
+	return m.itemFind(dbv, part)
+}
+
+func (m *memStore) itemFind(dbv, part string) ([]Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Item
+	for _, k := range sortedKeys(dbx.items) {
+		if strings.Contains(dbx.items[k].Name, part) && !dbx.deleted[k] {
+			out = append(out, dbx.items[k])
+		}
+	}
+
+	return out, nil
+}
+
+func (m *memStore) ItemCreate(ctx context.Context, dbv string, i ItemNew) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return "", err
+	}
+
+	k := m.key()
+	dbx.items[k] = Item{k, i.Name, i.Nett, i.Ntt_un, i.Brand}
+
+	return k, nil
+}
+
+func (m *memStore) ItemUpdate(ctx context.Context, dbv, id string, i ItemNew) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := dbx.items[id]; !ok {
+		return "", notFound("update Items/" + id)
+	}
+
+	dbx.items[id] = Item{id, i.Name, i.Nett, i.Ntt_un, i.Brand}
+
+	return id, nil
+}
+
+func (m *memStore) ItemDelete(ctx context.Context, dbv, id, mode string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, ok := dbx.items[id]; !ok || dbx.deleted[id] {
+		return 0, notFound("get item " + id)
+	}
+	if mode != delRestrict && mode != delCascade && mode != delSoft {
+		return 0, &storeError{errBadQuery, "delete item " + id + ": unknown mode " + mode, nil}
+	}
+
+	//Entries pointing at the item, in lists and templates
+	type ref struct {
+		l *memList
+		k string
+	}
+	var refs []ref
+	for _, ls := range []map[string]*memList{dbx.lists, dbx.templates} {
+		for _, l := range ls {
+			for k, e := range l.edges {
+				if e.To == "Items/"+id {
+					refs = append(refs, ref{l, k})
+				}
+			}
+		}
+	}
+
+	switch mode {
+	case delRestrict:
+		if len(refs) > 0 {
+			return len(refs), conflict(fmt.Sprintf("delete item %s: used by %d list entries", id, len(refs)))
+		}
+		delete(dbx.items, id)
+	case delCascade:
+		for _, r := range refs {
+			delete(r.l.edges, r.k)
+		}
+		delete(dbx.items, id)
+	case delSoft:
+		dbx.deleted[id] = true
+	}
+
+	return len(refs), nil
+}
+
+/*
+ * SHOPS
+ */
+
+func (m *memStore) ShopGet(ctx context.Context, dbv, id string) (Shop, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return Shop{}, err
+	}
+
+	s, ok := dbx.shops[id]
+	if !ok {
+		return Shop{}, notFound("get shop " + id)
+	}
+
+	return s, nil
+}
+
+func (m *memStore) ShopAll(ctx context.Context, dbv string) ([]Shop, error) {
+	return m.shopFind(dbv, "")
+}
+
+func (m *memStore) ShopLike(ctx context.Context, dbv, part string) ([]Shop, error) {
+	return m.shopFind(dbv, part)
+}
+
+func (m *memStore) shopFind(dbv, part string) ([]Shop, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Shop
+	for _, k := range sortedKeys(dbx.shops) {
+		if strings.Contains(dbx.shops[k].Name, part) {
+			out = append(out, dbx.shops[k])
+		}
+	}
+
+	return out, nil
+}
+
+func (m *memStore) ShopCreate(ctx context.Context, dbv string, s ShopNew) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return "", err
+	}
+
+	k := m.key()
+	dbx.shops[k] = Shop{k, s.Name, s.Branch, s.City, s.Country}
+
+	return k, nil
+}
+
+func (m *memStore) ShopUpdate(ctx context.Context, dbv, id string, s ShopNew) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := dbx.shops[id]; !ok {
+		return "", notFound("update Shops/" + id)
+	}
+
+	dbx.shops[id] = Shop{id, s.Name, s.Branch, s.City, s.Country}
+
+	return id, nil
+}
+
+func (m *memStore) ShopDelete(ctx context.Context, dbv, id, mode, to string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return 0, err
+	}
+
+	if mode != delRestrict && mode != delCascade && mode != delReassign {
+		return 0, &storeError{errBadQuery, "delete shop " + id + ": unknown mode " + mode, nil}
+	}
+	if _, ok := dbx.shops[id]; !ok {
+		return 0, notFound("get shop " + id)
+	}
+	if mode == delReassign {
+		if to == id {
+			return 0, &storeError{errBadQuery, "delete shop " + id + ": cannot reassign to itself", nil}
+		}
+		if _, ok := dbx.shops[to]; !ok {
+			return 0, notFound("get shop " + to)
+		}
+	}
+
+	n := 0
+	for _, ls := range []map[string]*memList{dbx.lists, dbx.templates} {
+		for _, l := range ls {
+			for k, e := range l.edges {
+				if e.From != "Shops/"+id {
+					continue
+				}
+				n++
+
+				switch mode {
+				case delCascade:
+					delete(l.edges, k)
+				case delReassign:
+					//Same key, as the ArangoDB store updates _from in place
+					e.From = "Shops/" + to
+					l.edges[k] = e
+				}
+			}
+		}
+	}
+
+	if mode == delRestrict && n > 0 {
+		return n, conflict(fmt.Sprintf("delete shop %s: used by %d list entries", id, n))
+	}
+	delete(dbx.shops, id)
+
+	return n, nil
+}
+
+/*
+ * SHOPPING LISTS & TEMPLATES
+ * Both share the same layout, tpl selects which one.
+ */
+
+func (m *memStore) listAll(dbv string, tpl, visibleOnly bool) ([]ShopListsAll, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return nil, err
+	}
+
+	lists := dbx.lists
+	if tpl {
+		if dbx.templates == nil {
+			return nil, errNoTemplates
+		}
+		lists = dbx.templates
+	}
+
+	var out []ShopListsAll
+	for _, k := range sortedKeys(lists) {
+		if visibleOnly && lists[k].doc.Hidden {
+			continue
+		}
+		out = append(out, lists[k].doc)
+	}
+
+	return out, nil
+}
+
+func (m *memStore) listLabel(dbv, id string, tpl bool) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, l, err := m.list(dbv, id, tpl)
+	if err != nil {
+		return "", err
+	}
+
+	return l.doc.Label, nil
+}
+
+func (m *memStore) listCreate(dbv string, tpl bool) (ShopListsAll, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return ShopListsAll{}, err
+	}
+
+	p, lists := "ShoppingList", dbx.lists
+	if tpl {
+		if dbx.templates == nil {
+			return ShopListsAll{}, errNoTemplates
+		}
+		p, lists = "Template", dbx.templates
+	}
+
+	k := m.key()
+	t := time.Now()
+	doc := ShopListsAll{Id: k, Name: p + fmt.Sprint(t.Unix()), Date: float64(t.UnixMilli())}
+	lists[k] = &memList{doc, make(map[string]SlistEdge)}
+
+	return doc, nil
+}
+
+func (m *memStore) listUpdate(dbv, id string, l ShopListsAll, tpl bool) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ml, err := m.list(dbv, id, tpl)
+	if err != nil {
+		return "", err
+	}
+
+	l.Id = id
+	ml.doc = l
+
+	return id, nil
+}
+
+// Group edges by shop, in the same shape as the AQL traversal over Shops
+func (m *memStore) listView(dbv, id string, tpl bool) ([]SList, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dbx, l, err := m.list(dbv, id, tpl)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []SList
+	for _, sk := range sortedKeys(dbx.shops) {
+		var items []SListItems
+		for _, ek := range sortedKeys(l.edges) {
+			e := l.edges[ek]
+			if e.From != "Shops/"+sk {
+				continue
+			}
+			items = append(items, dbx.entry(ek, sk, e))
+		}
+
+		if items != nil {
+			out = append(out, SList{Shop: dbx.shops[sk].Name, Items: items})
+		}
+	}
+
+	return out, nil
+}
+
+// Join an edge with its item. sk is the shop key.
+func (dbx *memDB) entry(ek, sk string, e SlistEdge) SListItems {
+	ik := strings.TrimPrefix(e.To, "Items/")
+	v := dbx.items[ik]
+
+	return SListItems{Label: v.Name, Nett: v.Nett, Nett_unit: v.Ntt_un, Price: e.Price, Currency: e.Currency, Qty: e.Qty, Special: e.Special, Trolley: e.Trolley, Tag: e.Tag, Edge_id: ek, Item_id: ik, Shop_id: sk}
+}
+
+func (m *memStore) edgeAdd(dbv, id string, e SlistEdge, tpl bool) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, l, err := m.list(dbv, id, tpl)
+	if err != nil {
+		return "", err
+	}
+
+	k := m.key()
+	l.edges[k] = e
+
+	return k, nil
+}
+
+// Remove edge key and, if e is not nil, add e in its place
+func (m *memStore) edgeReplace(dbv, id, key string, e *SlistEdge, tpl bool) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, l, err := m.list(dbv, id, tpl)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := l.edges[key]; !ok {
+		return "", notFound("edge " + key)
+	}
+	delete(l.edges, key)
+
+	if e == nil {
+		return key, nil
+	}
+
+	k := m.key()
+	l.edges[k] = *e
+
+	return k, nil
+}
+
+func (m *memStore) ListAll(ctx context.Context, dbv string, visibleOnly bool) ([]ShopListsAll, error) {
+	return m.listAll(dbv, false, visibleOnly)
+}
+
+func (m *memStore) ListLabel(ctx context.Context, dbv, id string) (string, error) {
+	return m.listLabel(dbv, id, false)
+}
+
+func (m *memStore) ListCreate(ctx context.Context, dbv string) (ShopListsAll, error) {
+	return m.listCreate(dbv, false)
+}
+
+func (m *memStore) ListUpdate(ctx context.Context, dbv, id string, l ShopListsAll) (string, error) {
+	return m.listUpdate(dbv, id, l, false)
+}
+
+func (m *memStore) ListView(ctx context.Context, dbv, id string) ([]SList, error) {
+	return m.listView(dbv, id, false)
+}
+
+func (m *memStore) ListTrolley(ctx context.Context, dbv, id, shop string) ([]SListItems, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dbx, l, err := m.list(dbv, id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []SListItems
+	for _, ek := range sortedKeys(l.edges) {
+		e := l.edges[ek]
+		if e.From == shop && e.Trolley {
+			it := dbx.entry(ek, "", e)
+			out = append(out, it)
+		}
+	}
+
+	return out, nil
+}
+
+func (m *memStore) ListAddItem(ctx context.Context, dbv, id string, e SlistEdge) (string, error) {
+	return m.edgeAdd(dbv, id, e, false)
+}
+
+func (m *memStore) ListUpdateItem(ctx context.Context, dbv, id, key string, e SlistEdgeItem) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, l, err := m.list(dbv, id, false)
+	if err != nil {
+		return "", err
+	}
+
+	old, ok := l.edges[key]
+	if !ok {
+		return "", notFound("edge " + key)
+	}
+
+	l.edges[key] = SlistEdge{old.To, old.From, e.Date, e.Price, e.Currency, e.Special, e.Trolley, e.Qty, e.Tag}
+
+	return key, nil
+}
+
+func (m *memStore) ListMoveItem(ctx context.Context, dbv, id, key string, e SlistEdge) (string, error) {
+	return m.edgeReplace(dbv, id, key, &e, false)
+}
+
+func (m *memStore) ListRemoveItem(ctx context.Context, dbv, id, key string) (string, error) {
+	return m.edgeReplace(dbv, id, key, nil, false)
+}
+
+func (m *memStore) TemplatesEnable(ctx context.Context, dbv string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return err
+	}
+
+	if dbx.templates != nil {
+		return conflict("create collection Templates")
+	}
+	dbx.templates = make(map[string]*memList)
+
+	return nil
+}
+
+func (m *memStore) TemplateAll(ctx context.Context, dbv string) ([]ShopListsAll, error) {
+	return m.listAll(dbv, true, false)
+}
+
+func (m *memStore) TemplateLabel(ctx context.Context, dbv, id string) (string, error) {
+	return m.listLabel(dbv, id, true)
+}
+
+func (m *memStore) TemplateCreate(ctx context.Context, dbv string) (ShopListsAll, error) {
+	return m.listCreate(dbv, true)
+}
+
+func (m *memStore) TemplateUpdate(ctx context.Context, dbv, id string, l ShopListsAll) (string, error) {
+	return m.listUpdate(dbv, id, l, true)
+}
+
+func (m *memStore) TemplateView(ctx context.Context, dbv, id string) ([]Tpl, error) {
+	sl, err := m.listView(dbv, id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Tpl
+	for _, s := range sl {
+		t := Tpl{Shop: s.Shop}
+		for _, i := range s.Items {
+			t.Items = append(t.Items, TplItem{i.Label, i.Nett, i.Nett_unit, i.Qty, i.Edge_id, i.Item_id, i.Shop_id})
+		}
+		out = append(out, t)
+	}
+
+	return out, nil
+}
+
+func (m *memStore) TemplateAddItem(ctx context.Context, dbv, id string, e TplEdge) (string, error) {
+	return m.edgeAdd(dbv, id, SlistEdge{To: e.To, From: e.From, Qty: e.Qty}, true)
+}
+
+func (m *memStore) TemplateUpdateItem(ctx context.Context, dbv, id, key string, e TplEdgeItem) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, l, err := m.list(dbv, id, true)
+	if err != nil {
+		return "", err
+	}
+
+	old, ok := l.edges[key]
+	if !ok {
+		return "", notFound("edge " + key)
+	}
+
+	old.Qty = e.Qty
+	l.edges[key] = old
+
+	return key, nil
+}
+
+func (m *memStore) TemplateMoveItem(ctx context.Context, dbv, id, key string, e TplEdge) (string, error) {
+	return m.edgeReplace(dbv, id, key, &SlistEdge{To: e.To, From: e.From, Qty: e.Qty}, true)
+}
+
+func (m *memStore) TemplateRemoveItem(ctx context.Context, dbv, id, key string) (string, error) {
+	return m.edgeReplace(dbv, id, key, nil, true)
+}
+
+func (m *memStore) TemplateRemove(ctx context.Context, dbv, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, _, err := m.list(dbv, id, true)
+	if err != nil {
+		return err
+	}
+
+	delete(dbx.templates, id)
+
+	return nil
+}
+
+/*
+ * TRENDS
+ */
+
+// Same as the ArangoDB query, from every shopping list's entries
+func (m *memStore) PriceHistory(ctx context.Context, dbv, id string, f PriceFilter) (PriceHistory, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return PriceHistory{}, err
+	}
+
+	i, ok := dbx.items[id] //Soft deleted items keep their history
+	if !ok {
+		return PriceHistory{}, notFound("price history of item " + id)
+	}
+
+	prices := []ItemTrend{}
+	for _, l := range dbx.lists {
+		for ek, e := range l.edges {
+			switch {
+			case e.To != "Items/"+id || e.Price <= 0:
+			case f.From != 0 && e.Date < f.From, f.To != 0 && e.Date > f.To:
+			case f.Shop != "" && e.From != f.Shop, f.Currency != "" && e.Currency != f.Currency:
+			default:
+				sk := strings.TrimPrefix(e.From, "Shops/")
+				s := dbx.shops[sk]
+				prices = append(prices, ItemTrend{Shop: s.Name, Branch: s.Branch, City: s.City, Country: s.Country, Currency: e.Currency, Price: e.Price, Date: e.Date, Special: e.Special, List: l.doc.Name + "/" + ek, ShopId: sk})
+			}
+		}
+	}
+	sort.Slice(prices, func(a, b int) bool {
+		if prices[a].Date != prices[b].Date {
+			return prices[a].Date > prices[b].Date
+		}
+		return prices[a].List < prices[b].List
+	})
+
+	h := PriceHistory{Item: id, Nett: i.Nett, NettUnit: i.Ntt_un, Total: len(prices), Stats: priceStats(prices)}
+
+	if f.ByShop {
+		byShop := map[string][]ItemTrend{}
+		for _, p := range prices {
+			byShop[p.ShopId] = append(byShop[p.ShopId], p)
+		}
+		for _, sk := range sortedKeys(byShop) {
+			p := byShop[sk][0]
+			h.Shops = append(h.Shops, ShopPrices{sk, p.Shop, p.Branch, p.City, p.Country, priceStats(byShop[sk])})
+		}
+	}
+
+	//Page
+	lo := min(f.Offset, len(prices))
+	hi := len(prices)
+	if f.Limit > 0 {
+		hi = min(lo+f.Limit, hi)
+	}
+	h.Prices = prices[lo:hi]
+
+	return h, nil
+}
+
+// Stats per currency, as AQL's MIN, MAX, AVERAGE and MEDIAN give them
+func priceStats(prices []ItemTrend) []PriceStats {
+	byCur := map[string][]float32{}
+	for _, p := range prices {
+		byCur[p.Currency] = append(byCur[p.Currency], p.Price)
+	}
+
+	curs := make([]string, 0, len(byCur))
+	for c := range byCur {
+		curs = append(curs, c)
+	}
+	sort.Strings(curs)
+
+	out := []PriceStats{}
+	for _, c := range curs {
+		pr := byCur[c]
+		sort.Slice(pr, func(a, b int) bool { return pr[a] < pr[b] })
+
+		var sum float32
+		for _, p := range pr {
+			sum += p
+		}
+
+		n := len(pr)
+		med := pr[n/2]
+		if n%2 == 0 {
+			med = (pr[n/2-1] + pr[n/2]) / 2
+		}
+
+		out = append(out, PriceStats{c, n, pr[0], pr[n-1], sum / float32(n), med})
+	}
+
+	return out
+}
+
+/*
+ * EXCHANGE RATES
+ */
+
+func (m *memStore) RateAll(ctx context.Context, dbv string) ([]Rate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Rate
+	for _, r := range dbx.rates {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].key() < out[b].key() })
+
+	return out, nil
+}
+
+func (m *memStore) RateSet(ctx context.Context, dbv string, r Rate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return err
+	}
+
+	dbx.rates[r.key()] = r
+
+	return nil
+}
+
+func (m *memStore) RateDelete(ctx context.Context, dbv, from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dbx, err := m.db(dbv)
+	if err != nil {
+		return err
+	}
+
+	k := Rate{From: from, To: to}.key()
+	if _, ok := dbx.rates[k]; !ok {
+		return notFound("delete rate " + k)
+	}
+	delete(dbx.rates, k)
+
+	return nil
+}
+
+/*
+ * USERS
+ */
+
+func (m *memStore) UserGet(ctx context.Context, email string) (user, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[email]
+	if !ok {
+		return user{}, notFound("get user " + email)
+	}
+
+	return u, nil
+}
+
+func (m *memStore) UserAll(ctx context.Context) ([]UserNew, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var out []UserNew
+	for _, u := range m.users {
+		out = append(out, UserNew{u.email, u.role})
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Email < out[b].Email })
+
+	return out, nil
+}
+
+func (m *memStore) UserCreate(ctx context.Context, u UserNew) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, ok := m.users[u.Email]; ok {
+		return old.db, false, nil
+	}
+
+	n, err := m.addUser(u.Email, roleUser)
+	return n, err == nil, err
+}
+
+func (m *memStore) UserDelete(ctx context.Context, email string) (user, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[email]
+	if !ok {
+		return user{}, notFound("get user " + email)
+	}
+	if u.role == roleAdmin && m.admins() == 1 {
+		return user{}, errLastAdmin
+	}
+
+	delete(m.users, email)
+	delete(m.dbs, u.db)
+	for id, k := range m.keys {
+		if k.Email == email {
+			delete(m.keys, id)
+		}
+	}
+
+	return u, nil
+}
+
+func (m *memStore) UserSetRole(ctx context.Context, email, role string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[email]
+	if !ok {
+		return "", notFound("get user " + email)
+	}
+	if u.role == roleAdmin && role != roleAdmin && m.admins() == 1 {
+		return u.role, errLastAdmin
+	}
+
+	old := u.role
+	u.role = role
+	m.users[email] = u
+
+	return old, nil
+}
+
+// Number of admins. Callers must hold the lock.
+func (m *memStore) admins() int {
+	n := 0
+	for _, u := range m.users {
+		if u.role == roleAdmin {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Adds user with its own database. Callers must hold the write lock.
+func (m *memStore) addUser(email, role string) (string, error) {
+	if _, ok := m.users[email]; ok {
+		return "", conflict("create user " + email)
+	}
+
+	n := makeID()
+	m.dbs[n] = newMemDB()
+	m.users[email] = user{email, n, role}
+
+	return n, nil
+}
+
+/*
+ * SCHEMA
+ * The in-memory layout is always the latest, so there is nothing to migrate.
+ */
+
+func (m *memStore) TenantDBs(ctx context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	//Names are db<ULID>, not numbers, so sortedKeys doesn't apply
+	out := make([]string, 0, len(m.dbs))
+	for n := range m.dbs {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+
+	return out, nil
+}
+
+func (m *memStore) SchemaVersion(ctx context.Context, dbv string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, err := m.db(dbv); err != nil {
+		return 0, err
+	}
+
+	return schemaLatest(), nil
+}
+
+func (m *memStore) SchemaMigrate(ctx context.Context, dbv string) (int, int, error) {
+	v, err := m.SchemaVersion(ctx, dbv)
+	return v, v, err
+}
+
+/*
+ * API keys
+ */
+
+func (m *memStore) KeyCreate(ctx context.Context, k ApiKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[k.Id]; ok {
+		return conflict("create api key " + k.Id)
+	}
+	m.keys[k.Id] = k
+
+	return nil
+}
+
+func (m *memStore) KeyGet(ctx context.Context, id string) (ApiKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k, ok := m.keys[id]
+	if !ok {
+		return ApiKey{}, notFound("get api key " + id)
+	}
+
+	return k, nil
+}
+
+func (m *memStore) KeyAll(ctx context.Context, email string) ([]ApiKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var out []ApiKey
+	for _, k := range m.keys {
+		if k.Email == email {
+			out = append(out, k)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created < out[b].Created })
+
+	return out, nil
+}
+
+func (m *memStore) KeyRevoke(ctx context.Context, email, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if k, ok := m.keys[id]; !ok || k.Email != email {
+		return notFound("revoke api key " + id)
+	}
+	delete(m.keys, id)
+
+	return nil
+}
+
+/*
+ * Audit trail
+ */
+
+func (m *memStore) AuditAdd(ctx context.Context, a AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.audit = append(m.audit, a)
+	return nil
+}
+
+func (m *memStore) AuditAll(ctx context.Context, limit int) ([]AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var out []AuditEntry
+	for i := len(m.audit) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, m.audit[i])
+	}
+
+	return out, nil
+}
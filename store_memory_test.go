@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// A memory store with one tenant, and that tenant's db
+func newMemTenant(t *testing.T) (*memStore, string) {
+	t.Helper()
+
+	m := newMemStore()
+	dbv, _, err := m.UserCreate(context.Background(), UserNew{Email: "t@x.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, dbv
+}
+
+// For store calls giving a key: fails t on their error, otherwise gives the key
+func mustKey(t *testing.T) func(string, error) string {
+	return func(k string, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return k
+	}
+}
+
+// Number of entries of list id
+func memEntries(t *testing.T, m *memStore, dbv, id string) int {
+	t.Helper()
+
+	sl, err := m.ListView(context.Background(), dbv, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for _, s := range sl {
+		n += len(s.Items)
+	}
+
+	return n
+}
+
+func TestMemItemDelete(t *testing.T) {
+	ctx := context.Background()
+
+	//Flour is on a list twice and on a template once, salt once on the list
+	setup := func(t *testing.T) (m *memStore, dbv, flour, list string) {
+		m, dbv = newMemTenant(t)
+		must := mustKey(t)
+		flour = must(m.ItemCreate(ctx, dbv, ItemNew{Name: "flour"}))
+		salt := must(m.ItemCreate(ctx, dbv, ItemNew{Name: "salt"}))
+		shop := "Shops/" + must(m.ShopCreate(ctx, dbv, ShopNew{Name: "spar"}))
+
+		l, err := m.ListCreate(ctx, dbv)
+		list = must(l.Id, err)
+		for _, e := range []SlistEdge{
+			{To: "Items/" + flour, From: shop, Price: 10, Currency: "NAD", Qty: 1},
+			{To: "Items/" + flour, From: shop, Price: 12, Currency: "NAD", Qty: 1},
+			{To: "Items/" + salt, From: shop, Price: 3, Currency: "NAD", Qty: 1},
+		} {
+			must(m.ListAddItem(ctx, dbv, list, e))
+		}
+
+		if err := m.TemplatesEnable(ctx, dbv); err != nil {
+			t.Fatal(err)
+		}
+		tpl, err := m.TemplateCreate(ctx, dbv)
+		must(m.TemplateAddItem(ctx, dbv, must(tpl.Id, err), TplEdge{"Items/" + flour, shop, 1}))
+
+		return m, dbv, flour, list
+	}
+
+	tests := []struct {
+		mode    string
+		n       int   //Entries reported
+		err     error //Kind, nil for none
+		gone    bool  //ItemGet no longer finds it
+		entries int   //Left on the list
+	}{
+		{delRestrict, 3, errConflict, false, 3},
+		{delSoft, 3, nil, true, 3},
+		{delCascade, 3, nil, true, 1},
+		{"purge", 0, errBadQuery, false, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			m, dbv, flour, list := setup(t)
+
+			n, err := m.ItemDelete(ctx, dbv, flour, tt.mode)
+			if (tt.err == nil) != (err == nil) || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Fatalf("ItemDelete error = %v, want %v", err, tt.err)
+			}
+			if n != tt.n {
+				t.Errorf("ItemDelete = %d entries, want %d", n, tt.n)
+			}
+
+			_, err = m.ItemGet(ctx, dbv, flour)
+			if gone := errors.Is(err, errNotFound); gone != tt.gone {
+				t.Errorf("ItemGet after delete error = %v, want gone %v", err, tt.gone)
+			}
+			if got := memEntries(t, m, dbv, list); got != tt.entries {
+				t.Errorf("%d list entries left, want %d", got, tt.entries)
+			}
+		})
+	}
+
+	t.Run("soft twice", func(t *testing.T) {
+		m, dbv, flour, _ := setup(t)
+		if _, err := m.ItemDelete(ctx, dbv, flour, delSoft); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.ItemDelete(ctx, dbv, flour, delSoft); !errors.Is(err, errNotFound) {
+			t.Errorf("second soft delete error = %v, want not found", err)
+		}
+	})
+
+	t.Run("restrict unused", func(t *testing.T) {
+		m, dbv, _, _ := setup(t)
+		sugar := mustKey(t)(m.ItemCreate(ctx, dbv, ItemNew{Name: "sugar"}))
+
+		if n, err := m.ItemDelete(ctx, dbv, sugar, delRestrict); n != 0 || err != nil {
+			t.Errorf("ItemDelete = %d, %v, want 0, nil", n, err)
+		}
+	})
+}
+
+func TestMemShopDelete(t *testing.T) {
+	ctx := context.Background()
+
+	//Two entries and a template entry at spar, one entry at shoprite
+	setup := func(t *testing.T) (m *memStore, dbv, spar, shoprite, list string) {
+		m, dbv = newMemTenant(t)
+		must := mustKey(t)
+		item := "Items/" + must(m.ItemCreate(ctx, dbv, ItemNew{Name: "flour"}))
+		spar = must(m.ShopCreate(ctx, dbv, ShopNew{Name: "spar"}))
+		shoprite = must(m.ShopCreate(ctx, dbv, ShopNew{Name: "shoprite"}))
+
+		l, err := m.ListCreate(ctx, dbv)
+		list = must(l.Id, err)
+		for _, e := range []SlistEdge{
+			{To: item, From: "Shops/" + spar, Price: 10, Currency: "NAD", Qty: 1},
+			{To: item, From: "Shops/" + spar, Price: 12, Currency: "NAD", Qty: 2, Tag: "baking"},
+			{To: item, From: "Shops/" + shoprite, Price: 9, Currency: "NAD", Qty: 1},
+		} {
+			must(m.ListAddItem(ctx, dbv, list, e))
+		}
+
+		if err := m.TemplatesEnable(ctx, dbv); err != nil {
+			t.Fatal(err)
+		}
+		tpl, err := m.TemplateCreate(ctx, dbv)
+		must(m.TemplateAddItem(ctx, dbv, must(tpl.Id, err), TplEdge{item, "Shops/" + spar, 1}))
+
+		return m, dbv, spar, shoprite, list
+	}
+
+	//Entries of list by key
+	entries := func(t *testing.T, m *memStore, dbv, list string) map[string]SListItems {
+		t.Helper()
+		sl, err := m.ListView(ctx, dbv, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := map[string]SListItems{}
+		for _, s := range sl {
+			for _, e := range s.Items {
+				out[e.Edge_id] = e
+			}
+		}
+		return out
+	}
+
+	t.Run("restrict", func(t *testing.T) {
+		m, dbv, spar, _, _ := setup(t)
+
+		n, err := m.ShopDelete(ctx, dbv, spar, delRestrict, "")
+		if !errors.Is(err, errConflict) || n != 3 {
+			t.Fatalf("ShopDelete = %d, %v, want 3, conflict", n, err)
+		}
+		if _, err := m.ShopGet(ctx, dbv, spar); err != nil {
+			t.Errorf("shop gone after a refused delete: %v", err)
+		}
+	})
+
+	t.Run("reassign", func(t *testing.T) {
+		m, dbv, spar, shoprite, list := setup(t)
+		before := entries(t, m, dbv, list)
+
+		n, err := m.ShopDelete(ctx, dbv, spar, delReassign, shoprite)
+		if err != nil || n != 3 {
+			t.Fatalf("ShopDelete = %d, %v, want 3, nil", n, err)
+		}
+		if _, err := m.ShopGet(ctx, dbv, spar); !errors.Is(err, errNotFound) {
+			t.Errorf("ShopGet after delete error = %v, want not found", err)
+		}
+
+		//Same keys and details, all at shoprite
+		after := entries(t, m, dbv, list)
+		if len(after) != len(before) {
+			t.Fatalf("%d entries after reassign, want %d", len(after), len(before))
+		}
+		for k, e := range before {
+			a, ok := after[k]
+			if !ok {
+				t.Errorf("entry %s lost its key", k)
+				continue
+			}
+			e.Shop_id = shoprite
+			if a != e {
+				t.Errorf("entry %s = %+v, want %+v", k, a, e)
+			}
+		}
+	})
+
+	t.Run("reassign to itself", func(t *testing.T) {
+		m, dbv, spar, _, _ := setup(t)
+		if _, err := m.ShopDelete(ctx, dbv, spar, delReassign, spar); !errors.Is(err, errBadQuery) {
+			t.Errorf("ShopDelete error = %v, want bad query", err)
+		}
+	})
+
+	t.Run("reassign to an unknown shop", func(t *testing.T) {
+		m, dbv, spar, _, list := setup(t)
+		if _, err := m.ShopDelete(ctx, dbv, spar, delReassign, "999"); !errors.Is(err, errNotFound) {
+			t.Errorf("ShopDelete error = %v, want not found", err)
+		}
+		if n := memEntries(t, m, dbv, list); n != 3 {
+			t.Errorf("%d entries after a refused reassign, want 3", n)
+		}
+	})
+
+	t.Run("cascade", func(t *testing.T) {
+		m, dbv, spar, shoprite, list := setup(t)
+
+		n, err := m.ShopDelete(ctx, dbv, spar, delCascade, "")
+		if err != nil || n != 3 {
+			t.Fatalf("ShopDelete = %d, %v, want 3, nil", n, err)
+		}
+		for k, e := range entries(t, m, dbv, list) {
+			if e.Shop_id != shoprite {
+				t.Errorf("entry %s still at shop %s", k, e.Shop_id)
+			}
+		}
+		if n := memEntries(t, m, dbv, list); n != 1 {
+			t.Errorf("%d entries left, want 1", n)
+		}
+	})
+}
+
+// A missing user and the last admin are told apart
+func TestMemUserDelete(t *testing.T) {
+	ctx := context.Background()
+	m, dbv := newMemTenant(t)
+	if _, err := m.UserSetRole(ctx, "t@x.io", roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.UserDelete(ctx, "nobody@x.io"); !errors.Is(err, errNotFound) {
+		t.Errorf("unknown user: error = %v, want not found", err)
+	}
+	if _, err := m.UserDelete(ctx, "t@x.io"); !errors.Is(err, errLastAdmin) {
+		t.Errorf("last admin: error = %v, want errLastAdmin", err)
+	}
+
+	//With a second admin the first can go, once
+	if _, err := m.addUser("b@x.io", roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	u, err := m.UserDelete(ctx, "t@x.io")
+	if err != nil || u.db != dbv {
+		t.Fatalf("UserDelete = %+v, %v, want db %s", u, err, dbv)
+	}
+	if _, err := m.UserDelete(ctx, "t@x.io"); !errors.Is(err, errNotFound) {
+		t.Errorf("deleted twice: error = %v, want not found", err)
+	}
+	if _, ok := m.dbs[dbv]; ok {
+		t.Error("tenant db kept")
+	}
+}
+
+func TestMemPriceHistory(t *testing.T) {
+	ctx := context.Background()
+	m, dbv := newMemTenant(t)
+	must := mustKey(t)
+
+	flour := must(m.ItemCreate(ctx, dbv, ItemNew{Name: "flour", Nett: 1, Ntt_un: "kg"}))
+	spar := must(m.ShopCreate(ctx, dbv, ShopNew{Name: "spar"}))
+	shoprite := must(m.ShopCreate(ctx, dbv, ShopNew{Name: "shoprite"}))
+	l, err := m.ListCreate(ctx, dbv)
+	list := must(l.Id, err)
+
+	for _, e := range []SlistEdge{
+		{From: "Shops/" + spar, Date: 100, Price: 10, Currency: "NAD"},
+		{From: "Shops/" + spar, Date: 200, Price: 12, Currency: "NAD"},
+		{From: "Shops/" + shoprite, Date: 300, Price: 8, Currency: "NAD"},
+		{From: "Shops/" + shoprite, Date: 400, Price: 1, Currency: "USD"},
+		{From: "Shops/" + spar, Date: 500}, //Not bought yet, so no price
+	} {
+		e.To, e.Qty = "Items/"+flour, 1
+		must(m.ListAddItem(ctx, dbv, list, e))
+	}
+
+	dates := func(h PriceHistory) []int64 {
+		out := []int64{}
+		for _, p := range h.Prices {
+			out = append(out, p.Date)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name  string
+		f     PriceFilter
+		total int
+		dates []int64
+	}{
+		{"all, newest first", PriceFilter{}, 4, []int64{400, 300, 200, 100}},
+		{"from", PriceFilter{From: 200}, 3, []int64{400, 300, 200}},
+		{"to", PriceFilter{To: 200}, 2, []int64{200, 100}},
+		{"shop", PriceFilter{Shop: "Shops/" + spar}, 2, []int64{200, 100}},
+		{"currency", PriceFilter{Currency: "USD"}, 1, []int64{400}},
+		{"limit", PriceFilter{Limit: 2}, 4, []int64{400, 300}},
+		{"offset", PriceFilter{Limit: 2, Offset: 1}, 4, []int64{300, 200}},
+		{"offset past the end", PriceFilter{Offset: 10}, 4, []int64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := m.PriceHistory(ctx, dbv, flour, tt.f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Total != tt.total {
+				t.Errorf("Total = %d, want %d", h.Total, tt.total)
+			}
+			if got := dates(h); !reflect.DeepEqual(got, tt.dates) {
+				t.Errorf("dates = %v, want %v", got, tt.dates)
+			}
+		})
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		h, err := m.PriceHistory(ctx, dbv, flour, PriceFilter{Limit: 1, ByShop: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//Over every match, not just the page
+		want := []PriceStats{{"NAD", 3, 8, 12, 10, 10}, {"USD", 1, 1, 1, 1, 1}}
+		if !reflect.DeepEqual(h.Stats, want) {
+			t.Errorf("Stats = %v, want %v", h.Stats, want)
+		}
+
+		if len(h.Shops) != 2 {
+			t.Fatalf("%d shops, want 2", len(h.Shops))
+		}
+		if s := h.Shops[0]; s.ShopId != spar || !reflect.DeepEqual(s.Stats, []PriceStats{{"NAD", 2, 10, 12, 11, 11}}) {
+			t.Errorf("Shops[0] = %+v", s)
+		}
+	})
+
+	t.Run("unknown item", func(t *testing.T) {
+		if _, err := m.PriceHistory(ctx, dbv, "999", PriceFilter{}); !errors.Is(err, errNotFound) {
+			t.Errorf("error = %v, want not found", err)
+		}
+	})
+
+	t.Run("soft deleted item", func(t *testing.T) {
+		if _, err := m.ItemDelete(ctx, dbv, flour, delSoft); err != nil {
+			t.Fatal(err)
+		}
+		h, err := m.PriceHistory(ctx, dbv, flour, PriceFilter{})
+		if err != nil || h.Total != 4 || h.NettUnit != "kg" {
+			t.Errorf("PriceHistory = %+v, %v, want the 4 prices", h, err)
+		}
+	})
+}
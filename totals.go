@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * LIST TOTALS
+ * What a shopping list comes to (price x qty of every entry), per shop, overall and for
+ * what is in the trolley. Sums are kept apart per currency. With ?in= they are also
+ * converted to one currency using the tenant's exchange rates (Rates), which are set
+ * by hand through /rates; nothing is fetched from outside. Entries without a price or
+ * currency yet, such as those of a list made from a template, are not summed but counted
+ * as unpriced.
+ */
+type Money struct {
+	Currency string  `json:"currency"`
+	Amount   float32 `json:"amount"`
+}
+
+type ListTotals struct {
+	List     string       `json:"list_id"`
+	Shops    []ShopTotals `json:"shops"`
+	Total    []Money      `json:"total"`
+	Trolley  []Money      `json:"trolley"` //Entries in the trolley only
+	Unpriced int          `json:"unpriced"`
+	In       *Converted   `json:"in,omitempty"`
+}
+
+type ShopTotals struct {
+	ShopId   string     `json:"shop_id"`
+	Shop     string     `json:"shop"`
+	Subtotal []Money    `json:"subtotal"`
+	Trolley  []Money    `json:"trolley"`
+	Unpriced int        `json:"unpriced"`
+	In       *Converted `json:"in,omitempty"`
+}
+
+// Totals converted to Currency. Amounts in a currency without a rate to it are left out
+// and listed in Missing.
+type Converted struct {
+	Currency string   `json:"currency"`
+	Total    float32  `json:"total"`
+	Trolley  float32  `json:"trolley"`
+	Missing  []string `json:"missing,omitempty"`
+}
+
+// 1 From is Rate To. Kept in Rates, keyed "From-To".
+type Rate struct {
+	From    string  `json:"from"`
+	To      string  `json:"to"`
+	Rate    float32 `json:"rate"`
+	Updated int64   `json:"updated"` //Unix seconds
+}
+
+// PUT /rates/:from/:to body
+type RateNew struct {
+	Rate float32 `json:"rate"`
+}
+
+func (r Rate) key() string {
+	return r.From + "-" + r.To
+}
+
+// Sums per currency
+type sums map[string]float64
+
+func (s sums) money() []Money {
+	curs := make([]string, 0, len(s))
+	for c := range s {
+		curs = append(curs, c)
+	}
+	sort.Strings(curs)
+
+	out := []Money{}
+	for _, c := range curs {
+		out = append(out, Money{c, cents(s[c])})
+	}
+
+	return out
+}
+
+// Rounded to 2 decimals, which is as precise as prices are entered
+func cents(f float64) float32 {
+	return float32(math.Round(f*100) / 100)
+}
+
+// Rate from one currency to another, by the pair or the inverse of the opposite pair
+type rateTable map[[2]string]float64
+
+func newRateTable(rs []Rate) rateTable {
+	t := rateTable{}
+	for _, r := range rs {
+		t[[2]string{r.From, r.To}] = float64(r.Rate)
+	}
+
+	return t
+}
+
+func (t rateTable) rate(from, to string) (float64, bool) {
+	if from == to {
+		return 1, true
+	}
+	if r, ok := t[[2]string{from, to}]; ok {
+		return r, true
+	}
+	if r, ok := t[[2]string{to, from}]; ok && r != 0 {
+		return 1 / r, true
+	}
+
+	return 0, false
+}
+
+func (t rateTable) convert(in string, total, trolley sums) *Converted {
+	out := &Converted{Currency: in}
+
+	var tot, tro float64
+	for c, v := range total {
+		r, ok := t.rate(c, in)
+		if !ok {
+			out.Missing = append(out.Missing, c)
+			continue
+		}
+		tot += v * r
+		tro += trolley[c] * r
+	}
+	sort.Strings(out.Missing)
+	out.Total, out.Trolley = cents(tot), cents(tro)
+
+	return out
+}
+
+// Whether e can be summed
+func priced(e SListItems) bool {
+	return e.Price != 0 && e.Currency != ""
+}
+
+// Totals of list id as returned by ListView. t may be nil when in is "".
+func listTotals(id string, sl []SList, t rateTable, in string) ListTotals {
+	out := ListTotals{List: id, Shops: []ShopTotals{}}
+	total, trolley := sums{}, sums{}
+
+	for _, s := range sl {
+		sub, subTro, unpriced := sums{}, sums{}, 0
+		for _, e := range s.Items {
+			if !priced(e) {
+				unpriced++
+				continue
+			}
+			v := float64(e.Price) * float64(e.Qty)
+			sub[e.Currency] += v
+			total[e.Currency] += v
+			if e.Trolley {
+				subTro[e.Currency] += v
+				trolley[e.Currency] += v
+			}
+		}
+
+		st := ShopTotals{Shop: s.Shop, Subtotal: sub.money(), Trolley: subTro.money(), Unpriced: unpriced}
+		out.Unpriced += unpriced
+		if len(s.Items) > 0 {
+			st.ShopId = s.Items[0].Shop_id
+		}
+		if in != "" {
+			st.In = t.convert(in, sub, subTro)
+		}
+		out.Shops = append(out.Shops, st)
+	}
+
+	out.Total, out.Trolley = total.money(), trolley.money()
+	if in != "" {
+		out.In = t.convert(in, total, trolley)
+	}
+
+	return out
+}
+
+// Subtotal per shop of the list view
+func setSubtotals(sl []SList) {
+	for n, s := range sl {
+		sub := sums{}
+		for _, e := range s.Items {
+			if !priced(e) {
+				continue
+			}
+			sub[e.Currency] += float64(e.Price) * float64(e.Qty)
+		}
+		sl[n].Subtotal = sub.money()
+	}
+}
+
+/*
+ * Handlers
+ */
+
+// ?in= converts the totals to that currency
+func listGetTotals(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	in := strings.ToUpper(c.QueryParam("in"))
+	if in != "" {
+		var chk checker
+		chk.currency("in", in)
+		if err := chk.err(); err != nil {
+			return err
+		}
+	}
+
+	sl, err := store.ListView(ctx, ctxDB(c), id)
+	if err != nil {
+		return err
+	}
+
+	t, err := rateTableOf(ctx, ctxDB(c), in)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, listTotals(id, sl, t, in))
+}
+
+// Rates are only read when converting
+func rateTableOf(ctx context.Context, dbv, in string) (rateTable, error) {
+	if in == "" {
+		return nil, nil
+	}
+
+	rs, err := store.RateAll(ctx, dbv)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRateTable(rs), nil
+}
+
+func rateGetAll(c echo.Context) error {
+	rs, err := store.RateAll(c.Request().Context(), ctxDB(c))
+	if err != nil {
+		return err
+	}
+	if rs == nil {
+		rs = []Rate{}
+	}
+
+	return c.JSON(http.StatusOK, rs)
+}
+
+// Sets how much 1 :from is in :to, e.g. PUT /rates/USD/NAD {"rate": 18.5}
+func rateSet(c echo.Context) error {
+	var data RateNew
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	r := Rate{strings.ToUpper(c.Param("from")), strings.ToUpper(c.Param("to")), data.Rate, 0}
+	if err := r.validate(); err != nil {
+		return err
+	}
+	r.Updated = time.Now().Unix()
+
+	if err := store.RateSet(c.Request().Context(), ctxDB(c), r); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, r)
+}
+
+func rateDelete(c echo.Context) error {
+	from, to := strings.ToUpper(c.Param("from")), strings.ToUpper(c.Param("to"))
+
+	if err := store.RateDelete(c.Request().Context(), ctxDB(c), from, to); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
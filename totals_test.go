@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A list view at two shops, with an entry made from a template (no price or currency)
+func totalsView() []SList {
+	return []SList{
+		{Shop: "spar", Items: []SListItems{
+			{Price: 10, Currency: "NAD", Qty: 2, Trolley: true, Shop_id: "1"},
+			{Price: 12, Currency: "NAD", Qty: 1, Shop_id: "1"},
+			{Qty: 1, Shop_id: "1"},
+		}},
+		{Shop: "shoprite", Items: []SListItems{
+			{Price: 8, Currency: "NAD", Qty: 1, Shop_id: "2"},
+			{Price: 1, Currency: "USD", Qty: 3, Trolley: true, Shop_id: "2"},
+		}},
+	}
+}
+
+func TestListTotals(t *testing.T) {
+	rates := newRateTable([]Rate{{From: "USD", To: "NAD", Rate: 18.5}})
+	lt := listTotals("7", totalsView(), rates, "NAD")
+
+	if want := []Money{{"NAD", 40}, {"USD", 3}}; !reflect.DeepEqual(lt.Total, want) {
+		t.Errorf("Total = %v, want %v", lt.Total, want)
+	}
+	if want := []Money{{"NAD", 20}, {"USD", 3}}; !reflect.DeepEqual(lt.Trolley, want) {
+		t.Errorf("Trolley = %v, want %v", lt.Trolley, want)
+	}
+	if lt.Unpriced != 1 {
+		t.Errorf("Unpriced = %d, want 1", lt.Unpriced)
+	}
+	if want := (&Converted{Currency: "NAD", Total: 95.5, Trolley: 75.5}); !reflect.DeepEqual(lt.In, want) {
+		t.Errorf("In = %+v, want %+v", lt.In, want)
+	}
+
+	want := []ShopTotals{
+		{"1", "spar", []Money{{"NAD", 32}}, []Money{{"NAD", 20}}, 1, &Converted{Currency: "NAD", Total: 32, Trolley: 20}},
+		{"2", "shoprite", []Money{{"NAD", 8}, {"USD", 3}}, []Money{{"USD", 3}}, 0, &Converted{Currency: "NAD", Total: 63.5, Trolley: 55.5}},
+	}
+	if !reflect.DeepEqual(lt.Shops, want) {
+		t.Errorf("Shops = %+v, want %+v", lt.Shops, want)
+	}
+}
+
+func TestListTotalsConvert(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *Converted
+	}{
+		{"", nil},
+		{"USD", &Converted{Currency: "USD", Total: 5.16, Trolley: 4.08}}, //By the inverse of USD-NAD
+		{"EUR", &Converted{Currency: "EUR", Missing: []string{"NAD", "USD"}}},
+	}
+
+	rates := newRateTable([]Rate{{From: "USD", To: "NAD", Rate: 18.5}})
+	for _, tt := range tests {
+		if got := listTotals("7", totalsView(), rates, tt.in).In; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("in %q = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSetSubtotals(t *testing.T) {
+	sl := totalsView()
+	setSubtotals(sl)
+
+	if want := []Money{{"NAD", 32}}; !reflect.DeepEqual(sl[0].Subtotal, want) {
+		t.Errorf("spar = %v, want %v", sl[0].Subtotal, want)
+	}
+	if want := []Money{{"NAD", 8}, {"USD", 3}}; !reflect.DeepEqual(sl[1].Subtotal, want) {
+		t.Errorf("shoprite = %v, want %v", sl[1].Subtotal, want)
+	}
+}
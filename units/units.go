@@ -0,0 +1,137 @@
+// Package units knows the units an item's nett may be given in, so that quantities
+// like "500 g", "0.5 kg" and "1 lb" can be compared. Every unit belongs to a kind
+// (mass, volume or count) and converts to the base unit of that kind: kilogram, litre
+// or unit (a single piece).
+package units
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Kind string
+
+const (
+	Mass   Kind = "mass"
+	Volume Kind = "volume"
+	Count  Kind = "count"
+)
+
+// Base unit of each kind, which prices are normalized to
+var base = map[Kind]string{
+	Mass:   "kg",
+	Volume: "l",
+	Count:  "unit",
+}
+
+// A known unit. Factor converts one of it to the base unit of its kind.
+type Unit struct {
+	Name   string
+	Kind   Kind
+	Factor float64
+}
+
+// Base unit of u's kind
+func (u Unit) Base() string {
+	return base[u.Kind]
+}
+
+// Canonical units. Volumes are metric only, as imperial and US pints, gallons and
+// fluid ounces differ.
+var known = []Unit{
+	{"mg", Mass, 0.000001},
+	{"g", Mass, 0.001},
+	{"kg", Mass, 1},
+	{"oz", Mass, 0.028349523125},
+	{"lb", Mass, 0.45359237},
+	{"ml", Volume, 0.001},
+	{"cl", Volume, 0.01},
+	{"dl", Volume, 0.1},
+	{"l", Volume, 1},
+	{"ea", Count, 1},
+	{"pk", Count, 1}, //A pack bought as one
+	{"dozen", Count, 12},
+}
+
+// Other spellings, all lower case
+var aliases = map[string]string{
+	"milligram": "mg", "milligrams": "mg",
+	"gram": "g", "grams": "g", "gr": "g",
+	"kilogram": "kg", "kilograms": "kg", "kgs": "kg", "kilo": "kg", "kilos": "kg",
+	"ounce": "oz", "ounces": "oz",
+	"pound": "lb", "pounds": "lb", "lbs": "lb",
+	"millilitre": "ml", "millilitres": "ml", "milliliter": "ml", "milliliters": "ml",
+	"centilitre": "cl", "centilitres": "cl", "centiliter": "cl", "centiliters": "cl",
+	"decilitre": "dl", "decilitres": "dl", "deciliter": "dl", "deciliters": "dl",
+	"litre": "l", "litres": "l", "liter": "l", "liters": "l", "lt": "l", "ltr": "l",
+	"each": "ea", "unit": "ea", "units": "ea", "pc": "ea", "pcs": "ea", "piece": "ea", "pieces": "ea",
+	"pack": "pk", "packs": "pk", "pkt": "pk", "packet": "pk",
+	"dz": "dozen", "doz": "dozen",
+}
+
+var byName = func() map[string]Unit {
+	m := make(map[string]Unit, len(known))
+	for _, u := range known {
+		m[u.Name] = u
+	}
+
+	return m
+}()
+
+// Unit named s, in any case and with or without surrounding space. Aliases such as
+// "grams" or "litre" give the canonical unit.
+func Parse(s string) (Unit, error) {
+	n := strings.ToLower(strings.TrimSpace(s))
+	if a, ok := aliases[n]; ok {
+		n = a
+	}
+
+	u, ok := byName[n]
+	if !ok {
+		return Unit{}, fmt.Errorf("unknown unit %q", s)
+	}
+
+	return u, nil
+}
+
+// Canonical names of every known unit, sorted
+func Names() []string {
+	out := make([]string, 0, len(known))
+	for _, u := range known {
+		out = append(out, u.Name)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// A quantity in the base unit of its kind, e.g. 500 g is 0.5 kg
+type Quantity struct {
+	Value float64
+	Unit  string
+}
+
+// qty of unit s in the base unit of its kind
+func Normalize(qty float64, s string) (Quantity, error) {
+	u, err := Parse(s)
+	if err != nil {
+		return Quantity{}, err
+	}
+
+	return Quantity{qty * u.Factor, u.Base()}, nil
+}
+
+// Price per base unit (kg, l or unit) of an item of nett qty in unit s, e.g. 20 for
+// 500 g at 10, per kg. qty must be more than zero.
+func PricePer(price, qty float64, s string) (float64, string, error) {
+	q, err := Normalize(qty, s)
+	if err != nil {
+		return 0, "", err
+	}
+	if q.Value <= 0 {
+		return 0, "", fmt.Errorf("quantity must be more than zero, not %v", qty)
+	}
+
+	return price / q.Value, q.Unit, nil
+}
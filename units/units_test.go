@@ -0,0 +1,104 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		name string
+		kind Kind
+		ok   bool
+	}{
+		{"g", "g", Mass, true},
+		{" KG ", "kg", Mass, true},
+		{"Grams", "g", Mass, true},
+		{"lbs", "lb", Mass, true},
+		{"litre", "l", Volume, true},
+		{"ML", "ml", Volume, true},
+		{"pcs", "ea", Count, true},
+		{"pack", "pk", Count, true},
+		{"doz", "dozen", Count, true},
+		{"", "", "", false},
+		{"stone", "", "", false},
+		{"gallon", "", "", false},
+	}
+
+	for _, tt := range tests {
+		u, err := Parse(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("Parse(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if u.Name != tt.name || u.Kind != tt.kind {
+			t.Errorf("Parse(%q) = %s %s, want %s %s", tt.in, u.Name, u.Kind, tt.name, tt.kind)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		qty  float64
+		unit string
+		want Quantity
+		ok   bool
+	}{
+		{500, "g", Quantity{0.5, "kg"}, true},
+		{2, "kg", Quantity{2, "kg"}, true},
+		{1, "lb", Quantity{0.45359237, "kg"}, true},
+		{330, "ml", Quantity{0.33, "l"}, true},
+		{75, "cl", Quantity{0.75, "l"}, true},
+		{2, "dozen", Quantity{24, "unit"}, true},
+		{6, "each", Quantity{6, "unit"}, true},
+		{0, "g", Quantity{0, "kg"}, true},
+		{1, "cup", Quantity{}, false},
+	}
+
+	for _, tt := range tests {
+		q, err := Normalize(tt.qty, tt.unit)
+		if (err == nil) != tt.ok {
+			t.Errorf("Normalize(%v, %q) error = %v, want ok %v", tt.qty, tt.unit, err, tt.ok)
+			continue
+		}
+		if !near(q.Value, tt.want.Value) || q.Unit != tt.want.Unit {
+			t.Errorf("Normalize(%v, %q) = %v, want %v", tt.qty, tt.unit, q, tt.want)
+		}
+	}
+}
+
+func TestPricePer(t *testing.T) {
+	tests := []struct {
+		price, qty float64
+		unit       string
+		want       float64
+		per        string
+		ok         bool
+	}{
+		{10, 500, "g", 20, "kg", true},
+		{10, 0.5, "kg", 20, "kg", true},
+		{3, 330, "ml", 3 / 0.33, "l", true},
+		{12, 1, "dozen", 1, "unit", true},
+		{0, 1, "kg", 0, "kg", true},
+		{10, 0, "g", 0, "", false},
+		{10, -1, "kg", 0, "", false},
+		{10, 1, "cup", 0, "", false},
+		{10, 1, "", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		p, per, err := PricePer(tt.price, tt.qty, tt.unit)
+		if (err == nil) != tt.ok {
+			t.Errorf("PricePer(%v, %v, %q) error = %v, want ok %v", tt.price, tt.qty, tt.unit, err, tt.ok)
+			continue
+		}
+		if !near(p, tt.want) || per != tt.per {
+			t.Errorf("PricePer(%v, %v, %q) = %v %s, want %v %s", tt.price, tt.qty, tt.unit, p, per, tt.want, tt.per)
+		}
+	}
+}
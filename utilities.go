@@ -3,7 +3,7 @@ package main
 /**
 Compare all databases ShoppingLIstYYYYMMDD123 with ShoppingLists entries
 Can be used to determine if shopping lists missing from ShoppingLists
-	dbx, ctx := aranDB(ah, adb)
+	dbx, ctx := aranDB(ctx, adb)
 
 	found, err := dbx.Collections(ctx)
 
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+ * API V2
+ * Resource oriented routes under /v2:
+ *   /items, /shops                  GET (?q= to search), POST, GET|PATCH|DELETE /:id
+ *   /items/:id/trend                latest 10 prices of an item
+ *   /items/:id/prices               price history of an item, as /trend/item/:id/history
+ *   /items/:id/compare              prices of an item per shop, as /compare/item/:id
+ *   /lists, /templates              GET, POST, GET|PATCH /:id (templates also DELETE)
+ *   /lists/:id/entries              GET, POST, GET|PATCH|PUT|DELETE /:entryId
+ *   /templates/:id/entries          as for lists
+ *   /lists/:id/totals               as /shoppinglist/totals/:id
+ *   /rates                          as /rates
+ *   /keys                           as /keys
+ * Creating answers 201 with a Location header and the new resource. Deleting answers 204,
+ * except for items and shops, which report what happened to the entries using them.
+ * Every response is a typed document or an array of them, errors are as in errors.go.
+ * PATCH bodies only need the fields being changed. PUT on an entry replaces it, i.e.
+ * moves it to another shop or item, and so gives it a new id.
+ *
+ * The original routes stay as they are while clients move over. /admin was already
+ * resource oriented and isn't repeated here.
+ */
+func v2Routes(e *echo.Echo) {
+	readItems, writeItems := needScope(scopeReadItems), needScope(scopeWriteItems)
+	readShops, writeShops := needScope(scopeReadShops), needScope(scopeWriteShops)
+	readLists, writeLists := needScope(scopeReadLists), needScope(scopeWriteLists)
+	readKeys, writeKeys := needScope(scopeReadKeys), needScope(scopeWriteKeys)
+
+	g := e.Group("/v2", middleUser)
+
+	g.GET("/items", v2ItemList, readItems)
+	g.POST("/items", v2ItemCreate, writeItems)
+	g.GET("/items/:id", itemGetSpecific, readItems)
+	g.PATCH("/items/:id", v2ItemUpdate, writeItems)
+	g.DELETE("/items/:id", itemDelete, writeItems)
+	g.GET("/items/:id/trend", trendGetItem, readLists)
+	g.GET("/items/:id/prices", trendGetHistory, readLists)
+	g.GET("/items/:id/compare", compareGetItem, readLists)
+
+	g.GET("/shops", v2ShopList, readShops)
+	g.POST("/shops", v2ShopCreate, writeShops)
+	g.GET("/shops/:id", shopGetSpecific, readShops)
+	g.PATCH("/shops/:id", v2ShopUpdate, writeShops)
+	g.DELETE("/shops/:id", shopDelete, writeShops)
+
+	g.GET("/lists", v2ListAll, readLists)
+	g.POST("/lists", v2ListCreate, writeLists)
+	g.GET("/lists/:id", v2ListGet, readLists)
+	g.PATCH("/lists/:id", v2ListUpdate, writeLists)
+	g.GET("/lists/:id/totals", listGetTotals, readLists)
+	g.GET("/lists/:id/entries", v2EntryAll, readLists)
+	g.POST("/lists/:id/entries", v2EntryCreate, writeLists)
+	g.GET("/lists/:id/entries/:entryId", v2EntryGet, readLists)
+	g.PATCH("/lists/:id/entries/:entryId", v2EntryUpdate, writeLists)
+	g.PUT("/lists/:id/entries/:entryId", v2EntryMove, writeLists)
+	g.DELETE("/lists/:id/entries/:entryId", v2EntryDelete, writeLists)
+
+	g.GET("/templates", v2TemplateAll, readLists)
+	g.POST("/templates", v2TemplateCreate, writeLists)
+	g.GET("/templates/:id", v2TemplateGet, readLists)
+	g.PATCH("/templates/:id", v2TemplateUpdate, writeLists)
+	g.DELETE("/templates/:id", v2TemplateDelete, writeLists)
+	g.GET("/templates/:id/entries", v2TplEntryAll, readLists)
+	g.POST("/templates/:id/entries", v2TplEntryCreate, writeLists)
+	g.GET("/templates/:id/entries/:entryId", v2TplEntryGet, readLists)
+	g.PATCH("/templates/:id/entries/:entryId", v2TplEntryUpdate, writeLists)
+	g.PUT("/templates/:id/entries/:entryId", v2TplEntryMove, writeLists)
+	g.DELETE("/templates/:id/entries/:entryId", v2TplEntryDelete, writeLists)
+
+	g.GET("/rates", rateGetAll, readLists)
+	g.PUT("/rates/:from/:to", rateSet, writeLists)
+	g.DELETE("/rates/:from/:to", rateDelete, writeLists)
+
+	g.GET("/keys", keyGetAll, readKeys)
+	g.POST("/keys", keyCreate, writeKeys)
+	g.DELETE("/keys/:id", keyRevoke, writeKeys)
+}
+
+// POST /v2/lists body, all optional. Copies the entries of template.
+type ListNew struct {
+	Template string `json:"template,omitempty"`
+}
+
+// POST /v2/templates body, all optional. Copies the entries of list.
+type TemplateNew struct {
+	List string `json:"list,omitempty"`
+}
+
+// 201 with the Location of the new resource
+func created(c echo.Context, loc string, v interface{}) error {
+	c.Response().Header().Set(echo.HeaderLocation, loc)
+	return c.JSON(http.StatusCreated, v)
+}
+
+/*
+ * Items and shops
+ */
+
+func v2ItemList(c echo.Context) error {
+	var items []Item
+	var err error
+
+	if q := c.QueryParam("q"); q != "" {
+		items, err = store.ItemLike(c.Request().Context(), ctxDB(c), q)
+	} else {
+		items, err = store.ItemAll(c.Request().Context(), ctxDB(c))
+	}
+	if err != nil {
+		return err
+	}
+
+	if items == nil {
+		items = []Item{}
+	}
+
+	return c.JSON(http.StatusOK, items)
+}
+
+func v2ItemCreate(c echo.Context) error {
+	var data ItemNew
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	data.normalize()
+	if err := data.validate(); err != nil {
+		return err
+	}
+
+	k, err := store.ItemCreate(c.Request().Context(), ctxDB(c), data)
+	if err != nil {
+		return err
+	}
+
+	return created(c, "/v2/items/"+k, Item{k, data.Name, data.Nett, data.Ntt_un, data.Brand})
+}
+
+func v2ItemUpdate(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	cur, err := store.ItemGet(ctx, ctxDB(c), id)
+	if err != nil {
+		return err
+	}
+
+	//Fields missing from the body keep their current value
+	data := ItemNew{cur.Name, cur.Nett, cur.Ntt_un, cur.Brand}
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	data.normalize()
+	if err := data.validate(); err != nil {
+		return err
+	}
+
+	if _, err := store.ItemUpdate(ctx, ctxDB(c), id, data); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, Item{id, data.Name, data.Nett, data.Ntt_un, data.Brand})
+}
+
+func v2ShopList(c echo.Context) error {
+	var shops []Shop
+	var err error
+
+	if q := c.QueryParam("q"); q != "" {
+		shops, err = store.ShopLike(c.Request().Context(), ctxDB(c), q)
+	} else {
+		shops, err = store.ShopAll(c.Request().Context(), ctxDB(c))
+	}
+	if err != nil {
+		return err
+	}
+
+	if shops == nil {
+		shops = []Shop{}
+	}
+
+	return c.JSON(http.StatusOK, shops)
+}
+
+func v2ShopCreate(c echo.Context) error {
+	var data ShopNew
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	data.normalize()
+	if err := data.validate(); err != nil {
+		return err
+	}
+
+	k, err := store.ShopCreate(c.Request().Context(), ctxDB(c), data)
+	if err != nil {
+		return err
+	}
+
+	return created(c, "/v2/shops/"+k, Shop{k, data.Name, data.Branch, data.City, data.Country})
+}
+
+func v2ShopUpdate(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	cur, err := store.ShopGet(ctx, ctxDB(c), id)
+	if err != nil {
+		return err
+	}
+
+	//Fields missing from the body keep their current value
+	data := ShopNew{cur.Name, cur.Branch, cur.City, cur.Country}
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	data.normalize()
+	if err := data.validate(); err != nil {
+		return err
+	}
+
+	if _, err := store.ShopUpdate(ctx, ctxDB(c), id, data); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, Shop{id, data.Name, data.Branch, data.City, data.Country})
+}
+
+/*
+ * Lists and templates
+ */
+
+// One list or template (tpl) from the overview
+func listDoc(ctx context.Context, dbv, id string, tpl bool) (ShopListsAll, error) {
+	var all []ShopListsAll
+	var err error
+
+	if tpl {
+		all, err = store.TemplateAll(ctx, dbv)
+	} else {
+		all, err = store.ListAll(ctx, dbv, false)
+	}
+	if err != nil {
+		return ShopListsAll{}, err
+	}
+
+	for _, l := range all {
+		if l.Id == id {
+			return l, nil
+		}
+	}
+
+	return ShopListsAll{}, notFound("list " + id)
+}
+
+// ?visible=true leaves out hidden lists
+func v2ListAll(c echo.Context) error {
+	lists, err := store.ListAll(c.Request().Context(), ctxDB(c), c.QueryParam("visible") == "true")
+	if err != nil {
+		return err
+	}
+
+	if lists == nil {
+		lists = []ShopListsAll{}
+	}
+
+	return c.JSON(http.StatusOK, lists)
+}
+
+func v2ListCreate(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var data ListNew
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	var l ShopListsAll
+	var err error
+	if data.Template != "" {
+		l, err = listFromTemplate(ctx, ctxDB(c), data.Template)
+	} else {
+		l, err = store.ListCreate(ctx, ctxDB(c))
+	}
+	if err != nil {
+		return err
+	}
+
+	return created(c, "/v2/lists/"+l.Id, l)
+}
+
+func v2ListGet(c echo.Context) error {
+	l, err := listDoc(c.Request().Context(), ctxDB(c), c.Param("id"), false)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, l)
+}
+
+func v2ListUpdate(c echo.Context) error {
+	return v2ListPatch(c, false)
+}
+
+// PATCH of a list or template (tpl): name, label, hidden or date
+func v2ListPatch(c echo.Context, tpl bool) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	data, err := listDoc(ctx, ctxDB(c), id, tpl)
+	if err != nil {
+		return err
+	}
+
+	//Fields missing from the body keep their current value
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+	data.Id = id
+
+	if err := data.validate(false); err != nil {
+		return err
+	}
+
+	if tpl {
+		_, err = store.TemplateUpdate(ctx, ctxDB(c), id, data)
+	} else {
+		_, err = store.ListUpdate(ctx, ctxDB(c), id, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, data)
+}
+
+// Templates are enabled on first use
+func v2TemplateCreate(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var data TemplateNew
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	if err := store.TemplatesEnable(ctx, ctxDB(c)); err != nil && !errors.Is(err, errConflict) {
+		return err
+	}
+
+	var t ShopListsAll
+	var err error
+	if data.List != "" {
+		t, err = templateFromList(ctx, ctxDB(c), data.List)
+	} else {
+		t, err = store.TemplateCreate(ctx, ctxDB(c))
+	}
+	if err != nil {
+		return err
+	}
+
+	return created(c, "/v2/templates/"+t.Id, t)
+}
+
+func v2TemplateAll(c echo.Context) error {
+	tpls, err := store.TemplateAll(c.Request().Context(), ctxDB(c))
+	if err != nil {
+		return err
+	}
+
+	if tpls == nil {
+		tpls = []ShopListsAll{}
+	}
+
+	return c.JSON(http.StatusOK, tpls)
+}
+
+func v2TemplateGet(c echo.Context) error {
+	t, err := listDoc(c.Request().Context(), ctxDB(c), c.Param("id"), true)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, t)
+}
+
+func v2TemplateUpdate(c echo.Context) error {
+	return v2ListPatch(c, true)
+}
+
+func v2TemplateDelete(c echo.Context) error {
+	if err := store.TemplateRemove(c.Request().Context(), ctxDB(c), c.Param("id")); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+/*
+ * List entries
+ */
+
+// Entries of list id, in shop order
+func listEntries(ctx context.Context, dbv, id string) ([]SListItems, error) {
+	sl, err := store.ListView(ctx, dbv, id)
+	if err != nil {
+		return nil, err
+	}
+
+	setUnitPrices(sl)
+
+	out := []SListItems{}
+	for _, s := range sl {
+		out = append(out, s.Items...)
+	}
+
+	return out, nil
+}
+
+func listEntry(ctx context.Context, dbv, id, key string) (SListItems, error) {
+	all, err := listEntries(ctx, dbv, id)
+	if err != nil {
+		return SListItems{}, err
+	}
+
+	for _, e := range all {
+		if e.Edge_id == key {
+			return e, nil
+		}
+	}
+
+	return SListItems{}, notFound("list " + id + " entry " + key)
+}
+
+// ?shop= and ?trolley=true|false narrow the entries down
+func v2EntryAll(c echo.Context) error {
+	all, err := listEntries(c.Request().Context(), ctxDB(c), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	shop, trolley := c.QueryParam("shop"), c.QueryParam("trolley")
+	out := []SListItems{}
+	for _, e := range all {
+		if shop != "" && e.Shop_id != shop {
+			continue
+		}
+		if trolley != "" && (trolley == "true") != e.Trolley {
+			continue
+		}
+		out = append(out, e)
+	}
+
+	return c.JSON(http.StatusOK, out)
+}
+
+func v2EntryGet(c echo.Context) error {
+	e, err := listEntry(c.Request().Context(), ctxDB(c), c.Param("id"), c.Param("entryId"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, e)
+}
+
+// Body as for PATCH /shoppinglist/additem/:id, _from and _to being shop and item keys
+func v2EntryCreate(c echo.Context) error {
+	return v2EntryPut(c, "")
+}
+
+func v2EntryMove(c echo.Context) error {
+	return v2EntryPut(c, c.Param("entryId"))
+}
+
+// Add an entry, or replace entry key
+func v2EntryPut(c echo.Context, key string) error {
+	ctx := c.Request().Context()
+	dbv, id := ctxDB(c), c.Param("id")
+
+	var data SlistEdge
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	data.normalize()
+	if err := data.validate(ctx, dbv); err != nil {
+		return err
+	}
+
+	data.Date = time.Now().Unix()
+	data.From = "Shops/" + data.From
+	data.To = "Items/" + data.To
+
+	var k string
+	var err error
+	if key == "" {
+		k, err = store.ListAddItem(ctx, dbv, id, data)
+	} else {
+		k, err = store.ListMoveItem(ctx, dbv, id, key, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	e, err := listEntry(ctx, dbv, id, k)
+	if err != nil {
+		return err
+	}
+
+	loc := "/v2/lists/" + id + "/entries/" + k
+	if key == "" {
+		return created(c, loc, e)
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, loc)
+	return c.JSON(http.StatusOK, e)
+}
+
+// Price, currency, qty, special, trolley or tag
+func v2EntryUpdate(c echo.Context) error {
+	ctx := c.Request().Context()
+	dbv, id, key := ctxDB(c), c.Param("id"), c.Param("entryId")
+
+	cur, err := listEntry(ctx, dbv, id, key)
+	if err != nil {
+		return err
+	}
+
+	//Fields missing from the body keep their current value
+	data := SlistEdgeItem{Price: cur.Price, Currency: cur.Currency, Special: cur.Special, Trolley: cur.Trolley, Qty: cur.Qty, Tag: cur.Tag}
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	//The merged entry is checked, so a price given to an unpriced entry needs a currency
+	data.normalize()
+	if err := data.validate(); err != nil {
+		return err
+	}
+	data.Date = time.Now().Unix()
+
+	if _, err := store.ListUpdateItem(ctx, dbv, id, key, data); err != nil {
+		return err
+	}
+
+	e, err := listEntry(ctx, dbv, id, key)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, e)
+}
+
+func v2EntryDelete(c echo.Context) error {
+	if _, err := store.ListRemoveItem(c.Request().Context(), ctxDB(c), c.Param("id"), c.Param("entryId")); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+/*
+ * Template entries
+ */
+
+func templateEntries(ctx context.Context, dbv, id string) ([]TplItem, error) {
+	tv, err := store.TemplateView(ctx, dbv, id)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []TplItem{}
+	for _, t := range tv {
+		out = append(out, t.Items...)
+	}
+
+	return out, nil
+}
+
+func templateEntry(ctx context.Context, dbv, id, key string) (TplItem, error) {
+	all, err := templateEntries(ctx, dbv, id)
+	if err != nil {
+		return TplItem{}, err
+	}
+
+	for _, e := range all {
+		if e.Edge_id == key {
+			return e, nil
+		}
+	}
+
+	return TplItem{}, notFound("template " + id + " entry " + key)
+}
+
+func v2TplEntryAll(c echo.Context) error {
+	all, err := templateEntries(c.Request().Context(), ctxDB(c), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, all)
+}
+
+func v2TplEntryGet(c echo.Context) error {
+	e, err := templateEntry(c.Request().Context(), ctxDB(c), c.Param("id"), c.Param("entryId"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, e)
+}
+
+func v2TplEntryCreate(c echo.Context) error {
+	return v2TplEntryPut(c, "")
+}
+
+func v2TplEntryMove(c echo.Context) error {
+	return v2TplEntryPut(c, c.Param("entryId"))
+}
+
+// Add an entry, or replace entry key
+func v2TplEntryPut(c echo.Context, key string) error {
+	ctx := c.Request().Context()
+	dbv, id := ctxDB(c), c.Param("id")
+
+	var data TplEdge
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	if err := data.validate(ctx, dbv); err != nil {
+		return err
+	}
+
+	data.From = "Shops/" + data.From
+	data.To = "Items/" + data.To
+
+	var k string
+	var err error
+	if key == "" {
+		k, err = store.TemplateAddItem(ctx, dbv, id, data)
+	} else {
+		k, err = store.TemplateMoveItem(ctx, dbv, id, key, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	e, err := templateEntry(ctx, dbv, id, k)
+	if err != nil {
+		return err
+	}
+
+	loc := "/v2/templates/" + id + "/entries/" + k
+	if key == "" {
+		return created(c, loc, e)
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, loc)
+	return c.JSON(http.StatusOK, e)
+}
+
+func v2TplEntryUpdate(c echo.Context) error {
+	ctx := c.Request().Context()
+	dbv, id, key := ctxDB(c), c.Param("id"), c.Param("entryId")
+
+	cur, err := templateEntry(ctx, dbv, id, key)
+	if err != nil {
+		return err
+	}
+
+	data := TplEdgeItem{cur.Qty}
+	if err := c.Bind(&data); err != nil {
+		return err
+	}
+
+	if err := data.validate(); err != nil {
+		return err
+	}
+
+	if _, err := store.TemplateUpdateItem(ctx, dbv, id, key, data); err != nil {
+		return err
+	}
+
+	cur.Qty = data.Qty
+	return c.JSON(http.StatusOK, cur)
+}
+
+func v2TplEntryDelete(c echo.Context) error {
+	if _, err := store.TemplateRemoveItem(c.Request().Context(), ctxDB(c), c.Param("id"), c.Param("entryId")); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
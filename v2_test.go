@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// PATCH on an entry of a list made from a template, which has no price or currency
+func TestV2EntryUpdateUnpriced(t *testing.T) {
+	dbv := newTestTenant(t)
+	id, key := newTemplateList(t, dbv)
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"trolley": true}`, http.StatusOK},
+		{`{"tag": "baking"}`, http.StatusOK},
+		{`{"price": 25.5}`, http.StatusUnprocessableEntity}, //A price needs its currency
+		{`{"price": 25.5, "currency": "nad"}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		rec := callHandler(v2EntryUpdate, http.MethodPatch, tt.body, dbv, "id", id, "entryId", key)
+		if rec.Code != tt.status {
+			t.Errorf("PATCH %s = %d %s, want %d", tt.body, rec.Code, rec.Body, tt.status)
+		}
+	}
+
+	//Each PATCH kept what the ones before it set
+	var e SListItems
+	rec := callHandler(v2EntryGet, http.MethodGet, "", dbv, "id", id, "entryId", key)
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Trolley || e.Tag != "baking" || e.Price != 25.5 || e.Currency != "NAD" || e.Qty != 2 {
+		t.Errorf("entry = %+v", e)
+	}
+}
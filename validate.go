@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"apiServer/units"
+)
+
+/*
+ * REQUEST VALIDATION
+ * Bodies are checked after binding and before they reach the store, as Arango only
+ * enforces what the tenant schema covers (see migrateSchema). Every problem is
+ * collected, so a client gets all of them in one response. httpError answers 422 with
+ * them as details: [{"field": "price", "message": "must not be negative"}]
+ */
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type validationError []fieldError
+
+func (v validationError) Error() string {
+	s := make([]string, len(v))
+	for i, f := range v {
+		s[i] = f.Field + " " + f.Message
+	}
+
+	return "validation failed: " + strings.Join(s, "; ")
+}
+
+// Collects field errors while checking one body
+type checker struct {
+	errs validationError
+}
+
+func (c *checker) add(field, msg string) {
+	c.errs = append(c.errs, fieldError{field, msg})
+}
+
+func (c *checker) required(field, val string) {
+	if strings.TrimSpace(val) == "" {
+		c.add(field, "is required")
+	}
+}
+
+func (c *checker) nonNegative(field string, val float32) {
+	if val < 0 {
+		c.add(field, "must not be negative")
+	}
+}
+
+func (c *checker) positive(field string, val float32) {
+	if val <= 0 {
+		c.add(field, "must be more than zero")
+	}
+}
+
+func (c *checker) currency(field, val string) {
+	if val == "" {
+		c.add(field, "is required")
+	} else if !currencies[val] {
+		c.add(field, "must be an ISO 4217 currency code, e.g. NAD")
+	}
+}
+
+// The currency of a price, needed once there is one. Entries of a list made from a
+// template have neither until they are bought.
+func (c *checker) priceCurrency(field, val string, price float32) {
+	if price > 0 || val != "" {
+		c.currency(field, val)
+	}
+}
+
+// nil when nothing was added
+func (c *checker) err() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+
+	return c.errs
+}
+
+/*
+ * Normalising, done before validating. Names are kept in lower case so that
+ * searches (ItemLike, ShopLike) don't depend on how they were typed.
+ */
+
+// Units are stored by their canonical name, e.g. "kg" for "Kilograms"
+func (i *ItemNew) normalize() {
+	i.Name = strings.ToLower(i.Name)
+	i.Brand = strings.ToLower(i.Brand)
+	i.Ntt_un = strings.ToLower(strings.TrimSpace(i.Ntt_un))
+	if u, err := units.Parse(i.Ntt_un); err == nil {
+		i.Ntt_un = u.Name
+	}
+}
+
+func (s *ShopNew) normalize() {
+	s.Name = strings.ToLower(s.Name)
+	s.Branch = strings.ToLower(s.Branch)
+	s.City = strings.ToLower(s.City)
+	s.Country = strings.ToLower(s.Country)
+}
+
+func (e *SlistEdge) normalize() {
+	e.Currency = strings.ToUpper(e.Currency)
+}
+
+func (e *SlistEdgeItem) normalize() {
+	e.Currency = strings.ToUpper(e.Currency)
+}
+
+/*
+ * Rules per body
+ */
+
+func (i ItemNew) validate() error {
+	var c checker
+
+	c.required("name", i.Name)
+	c.required("brand", i.Brand)
+	c.positive("nett", i.Nett)
+	if i.Ntt_un == "" {
+		c.add("nett_unit", "is required")
+	} else if _, err := units.Parse(i.Ntt_un); err != nil {
+		c.add("nett_unit", "must be a known unit: "+strings.Join(units.Names(), ", "))
+	}
+
+	return c.err()
+}
+
+func (s ShopNew) validate() error {
+	var c checker
+
+	c.required("name", s.Name)
+	c.required("branch", s.Branch)
+	c.required("city", s.City)
+	c.required("country", s.Country)
+
+	return c.err()
+}
+
+// List and template details. label is only required when renaming.
+func (l ShopListsAll) validate(needLabel bool) error {
+	var c checker
+
+	c.required("id", l.Id)
+	c.required("name", l.Name)
+	if l.Date == 0 {
+		c.add("date", "is required")
+	}
+	if needLabel {
+		c.required("label", l.Label)
+	}
+
+	return c.err()
+}
+
+// _to and _from are the bare keys of the item and shop. Both must exist in dbv.
+func (e SlistEdge) validate(ctx context.Context, dbv string) error {
+	var c checker
+
+	c.nonNegative("price", e.Price)
+	c.nonNegative("qty", e.Qty)
+	c.priceCurrency("currency", e.Currency, e.Price)
+
+	return c.refs(ctx, dbv, e.From, e.To)
+}
+
+func (e SlistEdgeItem) validate() error {
+	var c checker
+
+	c.nonNegative("price", e.Price)
+	c.nonNegative("qty", e.Qty)
+	c.priceCurrency("currency", e.Currency, e.Price)
+
+	return c.err()
+}
+
+func (e TplEdge) validate(ctx context.Context, dbv string) error {
+	var c checker
+
+	c.nonNegative("qty", e.Qty)
+
+	return c.refs(ctx, dbv, e.From, e.To)
+}
+
+func (e TplEdgeItem) validate() error {
+	var c checker
+
+	c.positive("qty", e.Qty)
+
+	return c.err()
+}
+
+// 1 from is rate to, in two different currencies
+func (r Rate) validate() error {
+	var c checker
+
+	c.currency("from", r.From)
+	c.currency("to", r.To)
+	if r.From != "" && r.From == r.To {
+		c.add("to", "must differ from from")
+	}
+	c.positive("rate", r.Rate)
+
+	return c.err()
+}
+
+// role may be left out, in which case it isn't changed (or defaults to user)
+func (u UserNew) validate() error {
+	var c checker
+
+	if u.Email == "" {
+		c.add("email", "is required")
+	} else if !validEmail(u.Email) {
+		c.add("email", "is not a valid email address")
+	}
+	if u.Role != "" && u.Role != roleUser && u.Role != roleAdmin {
+		c.add("role", "must be user or admin")
+	}
+
+	return c.err()
+}
+
+// Check the shop and item keys exist, then return everything collected. Lookups are
+// skipped once the body is already invalid. Store failures other than not found are
+// returned as they are.
+func (c *checker) refs(ctx context.Context, dbv, shop, item string) error {
+	c.required("_from", shop)
+	c.required("_to", item)
+	if len(c.errs) > 0 {
+		return c.err()
+	}
+
+	if _, err := store.ShopGet(ctx, dbv, shop); errors.Is(err, errNotFound) {
+		c.add("_from", "no such shop "+shop)
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := store.ItemGet(ctx, dbv, item); errors.Is(err, errNotFound) {
+		c.add("_to", "no such item "+item)
+	} else if err != nil {
+		return err
+	}
+
+	return c.err()
+}
+
+// Active ISO 4217 codes
+var currencies = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, c := range strings.Fields(`
+		AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BOV
+		BRL BSD BTN BWP BYN BZD CAD CDF CHE CHF CHW CLF CLP CNY COP COU CRC CUC CUP CVE
+		CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD
+		HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD
+		KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MXV
+		MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB
+		RWF SAR SBD SCR SDG SEK SGD SHP SLE SLL SOS SRD SSP STN SVC SYP SZL THB TJS TMT
+		TND TOP TRY TTD TWD TZS UAH UGX USD USN UYI UYU UYW UZS VED VES VND VUV WST XAF
+		XCD XDR XOF XPF XSU YER ZAR ZMW ZWL`) {
+		m[c] = true
+	}
+
+	return m
+}()
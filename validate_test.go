@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Fields err complains about, sorted. nil for no error.
+func badFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+
+	var ve validationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("error %v is not a validationError", err)
+	}
+
+	var out []string
+	for _, f := range ve {
+		out = append(out, f.Field)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+func TestValidateBodies(t *testing.T) {
+	item := ItemNew{Name: "flour", Nett: 1, Ntt_un: "kg", Brand: "snowflake"}
+
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{"item", item.validate(), nil},
+		{"item empty", ItemNew{}.validate(), []string{"brand", "name", "nett", "nett_unit"}},
+		{"item blank name", ItemNew{Name: "  ", Nett: 1, Ntt_un: "kg", Brand: "b"}.validate(), []string{"name"}},
+		{"item unknown unit", ItemNew{Name: "a", Nett: 1, Ntt_un: "bunch", Brand: "b"}.validate(), []string{"nett_unit"}},
+		{"item negative nett", ItemNew{Name: "a", Nett: -1, Ntt_un: "kg", Brand: "b"}.validate(), []string{"nett"}},
+
+		{"shop", ShopNew{"spar", "maerua", "windhoek", "namibia"}.validate(), nil},
+		{"shop empty", ShopNew{}.validate(), []string{"branch", "city", "country", "name"}},
+
+		{"list", ShopListsAll{Id: "1", Name: "l", Date: 1}.validate(false), nil},
+		{"list rename without label", ShopListsAll{Id: "1", Name: "l", Date: 1}.validate(true), []string{"label"}},
+		{"list empty", ShopListsAll{}.validate(false), []string{"date", "id", "name"}},
+
+		{"entry", SlistEdgeItem{Price: 10, Currency: "NAD", Qty: 1}.validate(), nil},
+		{"entry unpriced", SlistEdgeItem{Qty: 1, Trolley: true}.validate(), nil},
+		{"entry price without currency", SlistEdgeItem{Price: 10, Qty: 1}.validate(), []string{"currency"}},
+		{"entry unknown currency", SlistEdgeItem{Currency: "XYZ", Qty: 1}.validate(), []string{"currency"}},
+		{"entry negative", SlistEdgeItem{Price: -1, Currency: "NAD", Qty: -1}.validate(), []string{"price", "qty"}},
+
+		{"template entry", TplEdgeItem{Qty: 1}.validate(), nil},
+		{"template entry no qty", TplEdgeItem{}.validate(), []string{"qty"}},
+
+		{"rate", Rate{From: "USD", To: "NAD", Rate: 18.5}.validate(), nil},
+		{"rate same currency", Rate{From: "NAD", To: "NAD", Rate: 1}.validate(), []string{"to"}},
+		{"rate unknown", Rate{From: "usd", To: "", Rate: 0}.validate(), []string{"from", "rate", "to"}},
+
+		{"user", UserNew{Email: "a@x.io"}.validate(), nil},
+		{"user admin", UserNew{Email: "a@x.io", Role: roleAdmin}.validate(), nil},
+		{"user display name", UserNew{Email: "A <a@x.io>"}.validate(), []string{"email"}},
+		{"user role", UserNew{Email: "a@x.io", Role: "root"}.validate(), []string{"role"}},
+		{"user empty", UserNew{}.validate(), []string{"email"}},
+	}
+
+	for _, tt := range tests {
+		if got := badFields(t, tt.err); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: fields %v, want %v (%v)", tt.name, got, tt.want, tt.err)
+		}
+	}
+}
+
+// Shop and item keys of entries are looked up, once the rest is valid
+func TestValidateRefs(t *testing.T) {
+	ctx := context.Background()
+	m, dbv := newMemTenant(t)
+	store = m
+	must := mustKey(t)
+	item := must(m.ItemCreate(ctx, dbv, ItemNew{Name: "flour"}))
+	shop := must(m.ShopCreate(ctx, dbv, ShopNew{Name: "spar"}))
+
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{"entry", SlistEdge{To: item, From: shop, Price: 10, Currency: "NAD", Qty: 1}.validate(ctx, dbv), nil},
+		{"entry unpriced", SlistEdge{To: item, From: shop, Qty: 1}.validate(ctx, dbv), nil},
+		{"entry unknown keys", SlistEdge{To: "999", From: "998", Qty: 1}.validate(ctx, dbv), []string{"_from", "_to"}},
+		{"entry no keys", SlistEdge{Qty: 1}.validate(ctx, dbv), []string{"_from", "_to"}},
+		{"entry invalid skips lookups", SlistEdge{To: "999", From: shop, Qty: -1}.validate(ctx, dbv), []string{"qty"}},
+		{"template entry", TplEdge{To: item, From: shop, Qty: 1}.validate(ctx, dbv), nil},
+		{"template entry unknown shop", TplEdge{To: item, From: "998", Qty: 1}.validate(ctx, dbv), []string{"_from"}},
+	}
+
+	for _, tt := range tests {
+		if got := badFields(t, tt.err); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: fields %v, want %v (%v)", tt.name, got, tt.want, tt.err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	i := ItemNew{Name: "Flour", Brand: "Snowflake", Ntt_un: " Kilograms "}
+	i.normalize()
+	if i != (ItemNew{Name: "flour", Brand: "snowflake", Ntt_un: "kg"}) {
+		t.Errorf("item normalized to %+v", i)
+	}
+
+	//Unknown units are kept, for validate to report
+	i = ItemNew{Ntt_un: "Bunch"}
+	i.normalize()
+	if i.Ntt_un != "bunch" {
+		t.Errorf("unknown unit normalized to %q", i.Ntt_un)
+	}
+
+	e := SlistEdgeItem{Currency: "nad"}
+	e.normalize()
+	if e.Currency != "NAD" {
+		t.Errorf("currency normalized to %q", e.Currency)
+	}
+}